@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// exit statuses of the non-interactive mode
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+
+	errBatchUsage = "only one of -list, -upload, -download, -delete, -c and -script can be given"
+)
+
+// batchOptions holds the flags running a single command without the shell,
+// for cron jobs and CI.
+type batchOptions struct {
+	list     bool
+	delete   string
+	download string
+	upload   string
+	dir      string
+
+	// command and script hold shell commands, run until the first failed
+	// one when exitOnError is set
+	command     string
+	script      string
+	exitOnError bool
+}
+
+func (o batchOptions) actionCount() int {
+	count := 0
+	for _, set := range []bool{o.list, o.delete != "", o.download != "", o.upload != "", o.command != "", o.script != ""} {
+		if set {
+			count++
+		}
+	}
+	return count
+}
+
+// isBatch is true when a command was given with the flags, instead of
+// starting the shell.
+func (o batchOptions) isBatch() bool {
+	return o.actionCount() > 0
+}
+
+// runBatch runs the command given with the flags. -dir is the remote
+// directory for -upload and -list, and the local one for -download. Listed
+// files are written to w, one per line.
+func runBatch(c *client, o batchOptions, w io.Writer) error {
+	if o.actionCount() != 1 {
+		return errors.New(errBatchUsage)
+	}
+
+	switch {
+	case o.command != "":
+		return runScript(c, strings.NewReader(o.command), o.exitOnError)
+	case o.script != "":
+		script, err := openScript(o.script)
+		if err != nil {
+			return err
+		}
+		defer script.Close()
+		return runScript(c, script, o.exitOnError)
+	case o.upload != "":
+		return c.processUpload(o.upload, o.dir)
+	case o.download != "":
+		return c.doDownload(o.download, o.dir)
+	case o.delete != "":
+		return c.doDeleteObject(o.delete, false)
+	}
+
+	matchGlob := ""
+	if o.dir != "" {
+		matchGlob = path.Join(o.dir, "*")
+	}
+
+	files, err := c.getFileList(matchGlob)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchExitStatus maps the error of runBatch to the exit status of the
+// process, so scripts can tell a missing file from other failures.
+func batchExitStatus(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	switch err.Error() {
+	case errBatchUsage:
+		return exitUsage
+	case fileNotFoundError, fileNotFoundRemotelyError, errDeleteFileNotFound:
+		return exitNotFound
+	}
+	return exitFailure
+}
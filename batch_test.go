@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunBatch(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	uploadContent(c, "docs/a.txt", []byte("a"))
+	uploadContent(c, "docs/b.txt", []byte("b"))
+	uploadContent(c, "photos/c.jpg", []byte("c"))
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-batch")
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	assert.Nil(t, runBatch(c, batchOptions{list: true}, &out))
+	assert.Equal(t, "docs/a.txt\ndocs/b.txt\nphotos/c.jpg\n", out.String())
+
+	out.Reset()
+	assert.Nil(t, runBatch(c, batchOptions{list: true, dir: "docs"}, &out))
+	assert.Equal(t, "docs/a.txt\ndocs/b.txt\n", out.String())
+
+	assert.Nil(t, runBatch(c, batchOptions{download: "docs/a.txt", dir: dir}, &out))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.Equal(t, []byte("a"), data)
+
+	ioutil.WriteFile(filepath.Join(dir, "d.txt"), []byte("d"), 0600)
+	assert.Nil(t, runBatch(c, batchOptions{upload: filepath.Join(dir, "d.txt"), dir: "docs"}, &out))
+	assert.Nil(t, runBatch(c, batchOptions{delete: "photos/c.jpg"}, &out))
+
+	out.Reset()
+	assert.Nil(t, runBatch(c, batchOptions{list: true}, &out))
+	assert.Equal(t, "docs/a.txt\ndocs/b.txt\n"+filepath.Join("docs", dir, "d.txt")+"\n", out.String())
+
+	assert.Equal(t, errors.New(errBatchUsage), runBatch(c, batchOptions{list: true, delete: "docs/a.txt"}, &out))
+	assert.Equal(t, errors.New(errBatchUsage), runBatch(c, batchOptions{dir: "docs"}, &out))
+}
+
+func TestBatchExitStatus(t *testing.T) {
+	exitStatusTests := []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitOK},
+		{errors.New(errBatchUsage), exitUsage},
+		{errors.New(fileNotFoundError), exitNotFound},
+		{errors.New(fileNotFoundRemotelyError), exitNotFound},
+		{errors.New(errDeleteFileNotFound), exitNotFound},
+		{errors.New(fileUploadFailError), exitFailure},
+	}
+
+	for _, e := range exitStatusTests {
+		assert.Equal(t, e.expected, batchExitStatus(e.err), e.err)
+	}
+}
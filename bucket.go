@@ -1,16 +1,131 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/progress"
+)
+
 // Bucket is an interface that specifies all the basic functionalities
 // a cloud storage service must impplement.
 type Bucket interface {
 	// Delete file from bucket
 	Delete(name string) error
-	// Upload file to bucket
-	Upload(string, string, []byte) error
-	// Download file from bucket
-	Download(name string) (string, error)
-	// List files in the bucket
-	List() ([]string, error)
+	// Upload everything read from the reader to the bucket. The MD5 of the
+	// data read must be checked against the one of the stored object.
+	Upload(io.Reader, string) error
+	// Download length bytes of a file starting at offset, or the rest of
+	// the file when length is negative. The size of the whole file is
+	// returned along with the reader, which the caller must close.
+	Download(name string, offset, length int64) (io.ReadCloser, int64, error)
+	// List the objects in the bucket, with their size and upload time
+	List() ([]objectInfo, error)
 	// Move the file
 	Move(string, string) error
 }
+
+// objectInfo describes an object of the bucket, as listed by the storage
+// service.
+type objectInfo struct {
+	name    string
+	size    int64
+	updated time.Time
+}
+
+// objectNames returns the names of the listed objects.
+func objectNames(objects []objectInfo) []string {
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.name)
+	}
+	return names
+}
+
+// PassThrough reports what is read from a reader to progress.Default, as the
+// transfer of contentLength bytes of name. The transfer starts on the first
+// read, and ends on EOF, the first error, or when finish is called.
+type PassThrough struct {
+	io.Reader
+	totalRead     int64
+	contentLength int64
+	task          string
+	name          string
+
+	bar      progress.Bar
+	finished bool
+}
+
+func (pt *PassThrough) Read(b []byte) (int, error) {
+	if pt.bar == nil {
+		pt.bar = progress.Default.Start(pt.task, pt.name, pt.contentLength)
+	}
+
+	c, err := pt.Reader.Read(b)
+	pt.totalRead += int64(c)
+	pt.bar.Add(int64(c))
+
+	if err != nil {
+		pt.finish()
+	}
+	return c, err
+}
+
+// finish ends the transfer of a reader that was not read to the end.
+func (pt *PassThrough) finish() {
+	if pt.bar != nil && !pt.finished {
+		pt.bar.Done()
+		pt.finished = true
+	}
+}
+
+// readCloser closes a reader wrapping the body of a download.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+const invalidContentRange = "invalid Content-Range in response"
+
+// isWholeObject is true when a download requests the entire object.
+func isWholeObject(offset, length int64) bool {
+	return offset == 0 && length < 0
+}
+
+// rangeHeader returns the value of the HTTP Range header requesting length
+// bytes from offset, or "" for the whole object.
+func rangeHeader(offset, length int64) string {
+	switch {
+	case isWholeObject(offset, length):
+		return ""
+	case length < 0:
+		return fmt.Sprintf("bytes=%d-", offset)
+	default:
+		return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+}
+
+// objectSize returns the size of the whole object from the response to a,
+// possibly ranged, download.
+func objectSize(res *http.Response) (int64, error) {
+	if res.StatusCode != http.StatusPartialContent {
+		return res.ContentLength, nil
+	}
+
+	contentRange := res.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, errors.New(invalidContentRange)
+	}
+
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, errors.New(invalidContentRange)
+	}
+	return size, nil
+}
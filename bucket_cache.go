@@ -1,7 +1,46 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	bucketCacheVersion = 1
+
+	errBucketCacheVersion = "unsupported name cache version"
+)
+
+// bucketCache maps the encrypted paths of the bucket to their decrypted
+// paths. listed is set once it holds every object of the bucket. Since an
+// encrypted path always decrypts to the same path, the cache never goes
+// stale: listing the bucket is enough to find the added and removed objects.
 type bucketCache struct {
 	seenFiles map[string]string
+	listed    bool
+
+	// dir is where the cache is persisted, encrypted with the vault keys,
+	// none when it is empty. dirty is set when the cache changed since it
+	// was loaded or saved.
+	dir   string
+	dirty bool
+
+	// names remembers the decrypted segments of the names for the session.
+	names *nameDecrypter
+
+	// duplicates maps the decrypted paths held by several objects, like the
+	// files uploaded twice by a write-only client, to the objects not listed.
+	duplicates map[string][]string
+}
+
+// bucketCacheFile is the content of a persisted cache, before encryption.
+type bucketCacheFile struct {
+	Version int               `json:"version"`
+	Files   map[string]string `json:"files"`
 }
 
 func (bc *bucketCache) addFile(encrypted, decrypted string) {
@@ -17,16 +56,153 @@ func (bc *bucketCache) addFile(encrypted, decrypted string) {
 	}
 
 	bc.seenFiles[encrypted] = decrypted
+	bc.dirty = true
 }
 
 func (bc *bucketCache) removeFile(decrypted string) {
 	for encryptedFilePath, decryptedFilePath := range bc.seenFiles {
 		if decryptedFilePath == decrypted {
 			delete(bc.seenFiles, encryptedFilePath)
+			bc.dirty = true
 		}
 	}
+	delete(bc.duplicates, decrypted)
 }
 
 func (bc *bucketCache) empty() {
 	bc.seenFiles = make(map[string]string, 100)
+	bc.listed = false
+	bc.dirty = true
+}
+
+// refresh replaces the cached files with the objects listed in the bucket,
+// only decrypting the paths it does not hold yet, and maps their decrypted
+// paths to the encrypted ones. A path held by several objects is mapped to
+// the first one listed, and reported.
+func (bc *bucketCache) refresh(objects []string, keys *simplecrypto.Keys) decryptedToEncryptedFilePath {
+	var unseen []string
+	for _, e := range objects {
+		if bc.seenFiles[e] == "" && !isReservedObject(e) {
+			unseen = append(unseen, e)
+		}
+	}
+
+	if bc.names == nil || bc.names.keys != keys {
+		bc.names = newNameDecrypter(keys)
+	}
+
+	decrypted := make(map[string]string, len(unseen))
+	paths, errs := bc.names.decryptPaths(unseen)
+	for i, e := range unseen {
+		if errs[i] != nil {
+			// not cached, so it is decrypted again by the next listing
+			log.WithFields(logrus.Fields{"object": e, "error": errs[i]}).Warn("unable to decrypt the name of the object")
+			continue
+		}
+		decrypted[e] = paths[i]
+	}
+
+	files := make(map[string]string, len(objects))
+	m := make(decryptedToEncryptedFilePath, len(objects))
+	bc.duplicates = map[string][]string{}
+
+	for _, e := range objects {
+		if isReservedObject(e) {
+			continue
+		}
+
+		plainTextFilepath := bc.seenFiles[e]
+		if plainTextFilepath == "" {
+			if plainTextFilepath = decrypted[e]; plainTextFilepath == "" {
+				continue
+			}
+			bc.dirty = true
+		}
+
+		files[e] = plainTextFilepath
+		if listed, ok := m[plainTextFilepath]; ok {
+			log.WithFields(logrus.Fields{"file": plainTextFilepath, "object": listed, "duplicate": e}).Warn("file held by several objects, only the first one is listed, deleting the file removes them all")
+			bc.duplicates[plainTextFilepath] = append(bc.duplicates[plainTextFilepath], e)
+			continue
+		}
+		m[plainTextFilepath] = e
+	}
+
+	if len(files) != len(bc.seenFiles) {
+		bc.dirty = true
+	}
+	bc.seenFiles, bc.listed = files, true
+	return m
+}
+
+// replace sets the cached files to the ones found in the manifest.
+func (bc *bucketCache) replace(files decryptedToEncryptedFilePath) {
+	seenFiles := make(map[string]string, len(files))
+	for plaintextPath, encryptedPath := range files {
+		if bc.seenFiles[encryptedPath] != plaintextPath {
+			bc.dirty = true
+		}
+		seenFiles[encryptedPath] = plaintextPath
+	}
+
+	if len(seenFiles) != len(bc.seenFiles) {
+		bc.dirty = true
+	}
+	bc.seenFiles, bc.listed = seenFiles, true
+}
+
+// bucketCacheFileName names the persisted cache of a vault after its keys,
+// without revealing anything about them.
+func bucketCacheFileName(dir string, keys *simplecrypto.Keys) string {
+	return stateFileName(dir, keys, "gcloud-crypto name cache", ".cache")
+}
+
+// load reads the cache of the vault persisted in dir, which is then kept up
+// to date by save. A missing file leaves the cache empty.
+func (bc *bucketCache) load(dir string, keys *simplecrypto.Keys) error {
+	bc.dir = dir
+
+	data, err := readStateFile(bucketCacheFileName(dir, keys), keys)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var cf bucketCacheFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return err
+	} else if cf.Version != bucketCacheVersion {
+		return errors.New(errBucketCacheVersion)
+	}
+
+	bc.seenFiles, bc.dirty = cf.Files, false
+	return nil
+}
+
+// save writes the cache to its file when it changed.
+func (bc *bucketCache) save(keys *simplecrypto.Keys) error {
+	if bc.dir == "" || !bc.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(bucketCacheFile{bucketCacheVersion, bc.seenFiles})
+	if err != nil {
+		return err
+	}
+
+	if err := writeStateFile(bucketCacheFileName(bc.dir, keys), keys, data); err != nil {
+		return err
+	}
+
+	bc.dirty = false
+	return nil
+}
+
+// saveCache persists the name cache, which only speeds up the following
+// commands, so failing to save it is not an error.
+func (c *client) saveCache() {
+	if err := c.bcache.save(c.keys); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warn("unable to save the name cache")
+	}
 }
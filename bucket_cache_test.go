@@ -1,8 +1,12 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestAddFile(t *testing.T) {
@@ -37,3 +41,98 @@ func TestRemoveFile(t *testing.T) {
 		assert.Equal(t, sf.seenFiles[k], finalFilesList[k])
 	}
 }
+
+func TestRefresh(t *testing.T) {
+	keys := testKeys()
+	encryptedA := encryptFilePath("docs/a.txt", &keys)
+	encryptedB := encryptFilePath("docs/b.txt", &keys)
+
+	// a cached name is never decrypted again
+	bc := bucketCache{seenFiles: map[string]string{encryptedA: "cached/a.txt", "removed": "removed.txt"}}
+	m := bc.refresh([]string{encryptedA, encryptedB, VAULT_HEADER_FILE}, &keys)
+
+	assert.Equal(t, decryptedToEncryptedFilePath{"cached/a.txt": encryptedA, "docs/b.txt": encryptedB}, m)
+	assert.Equal(t, map[string]string{encryptedA: "cached/a.txt", encryptedB: "docs/b.txt"}, bc.seenFiles)
+	assert.True(t, bc.listed)
+	assert.True(t, bc.dirty)
+
+	bc.dirty = false
+	bc.refresh([]string{encryptedA, encryptedB}, &keys)
+	assert.False(t, bc.dirty)
+
+	// names failing to decrypt are left out, and not cached
+	otherKeys := simplecrypto.NewRandomKeys()
+	foreign := encryptFilePath("foreign.txt", otherKeys)
+	bc.seenFiles[encryptedB] = ""
+	m = bc.refresh([]string{encryptedA, encryptedB, foreign}, &keys)
+
+	assert.Equal(t, decryptedToEncryptedFilePath{"cached/a.txt": encryptedA, "docs/b.txt": encryptedB}, m)
+	assert.Equal(t, map[string]string{encryptedA: "cached/a.txt", encryptedB: "docs/b.txt"}, bc.seenFiles)
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-cache")
+	defer os.RemoveAll(dir)
+
+	keys := testKeys()
+	otherKeys := simplecrypto.NewRandomKeys()
+
+	// nothing is written until the cache changes
+	bc := bucketCache{}
+	assert.Nil(t, bc.load(dir, &keys))
+	assert.Nil(t, bc.save(&keys))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 0)
+
+	bc.addFile(encryptFilePath("a.txt", &keys), "a.txt")
+	assert.Nil(t, bc.save(&keys))
+	assert.False(t, bc.dirty)
+
+	loaded := bucketCache{}
+	assert.Nil(t, loaded.load(dir, &keys))
+	assert.Equal(t, bc.seenFiles, loaded.seenFiles)
+	assert.False(t, loaded.listed)
+
+	// each vault has its own cache
+	other := bucketCache{}
+	assert.Nil(t, other.load(dir, otherKeys))
+	assert.Empty(t, other.seenFiles)
+
+	// the cache is authenticated
+	file := bucketCacheFileName(dir, &keys)
+	data, _ := ioutil.ReadFile(file)
+	assert.NotContains(t, string(data), "a.txt")
+	data[len(data)/2] ^= 0xFF
+	ioutil.WriteFile(file, data, 0600)
+	assert.Error(t, (&bucketCache{}).load(dir, &keys))
+}
+
+func TestCommandsUseCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-cache")
+	defer os.RemoveAll(dir)
+
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	assert.Nil(t, c.bcache.load(dir, &keys))
+
+	uploadContent(c, "docs/a.txt", []byte("a"))
+	uploadContent(c, "docs/b.txt", []byte("b"))
+	files, _ := c.getFileList("")
+	c.saveCache()
+
+	// a new session takes the names from the cache instead of decrypting
+	// them, which the tampered names show
+	c = newClient(&keys, fb)
+	assert.Nil(t, c.bcache.load(dir, &keys))
+	for encrypted := range c.bcache.seenFiles {
+		c.bcache.seenFiles[encrypted] = "cached/" + c.bcache.seenFiles[encrypted]
+	}
+
+	cachedFiles, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Len(t, cachedFiles, len(files))
+	for i := range files {
+		assert.Equal(t, "cached/"+files[i], cachedFiles[i])
+	}
+}
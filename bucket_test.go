@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeHeader(t *testing.T) {
+	assert.Equal(t, "", rangeHeader(0, -1))
+	assert.Equal(t, "bytes=10-", rangeHeader(10, -1))
+	assert.Equal(t, "bytes=0-9", rangeHeader(0, 10))
+	assert.Equal(t, "bytes=100-149", rangeHeader(100, 50))
+}
+
+func TestObjectSize(t *testing.T) {
+	objectSizeTests := []struct {
+		statusCode    int
+		contentRange  string
+		contentLength int64
+
+		expectedSize  int64
+		expectedError error
+	}{
+		{http.StatusOK, "", 1000, 1000, nil},
+		{http.StatusPartialContent, "bytes 0-9/1000", 10, 1000, nil},
+		{http.StatusPartialContent, "bytes 0-9/*", 10, 0, errors.New(invalidContentRange)},
+		{http.StatusPartialContent, "", 10, 0, errors.New(invalidContentRange)},
+	}
+
+	for _, e := range objectSizeTests {
+		res := &http.Response{StatusCode: e.statusCode, Header: http.Header{}, ContentLength: e.contentLength}
+		res.Header.Set("Content-Range", e.contentRange)
+
+		size, err := objectSize(res)
+		assert.Equal(t, e.expectedError, err)
+		assert.Equal(t, e.expectedSize, size)
+	}
+}
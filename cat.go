@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+)
+
+const (
+	invalidByteRange = "invalid byte range; try using '<start>-<end>', '<start>-' or '-<last bytes>'"
+
+	// lineWindowSize is how much plaintext is fetched at a time when looking
+	// for the lines wanted by head or tail.
+	lineWindowSize = 64 * 1024
+)
+
+// openRemoteFile returns a decrypter reading ranges of a remote file,
+// without downloading it.
+func (c *client) openRemoteFile(remotePath string) (*simplecrypto.RangeDecrypter, error) {
+	files, err := c.listFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedFilepath, ok := files[remotePath]
+	if !ok || remotePath == PASSWORD_CHECK_FILE {
+		return nil, errors.New(fileNotFoundRemotelyError)
+	}
+
+	fetch := func(offset, length int64) (io.ReadCloser, int64, error) {
+		return c.bucket.Download(encryptedFilepath, offset, length)
+	}
+	return simplecrypto.NewRangeDecrypter(fetch, c.keys)
+}
+
+// parseByteRange parses an inclusive HTTP style byte range: "start-end",
+// "start-" or "-last", into an offset and a length in a file of size bytes.
+func parseByteRange(byteRange string, size int64) (int64, int64, error) {
+	i := strings.Index(byteRange, "-")
+	if i < 0 {
+		return 0, 0, errors.New(invalidByteRange)
+	}
+
+	start, end := byteRange[:i], byteRange[i+1:]
+
+	switch {
+	case start == "" && end == "":
+		return 0, 0, errors.New(invalidByteRange)
+	case start == "":
+		last, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || last < 0 {
+			return 0, 0, errors.New(invalidByteRange)
+		}
+		if last > size {
+			last = size
+		}
+		return size - last, last, nil
+	}
+
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 || offset > size {
+		return 0, 0, errors.New(invalidByteRange)
+	}
+
+	if end == "" {
+		return offset, -1, nil
+	}
+
+	endOffset, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || endOffset < offset {
+		return 0, 0, errors.New(invalidByteRange)
+	}
+	return offset, endOffset - offset + 1, nil
+}
+
+func copyRange(w io.Writer, rd *simplecrypto.RangeDecrypter, offset, length int64) error {
+	r, err := rd.NewReader(offset, length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func readRange(rd *simplecrypto.RangeDecrypter, offset, length int64) ([]byte, error) {
+	r, err := rd.NewReader(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// doCat writes a remote file, or only byteRange of it when not empty, to w.
+func (c *client) doCat(remotePath, byteRange string, w io.Writer) error {
+	rd, err := c.openRemoteFile(remotePath)
+	if err != nil {
+		return err
+	}
+
+	offset, length := int64(0), int64(-1)
+	if byteRange != "" {
+		if offset, length, err = parseByteRange(byteRange, rd.Size()); err != nil {
+			return err
+		}
+	}
+
+	return copyRange(w, rd, offset, length)
+}
+
+// doHead writes the first byteCount bytes of a remote file to w, or its
+// first lineCount lines when byteCount is negative.
+func (c *client) doHead(remotePath string, lineCount int, byteCount int64, w io.Writer) error {
+	rd, err := c.openRemoteFile(remotePath)
+	if err != nil {
+		return err
+	}
+
+	if byteCount >= 0 {
+		return copyRange(w, rd, 0, byteCount)
+	}
+
+	for offset := int64(0); offset < rd.Size() && lineCount > 0; offset += lineWindowSize {
+		data, err := readRange(rd, offset, lineWindowSize)
+		if err != nil {
+			return err
+		}
+
+		end := 0
+		for end < len(data) && lineCount > 0 {
+			if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+				end += i + 1
+				lineCount--
+			} else {
+				end = len(data)
+			}
+		}
+
+		if _, err := w.Write(data[:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doTail writes the last byteCount bytes of a remote file to w, or its last
+// lineCount lines when byteCount is negative.
+func (c *client) doTail(remotePath string, lineCount int, byteCount int64, w io.Writer) error {
+	rd, err := c.openRemoteFile(remotePath)
+	if err != nil {
+		return err
+	}
+
+	if byteCount >= 0 {
+		if byteCount > rd.Size() {
+			byteCount = rd.Size()
+		}
+		return copyRange(w, rd, rd.Size()-byteCount, -1)
+	}
+
+	if lineCount <= 0 {
+		return nil
+	}
+
+	var tail []byte
+	for end := rd.Size(); end > 0; end -= lineWindowSize {
+		start := end - lineWindowSize
+		if start < 0 {
+			start = 0
+		}
+
+		data, err := readRange(rd, start, end-start)
+		if err != nil {
+			return err
+		}
+
+		// the newline ending the file does not start a line
+		newlines := bytes.Count(data, []byte("\n"))
+		if end == rd.Size() && len(data) > 0 && data[len(data)-1] == '\n' {
+			newlines--
+		}
+
+		if newlines >= lineCount {
+			i := len(data)
+			if end == rd.Size() {
+				i--
+			}
+			for n := 0; n < lineCount; n++ {
+				i = bytes.LastIndexByte(data[:i], '\n')
+			}
+			tail = append(data[i+1:], tail...)
+			break
+		}
+
+		lineCount -= newlines
+		tail = append(data, tail...)
+	}
+
+	_, err = w.Write(tail)
+	return err
+}
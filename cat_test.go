@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadContent uploads data, encrypted, as remotePath.
+func uploadContent(c *client, remotePath string, data []byte) {
+	encryptedReader, err := simplecrypto.NewEncryptReader(bytes.NewReader(data), c.keys)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.bucket.Upload(encryptedReader, encryptFilePath(remotePath, c.keys)); err != nil {
+		panic(err)
+	}
+}
+
+func numberedLines(count int) []string {
+	lines := make([]string, count)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i)
+	}
+	return lines
+}
+
+func TestParseByteRange(t *testing.T) {
+	byteRangeTests := []struct {
+		byteRange      string
+		offset, length int64
+		expectedError  error
+	}{
+		{"0-9", 0, 10, nil},
+		{"10-", 10, -1, nil},
+		{"-10", 90, 10, nil},
+		{"-200", 0, 100, nil},
+		{"50-500", 50, 451, nil},
+		{"100-", 100, -1, nil},
+		{"101-", 0, 0, errors.New(invalidByteRange)},
+		{"9-0", 0, 0, errors.New(invalidByteRange)},
+		{"-", 0, 0, errors.New(invalidByteRange)},
+		{"10", 0, 0, errors.New(invalidByteRange)},
+		{"a-b", 0, 0, errors.New(invalidByteRange)},
+	}
+
+	for _, e := range byteRangeTests {
+		offset, length, err := parseByteRange(e.byteRange, 100)
+		assert.Equal(t, e.expectedError, err, e.byteRange)
+		assert.Equal(t, e.offset, offset, e.byteRange)
+		assert.Equal(t, e.length, length, e.byteRange)
+	}
+}
+
+func TestDoCat(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	data := randomByte(3*simplecrypto.DefaultChunkSize + 100)
+	uploadContent(c, "dir/file", data)
+
+	catTests := []struct {
+		byteRange string
+		expected  []byte
+	}{
+		{"", data},
+		{"0-9", data[:10]},
+		{"100-", data[100:]},
+		{"-100", data[len(data)-100:]},
+		{fmt.Sprintf("%d-%d", simplecrypto.DefaultChunkSize-10, simplecrypto.DefaultChunkSize+9), data[simplecrypto.DefaultChunkSize-10 : simplecrypto.DefaultChunkSize+10]},
+	}
+
+	for _, e := range catTests {
+		var out bytes.Buffer
+		assert.Nil(t, c.doCat("dir/file", e.byteRange, &out))
+		assert.Equal(t, e.expected, out.Bytes(), e.byteRange)
+	}
+
+	assert.Equal(t, errors.New(fileNotFoundRemotelyError), c.doCat("dir/404", "", &bytes.Buffer{}))
+	assert.Equal(t, errors.New(invalidByteRange), c.doCat("dir/file", "10", &bytes.Buffer{}))
+}
+
+func TestDoCatOnlyDownloadsRange(t *testing.T) {
+	fb, keys := setupUp()
+	bs, ok := fb.(*fakeBucket)
+	if !ok {
+		t.Skip("downloaded bytes can only be counted in the fake bucket")
+	}
+
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	data := randomByte(100 * simplecrypto.DefaultChunkSize)
+	uploadContent(c, "large", data)
+
+	bs.downloadedBytes = 0
+	var out bytes.Buffer
+	assert.Nil(t, c.doCat("large", "-10", &out))
+	assert.Equal(t, data[len(data)-10:], out.Bytes())
+	assert.True(t, bs.downloadedBytes < 2*simplecrypto.DefaultChunkSize, "the whole file was downloaded")
+}
+
+func TestDoCatCorrupted(t *testing.T) {
+	fb, keys := setupUp()
+	bs, ok := fb.(*fakeBucket)
+	if !ok {
+		t.Skip("corruption can only be injected in the fake bucket")
+	}
+
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	uploadContent(c, "file", randomByte(1000))
+
+	bs.corruptDownload = true
+	var out bytes.Buffer
+	assert.Error(t, c.doCat("file", "", &out))
+	assert.Empty(t, out.Bytes(), "unauthenticated plaintext was returned")
+}
+
+func TestDoHeadTail(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	// large enough to need several windows
+	lines := numberedLines(30000)
+	uploadContent(c, "log", []byte(strings.Join(lines, "")))
+	uploadContent(c, "no-newline", []byte("a\nb\nc"))
+	uploadContent(c, "empty", []byte{})
+
+	headTailTests := []struct {
+		file          string
+		lineCount     int
+		byteCount     int64
+		expectedHead  string
+		expectedTail  string
+		expectedError error
+	}{
+		{"log", 10, -1, strings.Join(lines[:10], ""), strings.Join(lines[len(lines)-10:], ""), nil},
+		{"log", 20000, -1, strings.Join(lines[:20000], ""), strings.Join(lines[len(lines)-20000:], ""), nil},
+		{"log", 40000, -1, strings.Join(lines, ""), strings.Join(lines, ""), nil},
+		{"log", 0, -1, "", "", nil},
+		{"log", 10, 12, "line 0\nline ", "\nline 29999\n", nil},
+		{"no-newline", 1, -1, "a\n", "c", nil},
+		{"no-newline", 2, -1, "a\nb\n", "b\nc", nil},
+		{"no-newline", 10, -1, "a\nb\nc", "a\nb\nc", nil},
+		{"empty", 10, -1, "", "", nil},
+		{"404", 10, -1, "", "", errors.New(fileNotFoundRemotelyError)},
+	}
+
+	for _, e := range headTailTests {
+		var head, tail bytes.Buffer
+		assert.Equal(t, e.expectedError, c.doHead(e.file, e.lineCount, e.byteCount, &head))
+		assert.Equal(t, e.expectedError, c.doTail(e.file, e.lineCount, e.byteCount, &tail))
+		assert.Equal(t, e.expectedHead, head.String(), "head of %s", e.file)
+		assert.Equal(t, e.expectedTail, tail.String(), "tail of %s", e.file)
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -12,11 +14,21 @@ import (
 )
 
 const (
-	invalidFormat   = "invalid command line"
-	invalidUpload   = "invalid upload request; try using 'upload <file>' or 'upload <file> <destination directroy>'"
-	invalidDelete   = "invalid delete request; try using 'delete' <path>"
-	invalidDownload = "invalid download request; try using 'download <file>' or 'download <file> <destination folder>'"
-	invalidMove     = "invalid move request; try using 'move <file>' or 'move <file> <destination folder>'"
+	invalidFormat    = "invalid command line"
+	invalidCommand   = "invalid command, try: 'upload', 'list', 'delete', 'download', 'move', 'cat', 'head', 'tail', 'cd', 'pwd', 'migrate', 'passwd', 'keyslot', 'recipient', 'exit'"
+	invalidUpload    = "invalid upload request; try using 'upload <file>' or 'upload <file> <destination directroy>'"
+	invalidDelete    = "invalid delete request; try using 'delete' <path>"
+	invalidDownload  = "invalid download request; try using 'download <file>' or 'download <file> <destination folder>'"
+	invalidMove      = "invalid move request; try using 'move <file>' or 'move <file> <destination folder>'"
+	invalidCat       = "invalid cat request; try using 'cat <file>' or 'cat --range <start>-<end> <file>'"
+	invalidHead      = "invalid head request; try using 'head <file>', 'head -n <lines> <file>' or 'head -c <bytes> <file>'"
+	invalidTail      = "invalid tail request; try using 'tail <file>', 'tail -n <lines> <file>' or 'tail -c <bytes> <file>'"
+	invalidKeySlot   = "invalid keyslot request; try using 'keyslot list', 'keyslot add [-keyfile <file>] [-current-keyfile <file>] <name>' or 'keyslot remove <name>'"
+	invalidRecipient = "invalid recipient request; try using 'recipient list', 'recipient add <name> <recipient>' or 'recipient remove <name>'"
+	invalidCd        = "invalid cd request; try using 'cd <directory>', 'cd ..' or 'cd /'"
+	invalidList      = "invalid ls request; try using 'ls [-lhStr] [<glob>]'"
+
+	defaultLineCount = 10
 )
 
 var completer = readline.NewPrefixCompleter(
@@ -26,15 +38,32 @@ var completer = readline.NewPrefixCompleter(
 	readline.PcItem("delete"),
 	readline.PcItem("list"),
 	readline.PcItem("ls"),
+	readline.PcItem("cat"),
+	readline.PcItem("head"),
+	readline.PcItem("tail"),
+	readline.PcItem("cd"),
+	readline.PcItem("pwd"),
+	readline.PcItem("migrate"),
+	readline.PcItem("passwd"),
+	readline.PcItem("keyslot",
+		readline.PcItem("list"),
+		readline.PcItem("add"),
+		readline.PcItem("remove"),
+	),
+	readline.PcItem("recipient",
+		readline.PcItem("list"),
+		readline.PcItem("add"),
+		readline.PcItem("remove"),
+	),
 	readline.PcItem("exit"),
 )
 
-func setupReadline() (*readline.Instance, error) {
+func setupReadline(c *client) (*readline.Instance, error) {
 	l, err := readline.NewEx(&readline.Config{
-		Prompt:          "\033[31m»\033[0m ",
+		Prompt:          shellPrompt(""),
 		HistoryFile:     "/tmp/readline-gcloud-enc.tmp",
 		InterruptPrompt: "^C",
-		AutoComplete:    completer,
+		AutoComplete:    shellCompleter{c},
 		EOFPrompt:       "exit",
 	})
 
@@ -60,6 +89,90 @@ func readSrcAndDstString(line string) (string, string, error) {
 	}
 }
 
+// readFileWithFlags parses the flags of a command taking a single file.
+func readFileWithFlags(flags *flag.FlagSet, line string) (string, error) {
+	flags.SetOutput(ioutil.Discard)
+
+	parsedLine, err := shellwords.Parse(line)
+	if err != nil {
+		return "", err
+	}
+
+	if err := flags.Parse(parsedLine); err != nil {
+		return "", err
+	} else if flags.NArg() != 1 {
+		return "", errors.New(invalidFormat)
+	}
+	return flags.Arg(0), nil
+}
+
+// parseKeySlotCommand runs the keyslot subcommands, the secrets of the slots
+// are read from keyfiles when given, or asked for.
+func parseKeySlotCommand(c *client, line string) error {
+	subcommand := strings.SplitN(line, " ", 2)[0]
+	args := strings.TrimSpace(strings.TrimPrefix(line, subcommand))
+
+	switch subcommand {
+	case "list":
+		return c.doKeySlotList(os.Stdout)
+	case "add":
+		flags := flag.NewFlagSet("keyslot add", flag.ContinueOnError)
+		keyFile := flags.String("keyfile", "", "")
+		currentKeyFile := flags.String("current-keyfile", "", "")
+		name, err := readFileWithFlags(flags, args)
+		if err != nil {
+			return errors.New(invalidKeySlot)
+		}
+
+		var currentSecret, secret []byte
+		if *currentKeyFile != "" {
+			currentSecret, err = readKeyFile(*currentKeyFile)
+		} else {
+			currentSecret, err = getCurrentSecret()
+		}
+		if err != nil {
+			return err
+		}
+
+		if *keyFile != "" {
+			secret, err = readKeyFile(*keyFile)
+		} else {
+			secret, err = getNewPasswordFromTerminal()
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.doKeySlotAdd(currentSecret, name, secret)
+	case "remove":
+		name, err := readFileWithFlags(flag.NewFlagSet("keyslot remove", flag.ContinueOnError), args)
+		if err != nil {
+			return errors.New(invalidKeySlot)
+		}
+		return c.doKeySlotRemove(name)
+	}
+	return errors.New(invalidKeySlot)
+}
+
+// parseRecipientCommand runs the recipient subcommands.
+func parseRecipientCommand(c *client, line string) error {
+	subcommand := strings.SplitN(line, " ", 2)[0]
+	args, err := shellwords.Parse(strings.TrimSpace(strings.TrimPrefix(line, subcommand)))
+	if err != nil {
+		return errors.New(invalidRecipient)
+	}
+
+	switch {
+	case subcommand == "list" && len(args) == 0:
+		return c.doRecipientList(os.Stdout)
+	case subcommand == "add" && len(args) == 2:
+		return c.doRecipientAdd(args[0], args[1])
+	case subcommand == "remove" && len(args) == 1:
+		return c.doRecipientRemove(args[0])
+	}
+	return errors.New(invalidRecipient)
+}
+
 func parseInteractiveCommand(c *client, line string) error {
 	var returnedError error
 
@@ -69,22 +182,19 @@ func parseInteractiveCommand(c *client, line string) error {
 		if src, dst, err := readSrcAndDstString(cleanLine); err != nil {
 			returnedError = errors.New(invalidUpload)
 		} else {
-			returnedError = c.processUpload(src, dst)
+			returnedError = c.processUpload(src, c.remotePath(dst))
 		}
 	case strings.HasPrefix(line, "ls") || strings.HasPrefix(line, "list"):
-		var (
-			fileList  []string
-			matchGlob string
-		)
+		var args string
 		if strings.HasPrefix(line, "ls") {
-			matchGlob = strings.TrimSpace(strings.TrimLeft(line, "ls"))
+			args = strings.TrimSpace(strings.TrimPrefix(line, "ls"))
 		} else if strings.HasPrefix(line, "list") {
-			matchGlob = strings.TrimSpace(strings.TrimLeft(line, "list"))
+			args = strings.TrimSpace(strings.TrimPrefix(line, "list"))
 		}
-		if matchGlob, returnedError = readString(matchGlob); returnedError != nil {
-			return returnedError
-		} else if fileList, returnedError = c.getFileList(matchGlob); returnedError == nil {
-			enumeratePrint(fileList)
+		if o, matchGlob, err := parseListCommand(args); err != nil {
+			returnedError = err
+		} else {
+			returnedError = c.doList(o, c.remoteGlob(matchGlob), os.Stdout)
 		}
 	case strings.HasPrefix(line, "dirs"):
 		var dirList []string
@@ -92,7 +202,7 @@ func parseInteractiveCommand(c *client, line string) error {
 		if matchGlob, returnedError = readString(matchGlob); returnedError != nil {
 			fmt.Println(returnedError, matchGlob)
 			return returnedError
-		} else if dirList, returnedError = c.getDirList(matchGlob); returnedError == nil {
+		} else if dirList, returnedError = c.getDirList(c.remoteGlob(matchGlob)); returnedError == nil {
 			enumeratePrint(dirList)
 		}
 	case strings.HasPrefix(line, "delete"):
@@ -100,26 +210,79 @@ func parseInteractiveCommand(c *client, line string) error {
 		if deletePath, err := readString(filepath); err != nil {
 			returnedError = errors.New(invalidDelete)
 		} else {
-			returnedError = c.doDeleteObject(deletePath, false)
+			returnedError = c.doDeleteObject(c.remotePath(deletePath), false)
 		}
 	case strings.HasPrefix(line, "download"):
 		cleanLine := strings.TrimSpace(strings.TrimLeft(line, "download"))
 		if src, dst, err := readSrcAndDstString(cleanLine); err != nil {
 			returnedError = errors.New(invalidDownload)
 		} else {
-			returnedError = c.doDownload(src, dst)
+			returnedError = c.doDownload(c.remotePath(src), dst)
 		}
 	case strings.HasPrefix(line, "move"):
 		cleanLine := strings.TrimSpace(strings.TrimLeft(line, "move"))
 		if src, dst, err := readSrcAndDstString(cleanLine); err != nil {
 			returnedError = errors.New(invalidMove)
 		} else {
-			returnedError = c.doMoveObject(src, dst)
+			returnedError = c.doMoveObject(c.remotePath(src), c.remotePath(dst))
+		}
+	case strings.HasPrefix(line, "cat"):
+		flags := flag.NewFlagSet("cat", flag.ContinueOnError)
+		byteRange := flags.String("range", "", "")
+		if file, err := readFileWithFlags(flags, strings.TrimSpace(strings.TrimPrefix(line, "cat"))); err != nil {
+			returnedError = errors.New(invalidCat)
+		} else {
+			returnedError = c.doCat(c.remotePath(file), *byteRange, os.Stdout)
+		}
+	case strings.HasPrefix(line, "head"):
+		flags := flag.NewFlagSet("head", flag.ContinueOnError)
+		lineCount := flags.Int("n", defaultLineCount, "")
+		byteCount := flags.Int64("c", -1, "")
+		if file, err := readFileWithFlags(flags, strings.TrimSpace(strings.TrimPrefix(line, "head"))); err != nil {
+			returnedError = errors.New(invalidHead)
+		} else {
+			returnedError = c.doHead(c.remotePath(file), *lineCount, *byteCount, os.Stdout)
+		}
+	case strings.HasPrefix(line, "tail"):
+		flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+		lineCount := flags.Int("n", defaultLineCount, "")
+		byteCount := flags.Int64("c", -1, "")
+		if file, err := readFileWithFlags(flags, strings.TrimSpace(strings.TrimPrefix(line, "tail"))); err != nil {
+			returnedError = errors.New(invalidTail)
+		} else {
+			returnedError = c.doTail(c.remotePath(file), *lineCount, *byteCount, os.Stdout)
+		}
+	case line == "cd" || strings.HasPrefix(line, "cd "):
+		if dir, err := readString(strings.TrimSpace(strings.TrimPrefix(line, "cd"))); err != nil {
+			returnedError = errors.New(invalidCd)
+		} else {
+			returnedError = c.doCd(dir)
+		}
+	case line == "pwd":
+		returnedError = c.doPwd(os.Stdout)
+	case strings.HasPrefix(line, "migrate"):
+		if password, err := getCurrentSecret(); err != nil {
+			returnedError = err
+		} else if returnedError = c.doMigrate(password); returnedError == nil {
+			fmt.Println("vault migrated, it now has its own keys")
+		}
+	case strings.HasPrefix(line, "passwd"):
+		if oldPassword, err := getCurrentSecret(); err != nil {
+			returnedError = err
+		} else if newPassword, err := getNewPasswordFromTerminal(); err != nil {
+			returnedError = err
+		} else if returnedError = c.doPasswd(oldPassword, newPassword); returnedError == nil {
+			fmt.Println("password changed")
 		}
+	case strings.HasPrefix(line, "keyslot"):
+		returnedError = parseKeySlotCommand(c, strings.TrimSpace(strings.TrimPrefix(line, "keyslot")))
+	case strings.HasPrefix(line, "recipient"):
+		returnedError = parseRecipientCommand(c, strings.TrimSpace(strings.TrimPrefix(line, "recipient")))
 	case strings.HasPrefix(line, "exit"):
+		c.saveCache()
 		os.Exit(0)
 	default:
-		fmt.Println("invalid command, try: 'upload', 'list', 'delete', 'download', 'move', 'exit'")
+		returnedError = errors.New(invalidCommand)
 	}
 	return returnedError
 }
@@ -144,5 +307,7 @@ func interactiveMode(c *client, rl *readline.Instance) {
 		if err != nil {
 			fmt.Println("Error: ", err)
 		}
+		c.saveCache()
+		rl.SetPrompt(shellPrompt(c.cwd))
 	}
 }
@@ -8,10 +8,10 @@ import (
 
 func TestInteractiveMode(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
-	rl, err := setupReadline()
+	rl, err := setupReadline(c)
 	assert.Nil(t, err)
 
 	interactiveMode(c, rl)
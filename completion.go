@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// remotePathCommands complete their arguments with remote paths, and
+// remoteDirCommands only with remote directories.
+var (
+	remotePathCommands = []string{"download", "delete", "move", "ls", "list", "dirs", "cat", "head", "tail"}
+	remoteDirCommands  = []string{"cd"}
+)
+
+// shellCompleter completes the commands of the shell, decrypted remote paths
+// and local paths for upload.
+type shellCompleter struct {
+	c *client
+}
+
+func (sc shellCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	args := strings.Split(string(line[:pos]), " ")
+	if len(args) == 1 {
+		return completer.Do(line, pos)
+	}
+
+	word := args[len(args)-1]
+	switch command := args[0]; {
+	case command == "upload" && len(args) == 2:
+		return completions(word, localEntries(filepath.Dir(word+"x")))
+	case command == "upload":
+		return sc.remoteCompletions(word, true)
+	case isStringInSlice(command, remotePathCommands):
+		return sc.remoteCompletions(word, false)
+	case isStringInSlice(command, remoteDirCommands):
+		return sc.remoteCompletions(word, true)
+	}
+	return completer.Do(line, pos)
+}
+
+func (sc shellCompleter) remoteCompletions(word string, dirsOnly bool) ([][]rune, int) {
+	paths, err := sc.c.cachedPaths()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Debug("unable to complete remote paths")
+		return nil, 0
+	}
+
+	// the part of word up to its last '/' is resolved against the current
+	// remote directory
+	dir := strings.TrimSuffix(sc.c.remotePath(word[:strings.LastIndex(word, "/")+1]), "/")
+
+	var entries []string
+	for _, entry := range remoteEntries(paths, dir) {
+		if !dirsOnly || strings.HasSuffix(entry, "/") {
+			entries = append(entries, entry)
+		}
+	}
+	return completions(word, entries)
+}
+
+// cachedPaths returns the decrypted paths of every file of the bucket from
+// the name cache, which is only filled by listing the bucket when it does not
+// hold every object yet.
+func (c *client) cachedPaths() ([]string, error) {
+	if !c.bcache.listed {
+		if _, err := c.listFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	for _, plaintextPath := range c.bcache.seenFiles {
+		if plaintextPath != "" {
+			paths = append(paths, plaintextPath)
+		}
+	}
+	return paths, nil
+}
+
+// remoteEntries returns the names of the files and directories right below
+// dir, "" being the root, directories ending with '/'.
+func remoteEntries(paths []string, dir string) []string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	seen := map[string]bool{}
+	var entries []string
+	for _, p := range paths {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+
+		entry := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(entry, "/"); i >= 0 {
+			entry = entry[:i+1]
+		}
+
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// localEntries returns the names of the files and directories in the local
+// directory dir, directories ending with '/'.
+func localEntries(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var entries []string
+	for _, f := range files {
+		if f.IsDir() {
+			entries = append(entries, f.Name()+"/")
+		} else {
+			entries = append(entries, f.Name())
+		}
+	}
+	return entries
+}
+
+// completions returns what completes the last path element of word into
+// each of entries, in the format of readline.AutoCompleter. Files are
+// followed by a space, directories are not so their content can be
+// completed next.
+func completions(word string, entries []string) ([][]rune, int) {
+	partial := word[strings.LastIndex(word, "/")+1:]
+
+	var candidates []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, partial) {
+			continue
+		}
+
+		candidate := strings.TrimPrefix(entry, partial)
+		if !strings.HasSuffix(entry, "/") {
+			candidate += " "
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	newLine := make([][]rune, len(candidates))
+	for i, candidate := range candidates {
+		newLine[i] = []rune(candidate)
+	}
+	return newLine, len([]rune(partial))
+}
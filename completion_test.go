@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func completionStrings(newLine [][]rune) []string {
+	candidates := []string{}
+	for _, candidate := range newLine {
+		candidates = append(candidates, string(candidate))
+	}
+	return candidates
+}
+
+func TestShellCompleterRemote(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+
+	uploadContent(c, "docs/2026/report.pdf", []byte("a"))
+	uploadContent(c, "docs/2026/notes.txt", []byte("b"))
+	uploadContent(c, "docs/readme.txt", []byte("c"))
+	uploadContent(c, "photos/a.jpg", []byte("d"))
+
+	sc := shellCompleter{c}
+	completionTests := []struct {
+		cwd            string
+		line           string
+		expected       []string
+		expectedLength int
+	}{
+		{"", "download ", []string{"docs/", "photos/"}, 0},
+		{"", "download do", []string{"cs/"}, 2},
+		{"", "download docs/", []string{"2026/", "readme.txt "}, 0},
+		{"", "delete docs/2026/n", []string{"otes.txt "}, 1},
+		{"", "move docs/readme.txt docs/2", []string{"026/"}, 1},
+		{"", "cd docs/", []string{"2026/"}, 0},
+		{"", "cd docs/r", []string{}, 1},
+		{"", "upload ./report.pdf d", []string{"ocs/"}, 1},
+		{"docs", "cat ", []string{"2026/", "readme.txt "}, 0},
+		{"docs", "ls ../p", []string{"hotos/"}, 1},
+		{"docs/2026", "head /photos/", []string{"a.jpg "}, 0},
+		{"", "down", []string{"load "}, 4},
+		{"", "keyslot re", []string{"move "}, 2},
+	}
+
+	for _, e := range completionTests {
+		c.cwd = e.cwd
+		newLine, length := sc.Do([]rune(e.line), len(e.line))
+		assert.Equal(t, e.expected, completionStrings(newLine), e.line)
+		assert.Equal(t, e.expectedLength, length, e.line)
+	}
+
+	// the names come from the cache, listed once
+	assert.Equal(t, 1, fb.lists)
+
+	// deleted files are dropped from the cache
+	c.cwd = ""
+	assert.Nil(t, c.doDeleteObject("photos/a.jpg", false))
+	newLine, _ := sc.Do([]rune("ls "), 3)
+	assert.Equal(t, []string{"docs/"}, completionStrings(newLine))
+	assert.Equal(t, 2, fb.lists)
+}
+
+func TestShellCompleterLocal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-completion")
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "reports"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "report.pdf"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("b"), 0600)
+
+	sc := shellCompleter{newClient(nil, newFakeBucket())}
+
+	line := "upload " + dir + "/rep"
+	newLine, length := sc.Do([]rune(line), len(line))
+	assert.Equal(t, []string{"ort.pdf ", "orts/"}, completionStrings(newLine))
+	assert.Equal(t, 3, length)
+
+	line = "upload " + dir + "/"
+	newLine, _ = sc.Do([]rune(line), len(line))
+	assert.Equal(t, []string{"notes.txt ", "report.pdf ", "reports/"}, completionStrings(newLine))
+}
@@ -3,28 +3,34 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	_ "github.com/GregorioDiStefano/go-file-storage/log"
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+const (
+	backendGoogle = "google"
+	backendLocal  = "local"
+	backendS3     = "s3"
+)
+
 type userData struct {
 	configFile *viper.Viper
-	salt       []byte
 }
 
-func saltStringToSHA256(salt string) []byte {
-
-	if salt == "" {
-		panic("salt value is empty!")
-	}
-
-	returnSalt := make([]byte, 32)
-	for e := range sha256.Sum256([]byte(salt)) {
-		returnSalt = append(returnSalt, byte(e))
+// legacySalt returns the salt of the vaults created before vault headers.
+// It was meant to be the SHA256 of the 'salt' setting, but the indices of
+// the hash were appended to 32 zero bytes instead of its bytes, so all of
+// these vaults share this salt.
+func legacySalt() []byte {
+	salt := make([]byte, 32)
+	for i := 0; i < sha256.Size; i++ {
+		salt = append(salt, byte(i))
 	}
-	return returnSalt
+	return salt
 }
 
 func parseConfig() *userData {
@@ -38,19 +44,53 @@ func parseConfig() *userData {
 		panic(fmt.Sprintf("Fatal error config file: %s \n", err))
 	}
 
-	switch {
-	case viper.GetString("bucket") == "":
-		panic("'bucket' not set in config file.")
-	case viper.GetString("project_id") == "":
-		panic("'project_id' not set in config file.")
+	viper.SetDefault("backend", backendGoogle)
+	// without the manifest, every command lists the whole bucket
+	viper.SetDefault("manifest", true)
+	viper.SetDefault("concurrency", defaultConcurrency)
+	viper.SetDefault("cache_dir", filepath.Join(os.Getenv("HOME"), ".gcloud-crypto", "cache"))
+	viper.SetDefault("state_dir", filepath.Join(os.Getenv("HOME"), ".gcloud-crypto", "state"))
+	viper.SetDefault("resumable_threshold", defaultResumableThreshold)
+
+	switch viper.GetString("backend") {
+	case backendGoogle:
+		switch {
+		case viper.GetString("bucket") == "":
+			panic("'bucket' not set in config file.")
+		case viper.GetString("project_id") == "":
+			panic("'project_id' not set in config file.")
+		}
+	case backendLocal:
+		if viper.GetString("path") == "" {
+			panic("'path' not set in config file.")
+		}
+	case backendS3:
+		viper.SetDefault("region", "us-east-1")
+		viper.SetDefault("access_key", os.Getenv("AWS_ACCESS_KEY_ID"))
+		viper.SetDefault("secret_key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+
+		switch {
+		case viper.GetString("endpoint") == "":
+			panic("'endpoint' not set in config file.")
+		case viper.GetString("bucket") == "":
+			panic("'bucket' not set in config file.")
+		case viper.GetString("access_key") == "" || viper.GetString("secret_key") == "":
+			panic("'access_key' and 'secret_key' not set in config file.")
+		}
+	default:
+		panic(fmt.Sprintf("unknown backend '%s' in config file.", viper.GetString("backend")))
 	}
 
-	// be default, use the SHA256 of the project_id as the salt
-	viper.SetDefault("salt", viper.GetString("project_id"))
+	log.WithFields(logrus.Fields{"backend": viper.GetString("backend"), "bucket": viper.GetString("bucket"), "project_id": viper.GetString("project_id")}).Debug("Loaded config")
+	return &userData{viper.GetViper()}
+}
 
-	saltString := viper.GetString("salt")
-	salt := []byte(saltStringToSHA256(saltString))
+// cacheDir is the directory holding the name caches of the vaults.
+func (ud *userData) cacheDir() string {
+	return ud.configFile.GetString("cache_dir")
+}
 
-	log.WithFields(logrus.Fields{"bucket": viper.GetString("bucket"), "project_id": viper.GetString("project_id")}).Debug("Loaded config")
-	return &userData{viper.GetViper(), salt}
+// stateDir is the directory holding the state of the interrupted transfers.
+func (ud *userData) stateDir() string {
+	return ud.configFile.GetString("state_dir")
 }
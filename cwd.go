@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	errRemoteDirNotFound = "no such remote directory"
+)
+
+// remotePath resolves p against the current remote directory, paths
+// starting with '/' being relative to the root of the bucket. A trailing
+// '/' is kept, since it marks directories for download and move, so the
+// root itself resolves to "/".
+func (c *client) remotePath(p string) string {
+	dir := c.cwd
+	if strings.HasPrefix(p, "/") {
+		dir = ""
+	}
+
+	resolved := strings.TrimPrefix(path.Join("/", dir, p), "/")
+	if strings.HasSuffix(p, "/") && resolved != "" {
+		resolved += "/"
+	} else if strings.HasSuffix(p, "/") {
+		resolved = "/"
+	}
+	return resolved
+}
+
+// remoteGlob resolves the glob of ls and dirs, an empty one matching
+// everything below the current remote directory.
+func (c *client) remoteGlob(matchGlob string) string {
+	if matchGlob == "" && c.cwd == "" {
+		return ""
+	} else if matchGlob == "" {
+		return c.cwd + "/*"
+	}
+	return c.remotePath(matchGlob)
+}
+
+// doCd changes the current remote directory, which must hold at least one
+// file. An empty dir goes back to the root.
+func (c *client) doCd(dir string) error {
+	if dir != "" {
+		dir = strings.TrimSuffix(c.remotePath(dir), "/")
+	}
+
+	if dir == "" {
+		c.cwd = ""
+		return nil
+	}
+
+	files, err := c.listFiles()
+	if err != nil {
+		return err
+	}
+
+	for plaintextPath := range files {
+		if strings.HasPrefix(plaintextPath, dir+"/") {
+			c.cwd = dir
+			return nil
+		}
+	}
+	return errors.New(errRemoteDirNotFound)
+}
+
+// doPwd writes the current remote directory to w.
+func (c *client) doPwd(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "/"+c.cwd)
+	return err
+}
+
+// shellPrompt returns the prompt of the shell, showing the current remote
+// directory.
+func shellPrompt(cwd string) string {
+	return "\033[31m/" + cwd + " »\033[0m "
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemotePath(t *testing.T) {
+	remotePathTests := []struct {
+		cwd      string
+		path     string
+		expected string
+	}{
+		{"", "", ""},
+		{"", "a.txt", "a.txt"},
+		{"", "/", "/"},
+		{"", "docs/", "docs/"},
+		{"", "..", ""},
+		{"docs", "", "docs"},
+		{"docs", "a.txt", "docs/a.txt"},
+		{"docs", "*.txt", "docs/*.txt"},
+		{"docs", "old/", "docs/old/"},
+		{"docs", "/photos/a.jpg", "photos/a.jpg"},
+		{"docs/2026", "../a.txt", "docs/a.txt"},
+		{"docs/2026", "../../../a.txt", "a.txt"},
+		{"docs", "./", "docs/"},
+		{"docs", "../", "/"},
+	}
+
+	for _, e := range remotePathTests {
+		c := &client{cwd: e.cwd}
+		assert.Equal(t, e.expected, c.remotePath(e.path), e.cwd+" "+e.path)
+	}
+
+	assert.Equal(t, "", (&client{}).remoteGlob(""))
+	assert.Equal(t, "docs/*", (&client{cwd: "docs"}).remoteGlob(""))
+	assert.Equal(t, "docs/*.txt", (&client{cwd: "docs"}).remoteGlob("*.txt"))
+}
+
+func TestCdAndPwd(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	uploadContent(c, "docs/2026/a.txt", []byte("a"))
+	uploadContent(c, "photos/b.jpg", []byte("b"))
+
+	cdTests := []struct {
+		dir           string
+		expectedCwd   string
+		expectedError error
+	}{
+		{"docs", "docs", nil},
+		{"2026/", "docs/2026", nil},
+		{"a.txt", "docs/2026", errors.New(errRemoteDirNotFound)},
+		{"../..", "", nil},
+		{"/docs/2026", "docs/2026", nil},
+		{"/missing", "docs/2026", errors.New(errRemoteDirNotFound)},
+		{"/photos", "photos", nil},
+		{"", "", nil},
+	}
+
+	for _, e := range cdTests {
+		assert.Equal(t, e.expectedError, c.doCd(e.dir), e.dir)
+		assert.Equal(t, e.expectedCwd, c.cwd, e.dir)
+	}
+
+	var out bytes.Buffer
+	c.cwd = "docs/2026"
+	assert.Nil(t, c.doPwd(&out))
+	assert.Equal(t, "/docs/2026\n", out.String())
+}
+
+func TestShellRelativePaths(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	uploadContent(c, "docs/a.txt", []byte("a"))
+
+	assert.Nil(t, parseInteractiveCommand(c, "cd docs"))
+	assert.Nil(t, parseInteractiveCommand(c, "upload testdata/testdata1"))
+	assert.Nil(t, parseInteractiveCommand(c, "move a.txt /photos/a.txt"))
+	assert.Nil(t, parseInteractiveCommand(c, "delete testdata/testdata1"))
+	assert.Equal(t, errors.New(invalidCd), parseInteractiveCommand(c, "cd a b"))
+
+	files, err := c.getFileList(c.remoteGlob(""))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	files, err = c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"photos/a.txt"}, files)
+}
@@ -14,11 +14,12 @@ const (
 
 func (c *client) doDeleteObject(filepath string, encrypted bool) error {
 	fileFound := false
-	objects, err := c.bucket.List()
+	decToEncPaths, err := c.listFiles()
 
 	if err != nil {
-		return errors.New("failed getting objects: " + err.Error())
+		return err
 	}
+	defer c.endManifestUpdate()
 
 	if encrypted {
 		filepath, err = decryptFilePath(filepath, c.keys)
@@ -33,7 +34,6 @@ func (c *client) doDeleteObject(filepath string, encrypted bool) error {
 		return errors.New("not perform destructive delete")
 	}
 
-	decToEncPaths := getDecryptedToEncryptedFileMapping(objects, c.keys)
 	for plaintextFilename := range decToEncPaths {
 		if glob.Glob(filepath, plaintextFilename) && plaintextFilename != PASSWORD_CHECK_FILE {
 			fileFound = true
@@ -42,9 +42,19 @@ func (c *client) doDeleteObject(filepath string, encrypted bool) error {
 				return errors.New(errDeleteFileNotFound)
 			}
 
+			if err := c.beginManifestUpdate(); err != nil {
+				return err
+			}
 			if err := c.bucket.Delete(encryptedFilename); err != nil {
 				return err
 			}
+			for _, duplicate := range c.bcache.duplicates[plaintextFilename] {
+				if err := c.bucket.Delete(duplicate); err != nil {
+					return err
+				}
+			}
+			c.bcache.removeFile(plaintextFilename)
+			c.manifestRemove(plaintextFilename)
 			log.WithFields(logrus.Fields{"filename": plaintextFilename}).Debug("deleted file.")
 		}
 	}
@@ -10,7 +10,7 @@ import (
 
 func TestDoDeleteObject(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 
 	uploadTests := []struct {
 		uploadFilepath string
@@ -47,3 +47,25 @@ func TestDoDeleteObject(t *testing.T) {
 		}
 	}
 }
+
+func TestDoDeleteObjectFails(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+
+	err := c.processUpload("testdata/testdata1", "")
+	assert.Nil(t, err)
+
+	fb.deleteErr = errors.New(errFakeInjected)
+	err = c.doDeleteObject("testdata/testdata1", false)
+	assert.Equal(t, fb.deleteErr, err)
+
+	fb.deleteErr = nil
+	fb.listErr = errors.New("failed to get objects in bucket")
+	err = c.doDeleteObject("testdata/testdata1", false)
+	assert.Error(t, err)
+
+	fb.listErr = nil
+	fileList, _ := c.getFileList("")
+	assert.Equal(t, []string{"testdata/testdata1"}, fileList)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	_ "fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
@@ -15,8 +18,15 @@ import (
 const (
 	fileNotFoundRemotelyError  = "File not found"
 	destinationFileExistsError = "File already exists locally"
+	destinationOutsideError    = "File would be downloaded outside of the destination directory"
 )
 
+// isUnder is true when file is dir, or lies below it.
+func isUnder(dir, file string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(file))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
 func moveDownload(source, destination string) error {
 	log.Debugf("downloaded file to: %s", destination)
 	if destStat, err := os.Stat(destination); err == nil {
@@ -33,11 +43,88 @@ func moveDownload(source, destination string) error {
 	return os.Rename(source, destination)
 }
 
+// downloadAndDecrypt downloads and decrypts an object to destination. The
+// objects large enough to be uploaded through resumable sessions are first
+// downloaded to the state directory, so interrupted downloads can be
+// resumed, and checked against their hashes; the others are streamed
+// through decryption.
+func (c *client) downloadAndDecrypt(encryptedFilepath, destination string) error {
+	download, size, err := c.bucket.Download(encryptedFilepath, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	if vb, ok := c.bucket.(versionedBucket); ok && c.isResumable(size) {
+		download.Close()
+		return c.downloadStaged(vb, encryptedFilepath, destination)
+	}
+	defer download.Close()
+
+	pt := &PassThrough{Reader: download, contentLength: size, task: "Downloading", name: destination}
+	defer pt.finish()
+
+	return c.decryptTo(pt, destination)
+}
+
+// downloadStaged downloads an object to the state directory, then decrypts
+// it to destination.
+func (c *client) downloadStaged(vb versionedBucket, encryptedFilepath, destination string) error {
+	partial, err := c.downloadPartial(vb, encryptedFilepath, destination)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+
+	f, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.decryptTo(f, destination)
+}
+
+// decryptTo decrypts into a temporary file next to the destination, which
+// is only moved in place once every chunk has been authenticated.
+func (c *client) decryptTo(r io.Reader, destination string) error {
+	os.MkdirAll(filepath.Dir(destination), 0777)
+	tmp, err := ioutil.TempFile(filepath.Dir(destination), ".download-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, simplecrypto.NewDecryptReader(r, c.keys))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := moveDownload(tmp.Name(), destination); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// downloadJob is a remote file to download and where to.
+type downloadJob struct {
+	remotePath  string
+	object      string
+	destination string
+}
+
+// doDownload downloads the files matching downloadPath, c.concurrency at a
+// time. The files already there locally are skipped; a failed download does
+// not stop the others, the failures are all reported at the end.
 func (c *client) doDownload(downloadPath, destinationDir string) error {
-	objects, err := c.bucket.List()
+	decToEncPaths, err := c.listFiles()
 
 	if err != nil {
-		return errors.New("failed getting objects: " + err.Error())
+		return err
 	}
 
 	if len(destinationDir) > 0 {
@@ -47,8 +134,9 @@ func (c *client) doDownload(downloadPath, destinationDir string) error {
 		}
 	}
 
-	decToEncPaths := getDecryptedToEncryptedFileMapping(objects, c.keys)
 	foundFile := false
+	jobs := []downloadJob{}
+	var rejected []transferFailure
 
 	for remotePlaintextPath := range decToEncPaths {
 		globMatched := glob.Glob(downloadPath, remotePlaintextPath)
@@ -56,25 +144,9 @@ func (c *client) doDownload(downloadPath, destinationDir string) error {
 		if globMatched || isDirectoryDownload {
 			foundFile = true
 			finalDownloadDestination := ""
-			log.Infof("Downloading: %s", remotePlaintextPath)
 
 			encryptedFilepath := decToEncPaths[remotePlaintextPath]
-			decryptedFilePath, _ := decryptFilePath(decToEncPaths[remotePlaintextPath], c.keys)
-			downloadedEncryptedFile, err := c.bucket.Download(encryptedFilepath)
-			defer os.Remove(downloadedEncryptedFile)
-
-			if err != nil {
-				return err
-			}
-
-			downloadedPlaintextFile, err := simplecrypto.DecryptFile(downloadedEncryptedFile, c.keys)
-
-			if err != nil {
-				return err
-			}
-
-			_, tempDownloadFilename := path.Split(downloadedPlaintextFile)
-			_, actualFilename := path.Split(decryptedFilePath)
+			_, actualFilename := path.Split(remotePlaintextPath)
 
 			if isDirectoryDownload {
 				finalDownloadDestination = filepath.Join(destinationDir, filepath.Dir(remotePlaintextPath), actualFilename)
@@ -87,19 +159,41 @@ func (c *client) doDownload(downloadPath, destinationDir string) error {
 				finalDownloadDestination = filepath.Join(destinationDir, relativeDownloadPath)
 			}
 
+			if !isUnder(destinationDir, finalDownloadDestination) {
+				log.Errorf("%s would be downloaded to %s, skipping", remotePlaintextPath, finalDownloadDestination)
+				rejected = append(rejected, transferFailure{remotePlaintextPath, errors.New(destinationOutsideError)})
+				continue
+			}
+
 			//TODO: check if filesize matches
 			if _, err := os.Stat(finalDownloadDestination); err == nil {
 				log.Errorf("file already exists: %s exists locally, skipping", finalDownloadDestination)
-				os.Remove(downloadedPlaintextFile)
 				continue
 			}
 
-			moveDownload(tempDownloadFilename, finalDownloadDestination)
-			os.Remove(downloadedEncryptedFile)
+			jobs = append(jobs, downloadJob{remotePlaintextPath, encryptedFilepath, finalDownloadDestination})
 		}
 	}
 	if !foundFile {
 		return errors.New(fileNotFoundRemotelyError)
 	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].remotePath < jobs[j].remotePath })
+	errs := runTransfers(c.concurrency, len(jobs), func(i int) error {
+		log.Infof("Downloading: %s", jobs[i].remotePath)
+		return c.downloadAndDecrypt(jobs[i].object, jobs[i].destination)
+	})
+
+	te := &transferError{op: "download", total: len(jobs) + len(rejected), failures: rejected}
+	for i, err := range errs {
+		if err != nil {
+			log.Infof("failed with %s when downloading: %s", err.Error(), jobs[i].remotePath)
+			te.failures = append(te.failures, transferFailure{jobs[i].remotePath, err})
+		}
+	}
+
+	if len(te.failures) > 0 {
+		return te
+	}
 	return nil
 }
@@ -1,10 +1,9 @@
 package main
 
 import (
-	//"io/ioutil"
-
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,7 +16,7 @@ func TestDoDownload(t *testing.T) {
 	bs, keys := setupUp()
 
 	uploadPath := "testdata"
-	c := client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	c.processUpload(uploadPath, "")
 
 	downloadTests := []struct {
@@ -59,3 +58,112 @@ func TestDoDownload(t *testing.T) {
 		}
 	}
 }
+
+func TestDoDownloadFaults(t *testing.T) {
+	downloadFaultTests := []struct {
+		truncateDownload int
+		corruptDownload  bool
+		listErr          error
+	}{
+		{1, false, nil},
+		{64, false, nil},
+		{0, true, nil},
+		{0, false, errors.New("failed to get objects in bucket")},
+	}
+
+	for _, e := range downloadFaultTests {
+		fb := newFakeBucket()
+		keys := testKeys()
+		c := newClient(&keys, fb)
+
+		err := c.processUpload("testdata/testdata1", "")
+		assert.Nil(t, err)
+
+		fb.truncateDownload = e.truncateDownload
+		fb.corruptDownload = e.corruptDownload
+		fb.listErr = e.listErr
+
+		tempDir, _ := ioutil.TempDir("", "dlfaults")
+		defer os.RemoveAll(tempDir)
+
+		err = c.doDownload("testdata/testdata1", tempDir)
+		assert.Error(t, err)
+
+		_, err = os.Stat(filepath.Join(tempDir, "testdata1"))
+		assert.True(t, os.IsNotExist(err), "a corrupted download must not be written to its destination")
+	}
+}
+
+func TestDoDownloadParallel(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	c.concurrency = 4
+
+	assert.Nil(t, c.processUpload("testdata/testdata*", "testdata"))
+
+	// corrupt a single object, the other files still get downloaded
+	files, _ := c.listFiles()
+	corrupted := fb.objects[files["testdata/testdata3"]]
+	corrupted[len(corrupted)/2] ^= 0xFF
+
+	tempDir, _ := ioutil.TempDir("", "dlparallel")
+	defer os.RemoveAll(tempDir)
+
+	err := c.doDownload("testdata/testdata*", tempDir)
+	te, ok := err.(*transferError)
+	assert.True(t, ok)
+	assert.Equal(t, 6, te.total)
+	assert.Len(t, te.failures, 1)
+	assert.Equal(t, "testdata/testdata3", te.failures[0].file)
+
+	for _, name := range []string{"testdata1", "testdata2", "testdata4", "testdata5", "testdata6"} {
+		expected, _ := ioutil.ReadFile(filepath.Join("testdata", name))
+		actual, err := ioutil.ReadFile(filepath.Join(tempDir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	_, err = os.Stat(filepath.Join(tempDir, "testdata3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDoDownloadOutsideDestination(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	uploadContent(c, "docs/a.txt", []byte("some text"))
+	uploadContent(c, "docs/../../escaped.txt", []byte("escaped"))
+
+	parent, _ := ioutil.TempDir("", "dloutside")
+	defer os.RemoveAll(parent)
+	tempDir := filepath.Join(parent, "destination")
+
+	err := c.doDownload("docs/", tempDir)
+	assert.Equal(t, destinationOutsideError, err.(*transferError).failures[0].err.Error())
+	assert.Equal(t, 2, err.(*transferError).total)
+
+	_, err = os.Stat(filepath.Join(parent, "escaped.txt"))
+	assert.True(t, os.IsNotExist(err))
+	data, _ := ioutil.ReadFile(filepath.Join(tempDir, "docs", "a.txt"))
+	assert.Equal(t, []byte("some text"), data)
+}
+
+func TestIsUnder(t *testing.T) {
+	for _, test := range []struct {
+		dir, file string
+		under     bool
+	}{
+		{"dest", "dest/a", true},
+		{"dest", "dest/a/../b", true},
+		{"", "a/b", true},
+		{"/dest", "/dest/a", true},
+		{"dest", "dest/../a", false},
+		{"dest", "dest/../../a", false},
+		{"", "../a", false},
+		{"/dest", "/destination/a", false},
+		{"dest", "dest/..a", true},
+	} {
+		assert.Equal(t, test.under, isUnder(test.dir, test.file), "%s in %s", test.file, test.dir)
+	}
+}
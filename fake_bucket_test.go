@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	errFakeObjectNotFound = "fake: object not found"
+	errFakeInjected       = "fake: injected failure"
+)
+
+// fakeBucket is an in-memory Bucket used by the tests. Setting one of its
+// fault fields makes the following operations fail, which makes it possible
+// to test how the client handles a misbehaving storage service.
+type fakeBucket struct {
+	sync.Mutex
+	objects map[string][]byte
+	// updated holds the time each object was uploaded or moved, and
+	// generations its generation, a new one each time.
+	updated     map[string]time.Time
+	generations map[string]int64
+	generation  int64
+	uploads     int
+	lists       int
+	// downloadedBytes counts the bytes returned by every download, and
+	// downloadOffsets holds where the downloads of a generation started.
+	downloadedBytes int64
+	downloadOffsets []int64
+
+	// failUpload makes the Nth upload (counting from 1) fail.
+	failUpload int
+	// md5Mismatch makes every upload fail the MD5 check.
+	md5Mismatch bool
+	// truncateDownload cuts downloads short by that many bytes.
+	truncateDownload int
+	// corruptDownload flips a byte in the middle of every download.
+	corruptDownload bool
+	// dropDownloads makes that many downloads of a generation fail halfway.
+	dropDownloads int
+	// listErr, deleteErr and moveErr are returned by their operation.
+	listErr   error
+	deleteErr error
+	moveErr   error
+
+	// created, location and storageClass are set by CreateBucket.
+	created      bool
+	location     string
+	storageClass string
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: make(map[string][]byte), updated: make(map[string]time.Time), generations: make(map[string]int64)}
+}
+
+// store sets the data of an object, as a new generation.
+func (fb *fakeBucket) store(name string, data []byte) {
+	fb.generation++
+	fb.objects[name] = data
+	fb.updated[name] = time.Now()
+	fb.generations[name] = fb.generation
+}
+
+func (fb *fakeBucket) CreateBucket(location, storageClass string) error {
+	fb.Lock()
+	defer fb.Unlock()
+
+	fb.created = true
+	fb.location, fb.storageClass = location, storageClass
+	return nil
+}
+
+func (fb *fakeBucket) Delete(name string) error {
+	fb.Lock()
+	defer fb.Unlock()
+
+	if fb.deleteErr != nil {
+		return fb.deleteErr
+	}
+
+	if _, ok := fb.objects[name]; !ok {
+		return errors.New(errFakeObjectNotFound)
+	}
+
+	delete(fb.objects, name)
+	return nil
+}
+
+func (fb *fakeBucket) Upload(r io.Reader, name string) error {
+	fb.Lock()
+	defer fb.Unlock()
+
+	fb.uploads++
+	if fb.uploads == fb.failUpload {
+		return errors.New(errFakeInjected)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if fb.md5Mismatch {
+		return errors.New(hashMismatchErr)
+	}
+
+	fb.store(name, data)
+	return nil
+}
+
+// version returns the version of an object for conditionalBucket, which is
+// its generation; the caller holds the lock.
+func (fb *fakeBucket) version(name string) string {
+	if _, ok := fb.objects[name]; !ok {
+		return ""
+	}
+	return strconv.FormatInt(fb.generations[name], 10)
+}
+
+func (fb *fakeBucket) DownloadVersion(name string) (io.ReadCloser, string, error) {
+	fb.Lock()
+	defer fb.Unlock()
+
+	data, ok := fb.objects[name]
+	if !ok {
+		return nil, "", errors.New(errFakeObjectNotFound)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), fb.version(name), nil
+}
+
+func (fb *fakeBucket) UploadIfVersion(r io.Reader, name, version string) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	fb.Lock()
+	defer fb.Unlock()
+
+	if fb.version(name) != version {
+		return "", errors.New(errPreconditionFailed)
+	}
+
+	fb.uploads++
+	if fb.uploads == fb.failUpload {
+		return "", errors.New(errFakeInjected)
+	}
+
+	fb.store(name, data)
+	return fb.version(name), nil
+}
+
+func (fb *fakeBucket) Download(name string, offset, length int64) (io.ReadCloser, int64, error) {
+	fb.Lock()
+	defer fb.Unlock()
+
+	data, ok := fb.objects[name]
+	if !ok {
+		return nil, 0, errors.New(errFakeObjectNotFound)
+	}
+
+	size := int64(len(data))
+	end := size
+	if offset > size {
+		offset = size
+	}
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+
+	data = append([]byte{}, data[offset:end]...)
+	fb.downloadedBytes += int64(len(data))
+
+	if fb.truncateDownload > 0 && fb.truncateDownload <= len(data) {
+		data = data[:len(data)-fb.truncateDownload]
+	}
+
+	if fb.corruptDownload && len(data) > 0 {
+		data[len(data)/2] ^= 0xFF
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), size, nil
+}
+
+func (fb *fakeBucket) List() ([]objectInfo, error) {
+	fb.Lock()
+	defer fb.Unlock()
+
+	fb.lists++
+	if fb.listErr != nil {
+		return nil, fb.listErr
+	}
+
+	objects := make([]objectInfo, 0, len(fb.objects))
+	for name, data := range fb.objects {
+		objects = append(objects, objectInfo{name, int64(len(data)), fb.updated[name]})
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].name < objects[j].name })
+	return objects, nil
+}
+
+func (fb *fakeBucket) Move(src, dst string) error {
+	fb.Lock()
+	defer fb.Unlock()
+
+	if fb.moveErr != nil {
+		return fb.moveErr
+	}
+
+	data, ok := fb.objects[src]
+	if !ok {
+		return errors.New(errFakeObjectNotFound)
+	}
+
+	delete(fb.objects, src)
+	fb.store(dst, data)
+	return nil
+}
+
+func (fb *fakeBucket) Stat(name string) (objectVersion, error) {
+	fb.Lock()
+	defer fb.Unlock()
+
+	data, ok := fb.objects[name]
+	if !ok {
+		return objectVersion{}, errors.New(errFakeObjectNotFound)
+	}
+
+	md5Hash := md5.Sum(data)
+	crc32cHash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc32cHash.Write(data)
+	return objectVersion{fb.generations[name], int64(len(data)), md5Hash[:], crc32cHash.Sum(nil)}, nil
+}
+
+func (fb *fakeBucket) DownloadGeneration(name string, generation, offset int64) (io.ReadCloser, error) {
+	fb.Lock()
+	if _, ok := fb.objects[name]; ok && fb.generations[name] != generation {
+		fb.Unlock()
+		return nil, errors.New(errObjectChanged)
+	}
+
+	fb.downloadOffsets = append(fb.downloadOffsets, offset)
+	drop := fb.dropDownloads > 0
+	if drop {
+		fb.dropDownloads--
+	}
+	fb.Unlock()
+
+	r, _, err := fb.Download(name, offset, -1)
+	if err != nil || !drop {
+		return r, err
+	}
+
+	data, _ := ioutil.ReadAll(r)
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data[:len(data)/2]), failingReader{})), nil
+}
+
+// failingReader fails like a dropped connection.
+type failingReader struct{}
+
+func (failingReader) Read(b []byte) (int, error) {
+	return 0, errors.New(errFakeInjected)
+}
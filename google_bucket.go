@@ -1,15 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	b64 "encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/GregorioDiStefano/gcloud-crypto/progress"
 	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
 	"github.com/Sirupsen/logrus"
 
@@ -25,6 +26,12 @@ type bucketService struct {
 	service *storage.Service
 	keys    *simplecrypto.Keys
 	bucket
+
+	// client sends the requests of the resumable uploads to uploadURL, in
+	// parts of partSize bytes
+	client    *http.Client
+	uploadURL string
+	partSize  int
 }
 
 type bucket struct {
@@ -32,28 +39,29 @@ type bucket struct {
 	project string
 }
 
-type PassThrough struct {
-	io.Reader
-	totalRead     int64
-	contentLength int64
+func NewGoogleBucketService(client *http.Client, service *storage.Service, keys *simplecrypto.Keys, bucketName, projectName string) *bucketService {
+	return &bucketService{service, keys, bucket{bucketName, projectName}, client, googleUploadURL, resumablePartSize}
 }
 
-type Progress struct {
-	total      int64
-	transfered int64
-}
+// CreateBucket creates the bucket in the project, unless it already exists.
+func (bs bucketService) CreateBucket(location, storageClass string) error {
+	_, err := bs.service.Buckets.Get(bs.bucket.name).Do()
+	if err == nil {
+		log.WithFields(logrus.Fields{"bucket": bs.bucket.name}).Debug("Bucket already exists.")
+		return nil
+	}
 
-var progresses []Progress
+	if apiErr, ok := err.(*googleAPI.Error); !ok || apiErr.Code != http.StatusNotFound {
+		return errors.New("Failed to get bucket: " + err.Error())
+	}
 
-func (pt *PassThrough) Read(b []byte) (int, error) {
-	c, err := pt.Reader.Read(b)
-	pt.totalRead += int64(c)
-	progress.DrawProgress("Downloading", pt.totalRead, pt.contentLength)
-	return c, err
-}
+	newBucket := &storage.Bucket{Name: bs.bucket.name, Location: location, StorageClass: storageClass}
+	if _, err := bs.service.Buckets.Insert(bs.bucket.project, newBucket).Do(); err != nil {
+		return errors.New("Failed to create bucket: " + err.Error())
+	}
 
-func NewGoogleBucketService(service *storage.Service, keys *simplecrypto.Keys, bucketName, projectName string) *bucketService {
-	return &bucketService{service, keys, bucket{bucketName, projectName}}
+	log.WithFields(logrus.Fields{"bucket": bs.bucket.name, "location": location, "storage class": storageClass}).Info("Created bucket.")
+	return nil
 }
 
 func (bs bucketService) Delete(encryptedFilePath string) error {
@@ -64,81 +72,128 @@ func (bs bucketService) Delete(encryptedFilePath string) error {
 	return nil
 }
 
-func (bs bucketService) Upload(fileToUpload, encryptedUploadPath string, expectedMD5Hash []byte) error {
-	defer os.Remove(fileToUpload)
-	fileSize := int64(0)
+func (bs bucketService) Upload(r io.Reader, encryptedUploadPath string) error {
+	_, err := bs.insert(r, encryptedUploadPath, -1)
+	return err
+}
 
+// insert uploads an object, only if its current generation is generation
+// unless it is negative, and returns the generation of the new object.
+func (bs bucketService) insert(r io.Reader, encryptedUploadPath string, generation int64) (int64, error) {
 	object := &storage.Object{Name: encryptedUploadPath}
-	file, err := os.Open(fileToUpload)
+	md5Hash := md5.New()
 
-	if err != nil {
-		return errors.New("Failed opening file: " + fileToUpload + ", error: " + err.Error())
+	call := bs.service.Objects.Insert(bs.bucket.name, object)
+	if generation >= 0 {
+		call = call.IfGenerationMatch(generation)
 	}
+	res, err := call.Media(io.TeeReader(r, md5Hash)).Do()
 
-	if fileStat, err := os.Stat(fileToUpload); err == nil {
-		fileSize = fileStat.Size()
+	if apiErr, ok := err.(*googleAPI.Error); ok && apiErr.Code == http.StatusPreconditionFailed {
+		return 0, errors.New(errPreconditionFailed)
+	} else if err != nil {
+		return 0, err
 	}
 
-	defer file.Close()
-
-	if err != nil {
-		fmt.Printf("Error opening %q: %v", fileToUpload, err)
+	if actualMD5Hash, err := b64.StdEncoding.DecodeString(res.Md5Hash); err != nil || !bytes.Equal(md5Hash.Sum(nil), actualMD5Hash) {
+		log.WithFields(logrus.Fields{"expected md5": md5Hash.Sum(nil), "actual md5": actualMD5Hash}).Warn("Uploaded file is corrupted")
+		bs.Delete(encryptedUploadPath)
+		return 0, errors.New(hashMismatchErr)
 	}
 
-	// TODO: what is total? why is it 0?
-	var pu googleAPI.ProgressUpdater = func(current, total int64) {
-		progress.DrawProgress("Uploading", current, fileSize)
-	}
+	log.WithFields(logrus.Fields{"filename": encryptedUploadPath}).Debug("Created object successfully.")
+	return res.Generation, nil
+}
 
-	if res, err := bs.service.Objects.Insert(bs.bucket.name, object).ProgressUpdater(pu).Media(file).Do(); err == nil {
-		if actualMD5Hash, err := b64.URLEncoding.DecodeString(res.Md5Hash); err == nil {
-			if string(expectedMD5Hash) != string(actualMD5Hash) {
-				log.WithFields(logrus.Fields{"expected md5": expectedMD5Hash, "actual md5": actualMD5Hash}).Warn("Uploaded file is corrupted")
-				bs.Delete(encryptedUploadPath)
-				return errors.New(hashMismatchErr)
-			}
+// UploadIfVersion uploads an object with ifGenerationMatch, the generation
+// of a missing object being 0.
+func (bs bucketService) UploadIfVersion(r io.Reader, encryptedUploadPath, version string) (string, error) {
+	var generation int64
+	if version != "" {
+		var err error
+		if generation, err = strconv.ParseInt(version, 10, 64); err != nil {
+			return "", err
 		}
-		log.WithFields(logrus.Fields{"filename": encryptedUploadPath}).Debug("Created object successfully.")
-	} else {
-		return err
 	}
 
-	return nil
+	generation, err := bs.insert(r, encryptedUploadPath, generation)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(generation, 10), nil
 }
 
-func (bs bucketService) Download(encryptedFilePath string) (string, error) {
-	writeFile, _ := ioutil.TempFile(".", "download")
-	saveFilename := writeFile.Name()
-	defer writeFile.Close()
-
+func (bs bucketService) Download(encryptedFilePath string, offset, length int64) (io.ReadCloser, int64, error) {
 	obj := bs.service.Objects.Get(bs.bucket.name, encryptedFilePath)
+	if r := rangeHeader(offset, length); r != "" {
+		obj.Header().Set("Range", r)
+	}
+
 	download, err := obj.Download()
 
 	if err != nil {
-		return saveFilename, errors.New("Error trying to download file:" + err.Error())
+		return nil, 0, errors.New("Error trying to download file:" + err.Error())
 	}
 
-	defer download.Body.Close()
+	size, err := objectSize(download)
+	if err != nil {
+		download.Body.Close()
+		return nil, 0, err
+	}
+
+	// a body shorter than its Content-Length fails with io.ErrUnexpectedEOF
+	return download.Body, size, nil
+}
 
+// DownloadVersion downloads a whole object, whose version is the generation
+// the response tells.
+func (bs bucketService) DownloadVersion(encryptedFilePath string) (io.ReadCloser, string, error) {
+	download, err := bs.service.Objects.Get(bs.bucket.name, encryptedFilePath).Download()
 	if err != nil {
-		fmt.Println(err)
+		return nil, "", errors.New("Error trying to download file:" + err.Error())
 	}
+	return download.Body, download.Header.Get("X-Goog-Generation"), nil
+}
 
-	pt := &PassThrough{Reader: download.Body, contentLength: download.ContentLength}
+// Stat returns the generation, size and hashes of an object; composite
+// objects have no MD5.
+func (bs bucketService) Stat(encryptedFilePath string) (objectVersion, error) {
+	object, err := bs.service.Objects.Get(bs.bucket.name, encryptedFilePath).Do()
+	if err != nil {
+		return objectVersion{}, errors.New("Error trying to get file:" + err.Error())
+	}
 
-	if written, err := io.Copy(writeFile, pt); err != nil {
-		log.Warn("error when downloading file: %s, %s", writeFile.Name(), err.Error())
-	} else if written != download.ContentLength {
-		return saveFilename, errors.New("Download failed, file was not entirely downloaded")
+	version := objectVersion{generation: object.Generation, size: int64(object.Size)}
+	version.md5, _ = b64.StdEncoding.DecodeString(object.Md5Hash)
+	version.crc32c, _ = b64.StdEncoding.DecodeString(object.Crc32c)
+	if len(version.md5) == 0 {
+		version.md5 = nil
+	}
+	if len(version.crc32c) == 0 {
+		version.crc32c = nil
 	}
+	return version, nil
+}
 
-	writeFile.Close()
+// DownloadGeneration downloads a generation of an object from offset on,
+// which is gone once the object was replaced.
+func (bs bucketService) DownloadGeneration(encryptedFilePath string, generation, offset int64) (io.ReadCloser, error) {
+	obj := bs.service.Objects.Get(bs.bucket.name, encryptedFilePath).Generation(generation)
+	if r := rangeHeader(offset, -1); r != "" {
+		obj.Header().Set("Range", r)
+	}
 
-	return saveFilename, nil
+	download, err := obj.Download()
+	if apiErr, ok := err.(*googleAPI.Error); ok && apiErr.Code == http.StatusNotFound {
+		return nil, errors.New(errObjectChanged)
+	} else if err != nil {
+		return nil, errors.New("Error trying to download file:" + err.Error())
+	}
+	return download.Body, nil
 }
 
-func (bs bucketService) List() ([]string, error) {
-	var objects []string
+func (bs bucketService) List() ([]objectInfo, error) {
+	var objects []objectInfo
 	pageToken := ""
 
 	for {
@@ -148,11 +203,12 @@ func (bs bucketService) List() ([]string, error) {
 		}
 		res, err := call.Do()
 		if err != nil {
-			log.Errorf("error while getting object list: " + err.Error())
+			log.Errorf("error while getting object list: %s", err.Error())
 			return nil, errors.New("failed to get objects in bucket")
 		}
 		for _, object := range res.Items {
-			objects = append(objects, object.Name)
+			updated, _ := time.Parse(time.RFC3339, object.Updated)
+			objects = append(objects, objectInfo{object.Name, int64(object.Size), updated})
 		}
 		if pageToken = res.NextPageToken; pageToken == "" {
 			break
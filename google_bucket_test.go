@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"testing"
 
@@ -9,20 +10,22 @@ import (
 
 func TestHashMismatch(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	c.getFileList("")
 	file1 := encryptFilePath("test0", &keys)
 	file2 := encryptFilePath("test1", &keys)
 
-	randomFileTestFilename1 := randomFile()
-	randomFileTestFilename2 := randomFile()
+	fb, ok := bs.(*fakeBucket)
+	if !ok {
+		t.Skip("hash mismatches can only be injected in the fake bucket")
+	}
 
-	md5hash, _ := getFileMD5(randomFileTestFilename1)
-	err := bs.Upload(randomFileTestFilename1, file1, md5hash)
+	err := bs.Upload(bytes.NewReader(randomByte(100)), file1)
 	assert.Nil(t, err)
-	err = bs.Upload(randomFileTestFilename2, file2, []byte{0x00})
+	fb.md5Mismatch = true
+	err = bs.Upload(bytes.NewReader(randomByte(100)), file2)
 	assert.Equal(t, err, errors.New(hashMismatchErr))
 	filesInBucket, err := c.getFileList("")
 	assert.Equal(t, []string{"test0"}, filesInBucket)
@@ -30,16 +33,13 @@ func TestHashMismatch(t *testing.T) {
 
 func TestMoveObject(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	srcFile := encryptFilePath("test0", &keys)
 	dstFile := encryptFilePath("dst", &keys)
 
-	randomFileTestFilename := randomFile()
-	md5hash, _ := getFileMD5(randomFileTestFilename)
-
-	bs.Upload(randomFileTestFilename, srcFile, md5hash)
+	bs.Upload(bytes.NewReader(randomByte(100)), srcFile)
 	bs.Move(srcFile, dstFile)
 
 	files, err := c.getFileList("")
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	storage "google.golang.org/api/storage/v1"
+)
+
+const (
+	googleUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/"
+	// resumablePartSize is sent with each request of a resumable upload,
+	// which must be a multiple of 256 KiB but for the last one.
+	resumablePartSize = 8 * 1024 * 1024
+
+	// statusResumeIncomplete answers the parts of an unfinished upload.
+	statusResumeIncomplete = 308
+
+	errUploadSessionExpired = "upload session expired"
+	errUploadSessionStatus  = "unexpected answer from upload session"
+	errUploadShortRead      = "the file is shorter than when its upload started"
+)
+
+// StartUpload opens a resumable upload session of an object of size bytes,
+// returning its URI.
+func (bs bucketService) StartUpload(name string, size int64) (string, error) {
+	query := url.Values{"uploadType": {"resumable"}, "name": {name}}
+	req, err := http.NewRequest("POST", bs.uploadURL+url.PathEscape(bs.bucket.name)+"/o?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := bs.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", errors.New("Failed to start upload: " + res.Status)
+	}
+
+	session := res.Header.Get("Location")
+	if session == "" {
+		return "", errors.New(errUploadSessionStatus)
+	}
+
+	log.WithFields(logrus.Fields{"filename": name, "size": size}).Debug("Started resumable upload.")
+	return session, nil
+}
+
+// UploadStatus returns how many bytes of the object of size bytes the
+// session holds, and the MD5 of the object once they all are.
+func (bs bucketService) UploadStatus(session string, size int64) (int64, []byte, error) {
+	res, err := bs.putPart(session, nil, 0, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == statusResumeIncomplete {
+		offset, err := committedOffset(res)
+		return offset, nil, err
+	}
+
+	objectMD5, err := uploadedMD5(res)
+	return size, objectMD5, err
+}
+
+// ResumeUpload sends the rest of the object, read from r, to the session,
+// hashing in u.md5 what the session stores. The MD5 of the stored object is
+// returned once it is complete.
+func (bs bucketService) ResumeUpload(u *resumableUpload, r io.Reader) ([]byte, error) {
+	part := make([]byte, bs.partSize)
+	buffered := 0
+
+	for {
+		want := int64(bs.partSize)
+		if left := u.size - u.offset; left < want {
+			want = left
+		}
+
+		n, err := io.ReadFull(r, part[buffered:want])
+		buffered += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New(errUploadShortRead)
+		} else if err != nil {
+			return nil, err
+		}
+
+		res, err := bs.putPart(u.session, part[:buffered], u.offset, u.size)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != statusResumeIncomplete {
+			objectMD5, err := uploadedMD5(res)
+			res.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			u.md5.Write(part[:buffered])
+			u.offset = u.size
+			return objectMD5, nil
+		}
+
+		committed, err := committedOffset(res)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		} else if committed < u.offset || committed > u.offset+int64(buffered) {
+			return nil, errors.New(errUploadSessionStatus)
+		}
+
+		// the service may keep less than was sent, the rest is sent again
+		stored := int(committed - u.offset)
+		u.md5.Write(part[:stored])
+		buffered = copy(part, part[stored:buffered])
+		u.offset = committed
+
+		if u.committed != nil {
+			u.committed()
+		}
+	}
+}
+
+// putPart sends data, the bytes of an object of size bytes starting at
+// offset, to an upload session; no data only asks how far the upload went.
+// A response is only returned for an unfinished or a finished upload.
+func (bs bucketService) putPart(session string, data []byte, offset, size int64) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", session, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(data))-1, size))
+	}
+
+	res, err := bs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated, statusResumeIncomplete:
+		return res, nil
+	case http.StatusNotFound, http.StatusGone:
+		res.Body.Close()
+		return nil, errors.New(errUploadSessionExpired)
+	default:
+		res.Body.Close()
+		return nil, errors.New("Failed to upload: " + res.Status)
+	}
+}
+
+// committedOffset returns how many bytes an unfinished upload holds, from
+// the Range header of the answer, missing when it holds none.
+func committedOffset(res *http.Response) (int64, error) {
+	r := res.Header.Get("Range")
+	if r == "" {
+		return 0, nil
+	}
+
+	if !strings.HasPrefix(r, "bytes=0-") {
+		return 0, errors.New(errUploadSessionStatus)
+	}
+
+	last, err := strconv.ParseInt(strings.TrimPrefix(r, "bytes=0-"), 10, 64)
+	if err != nil {
+		return 0, errors.New(errUploadSessionStatus)
+	}
+	return last + 1, nil
+}
+
+// uploadedMD5 returns the MD5 of the object created by a finished upload.
+func uploadedMD5(res *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var object storage.Object
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, errors.New(errUploadSessionStatus)
+	}
+	return b64.StdEncoding.DecodeString(object.Md5Hash)
+}
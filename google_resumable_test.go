@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/md5"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUploadServer stands in for the resumable upload endpoint of GCS,
+// storing the finished objects in a fakeBucket. Its fault fields make the
+// following requests fail.
+type fakeUploadServer struct {
+	sync.Mutex
+	*httptest.Server
+	bucket   *fakeBucket
+	sessions map[string]*fakeUploadSession
+	started  int
+	parts    int
+
+	// failParts makes that many parts fail, once failAfter parts were stored.
+	failAfter, failParts int
+	// storeLess makes each part, but the last one, store that many bytes
+	// less than sent.
+	storeLess int
+	// expired makes every session expire.
+	expired bool
+	// corrupt makes the finished objects report a wrong MD5.
+	corrupt bool
+}
+
+type fakeUploadSession struct {
+	name string
+	size int64
+	data []byte
+	// resumedAt holds the offsets of the parts sent after a failure.
+	resumedAt []int64
+	failed    bool
+}
+
+func newFakeUploadServer(fb *fakeBucket) *fakeUploadServer {
+	fs := &fakeUploadServer{bucket: fb, sessions: make(map[string]*fakeUploadSession)}
+	fs.Server = httptest.NewServer(fs)
+	return fs
+}
+
+// newBucketService returns a bucketService uploading to the stand-in, in
+// parts of partSize bytes.
+func (fs *fakeUploadServer) newBucketService(partSize int) *bucketService {
+	bs := NewGoogleBucketService(fs.Client(), nil, nil, "bucket", "project")
+	bs.uploadURL = fs.URL + "/upload/storage/v1/b/"
+	bs.partSize = partSize
+	return bs
+}
+
+func (fs *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.Lock()
+	defer fs.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o" && r.URL.Query().Get("uploadType") == "resumable" {
+		size, err := strconv.ParseInt(r.Header.Get("X-Upload-Content-Length"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad length", http.StatusBadRequest)
+			return
+		}
+
+		fs.started++
+		id := fmt.Sprintf("/session/%d", fs.started)
+		fs.sessions[id] = &fakeUploadSession{name: r.URL.Query().Get("name"), size: size}
+		w.Header().Set("Location", fs.URL+id)
+		return
+	}
+
+	s, ok := fs.sessions[r.URL.Path]
+	if r.Method != "PUT" || !ok || fs.expired {
+		http.NotFound(w, r)
+		return
+	}
+
+	var first, last, size int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &size); err == nil {
+		fs.answer(w, s)
+		return
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &size); err != nil || size != s.size ||
+		first != int64(len(s.data)) || last-first+1 != int64(len(body)) {
+		http.Error(w, "bad Content-Range "+contentRange, http.StatusBadRequest)
+		return
+	}
+
+	fs.parts++
+	if fs.parts > fs.failAfter && fs.failParts > 0 {
+		fs.failParts--
+		s.failed = true
+		http.Error(w, "injected failure", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.failed {
+		s.resumedAt = append(s.resumedAt, first)
+		s.failed = false
+	}
+
+	if last+1 < size && len(body) > fs.storeLess {
+		body = body[:len(body)-fs.storeLess]
+	}
+	s.data = append(s.data, body...)
+	if int64(len(s.data)) == s.size {
+		fs.bucket.Lock()
+		fs.bucket.store(s.name, s.data)
+		fs.bucket.Unlock()
+	}
+	fs.answer(w, s)
+}
+
+// answer tells how far the upload of a session went.
+func (fs *fakeUploadServer) answer(w http.ResponseWriter, s *fakeUploadSession) {
+	if int64(len(s.data)) < s.size {
+		if len(s.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		}
+		w.WriteHeader(statusResumeIncomplete)
+		return
+	}
+
+	hash := md5.Sum(s.data)
+	if fs.corrupt {
+		hash[0] ^= 0xFF
+	}
+	json.NewEncoder(w).Encode(map[string]string{"name": s.name, "md5Hash": b64.StdEncoding.EncodeToString(hash[:])})
+}
+
+func TestResumableUploadProtocol(t *testing.T) {
+	fb := newFakeBucket()
+	fs := newFakeUploadServer(fb)
+	defer fs.Close()
+	bs := fs.newBucketService(1000)
+	data := randomByte(4500)
+
+	for _, storeLess := range []int{0, 100} {
+		fs.storeLess = storeLess
+
+		session, err := bs.StartUpload("object", int64(len(data)))
+		assert.Nil(t, err)
+
+		offset, objectMD5, err := bs.UploadStatus(session, int64(len(data)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), offset)
+		assert.Nil(t, objectMD5)
+
+		committed := 0
+		u := &resumableUpload{session: session, size: int64(len(data)), md5: md5.New(), committed: func() { committed++ }}
+		objectMD5, err = bs.ResumeUpload(u, strings.NewReader(string(data)))
+		assert.Nil(t, err)
+
+		hash := md5.Sum(data)
+		assert.Equal(t, hash[:], objectMD5)
+		assert.Equal(t, hash[:], u.md5.Sum(nil))
+		assert.Equal(t, data, fb.objects["object"])
+		assert.Equal(t, u.size, u.offset)
+		assert.True(t, committed >= 4, "parts committed: %d", committed)
+
+		offset, objectMD5, err = bs.UploadStatus(session, int64(len(data)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), offset)
+		assert.Equal(t, hash[:], objectMD5)
+	}
+
+	// a source shorter than the object, and an expired session
+	fs.storeLess = 0
+	session, _ := bs.StartUpload("short", int64(len(data)))
+	u := &resumableUpload{session: session, size: int64(len(data)), md5: md5.New()}
+	_, err := bs.ResumeUpload(u, strings.NewReader(string(data[:2500])))
+	assert.Equal(t, errUploadShortRead, err.Error())
+	assert.Equal(t, int64(2000), u.offset)
+
+	fs.expired = true
+	_, _, err = bs.UploadStatus(session, int64(len(data)))
+	assert.Equal(t, errUploadSessionExpired, err.Error())
+}
+
+func TestCommittedOffset(t *testing.T) {
+	for _, test := range []struct {
+		rangeHeader string
+		offset      int64
+		valid       bool
+	}{
+		{"", 0, true},
+		{"bytes=0-0", 1, true},
+		{"bytes=0-262143", 262144, true},
+		{"bytes=10-20", 0, false},
+		{"bytes=0-x", 0, false},
+	} {
+		res := &http.Response{Header: http.Header{}}
+		if test.rangeHeader != "" {
+			res.Header.Set("Range", test.rangeHeader)
+		}
+
+		offset, err := committedOffset(res)
+		assert.Equal(t, test.offset, offset, test.rangeHeader)
+		assert.Equal(t, test.valid, err == nil, test.rangeHeader)
+	}
+}
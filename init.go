@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	errBucketNotEmpty   = "the bucket is not empty, use -force to create a vault in it anyway"
+	errVaultExists      = "the bucket already holds a vault, which a new one would make undecryptable"
+	errPasswordMismatch = "the passwords do not match"
+	errEmptyPassword    = "the password must not be empty"
+)
+
+// bucketCreator is implemented by the backends able to create their bucket.
+type bucketCreator interface {
+	// CreateBucket creates the bucket, if it does not exist yet. Empty
+	// location and storage class use the defaults of the backend.
+	CreateBucket(location, storageClass string) error
+}
+
+// newKDFParams returns the key derivation parameters of new vault headers,
+// tests replace it with cheaper parameters.
+var newKDFParams = simplecrypto.NewKDFParams
+
+// initVault creates the bucket if needed and writes the header of a new vault
+// protected by password, returning its keys. Unless force is set, the bucket
+// must be empty; force never replaces a vault, legacy or not, since its
+// files can only be decrypted with its keys.
+func initVault(bucket Bucket, password []byte, location, storageClass string, force bool) (*simplecrypto.Keys, error) {
+	if len(password) == 0 {
+		return nil, errors.New(errEmptyPassword)
+	}
+
+	if creator, ok := bucket.(bucketCreator); ok {
+		if err := creator.CreateBucket(location, storageClass); err != nil {
+			return nil, err
+		}
+	} else if location != "" || storageClass != "" {
+		log.Warn("this backend cannot create buckets, location and storage class are ignored")
+	}
+
+	objects, err := bucket.List()
+	if err != nil {
+		return nil, errors.New("failed getting objects: " + err.Error())
+	}
+
+	for _, object := range objects {
+		switch object.name {
+		case VAULT_HEADER_FILE, VAULT_MIGRATION_FILE, PASSWORD_CHECK_FILE:
+			return nil, errors.New(errVaultExists)
+		}
+	}
+
+	if len(objects) > 0 {
+		if !force {
+			return nil, errors.New(errBucketNotEmpty)
+		}
+		log.WithFields(logrus.Fields{"objects": len(objects)}).Warn("creating a vault in a non-empty bucket")
+	}
+
+	vh, keys, err := newVaultHeader(password, newKDFParams())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeVaultHeader(bucket, VAULT_HEADER_FILE, vh); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
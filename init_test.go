@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitVault(t *testing.T) {
+	defer useTestKDFParams()()
+
+	initTests := []struct {
+		existing      []string
+		password      string
+		force         bool
+		expectedError error
+	}{
+		{nil, "password", false, nil},
+		{nil, "", false, errors.New(errEmptyPassword)},
+		{[]string{"someobject"}, "password", false, errors.New(errBucketNotEmpty)},
+		{[]string{"someobject"}, "password", true, nil},
+		{[]string{VAULT_HEADER_FILE, "someobject"}, "password", true, errors.New(errVaultExists)},
+		{[]string{VAULT_MIGRATION_FILE}, "password", true, errors.New(errVaultExists)},
+		{[]string{PASSWORD_CHECK_FILE, "someobject"}, "password", true, errors.New(errVaultExists)},
+	}
+
+	for _, e := range initTests {
+		fb := newFakeBucket()
+		for _, name := range e.existing {
+			assert.Nil(t, fb.Upload(strings.NewReader("data"), name))
+		}
+
+		keys, err := initVault(fb, []byte(e.password), "EU", "NEARLINE", e.force)
+		assert.Equal(t, e.expectedError, err)
+
+		if e.expectedError != nil {
+			// an existing vault is left untouched
+			for _, name := range e.existing {
+				assert.Equal(t, []byte("data"), fb.objects[name])
+			}
+			if len(e.existing) == 0 || e.existing[0] != VAULT_HEADER_FILE {
+				assert.NotContains(t, fb.objects, VAULT_HEADER_FILE)
+			}
+			continue
+		}
+
+		assert.True(t, fb.created)
+		assert.Equal(t, "EU", fb.location)
+		assert.Equal(t, "NEARLINE", fb.storageClass)
+
+		unlockedKeys, legacy, err := unlockVault(fb, []byte(e.password))
+		assert.Nil(t, err)
+		assert.False(t, legacy)
+		assert.Equal(t, keys, unlockedKeys)
+
+		// forcing keeps the existing objects
+		for _, name := range e.existing {
+			assert.Contains(t, fb.objects, name)
+		}
+	}
+}
+
+func TestInitVaultForceKeepsExistingVault(t *testing.T) {
+	defer useTestKDFParams()()
+
+	fb := newFakeBucket()
+	keys, err := initVault(fb, []byte("password"), "", "", false)
+	assert.Nil(t, err)
+	header := fb.objects[VAULT_HEADER_FILE]
+
+	_, err = initVault(fb, []byte("other password"), "", "", true)
+	assert.Equal(t, errors.New(errVaultExists), err)
+	assert.Equal(t, header, fb.objects[VAULT_HEADER_FILE])
+
+	unlockedKeys, _, err := unlockVault(fb, []byte("password"))
+	assert.Nil(t, err)
+	assert.Equal(t, keys, unlockedKeys)
+}
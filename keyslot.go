@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultKeySlot names the slot of the password given to init.
+	defaultKeySlot       = "default"
+	maxKeySlots          = 8
+	maxKeySlotNameLength = 64
+
+	errKeySlotExists     = "a key slot with this name already exists"
+	errKeySlotNotFound   = "no key slot with this name"
+	errTooManyKeySlots   = "every key slot is in use, remove one first"
+	errLastKeySlot       = "the last key slot can not be removed"
+	errEmptyKeySlotName  = "the key slot name must not be empty"
+	errKeySlotNameLength = "the key slot name is too long"
+	errNoKeySlots        = "this vault has a version 1 header without key slots, 'passwd' or 'keyslot add' upgrade it"
+	errEmptyKeyFile      = "the keyfile is empty"
+)
+
+// keySlot holds the vault keys wrapped with the key derived from the
+// password, or keyfile, of the slot.
+type keySlot struct {
+	Name       string                 `json:"name"`
+	KDF        simplecrypto.KDFParams `json:"kdf"`
+	WrappedKey []byte                 `json:"wrapped_key"`
+}
+
+func newKeySlot(name string, secret []byte, kdf *simplecrypto.KDFParams, keys *simplecrypto.Keys) (*keySlot, error) {
+	if len(secret) == 0 {
+		return nil, errors.New(errEmptyPassword)
+	}
+
+	kek, err := kdf.DeriveKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := simplecrypto.WrapKeys(keys, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keySlot{Name: name, KDF: *kdf, WrappedKey: wrappedKey}, nil
+}
+
+func (ks *keySlot) unlock(secret []byte) (*simplecrypto.Keys, error) {
+	kek, err := ks.KDF.DeriveKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	return simplecrypto.UnwrapKeys(ks.WrappedKey, kek)
+}
+
+func (vh *vaultHeader) findSlot(name string) int {
+	for i := range vh.Slots {
+		if vh.Slots[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// readKeyFile returns the content of a keyfile, used as the secret of a key
+// slot instead of a password.
+func readKeyFile(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secret) == 0 {
+		return nil, errors.New(errEmptyKeyFile)
+	}
+	return secret, nil
+}
+
+// unlockVaultHeader reads the vault header and returns it along with the
+// vault keys and the index of the key slot unlocked by secret. Version 1
+// headers are upgraded to a default key slot unlocked by secret, which is
+// only written along with the next change of the header.
+func (c *client) unlockVaultHeader(secret []byte) (*vaultHeader, *simplecrypto.Keys, int, error) {
+	vh, err := readVaultHeader(c.bucket, VAULT_HEADER_FILE)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Debug("unable to read the vault header")
+		return nil, nil, -1, errors.New(errVaultLegacy)
+	}
+
+	keys, i, err := vh.unlockSlot(secret)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	if vh.Version == vaultHeaderDerivedKeysV1 {
+		slot, err := newKeySlot(defaultKeySlot, secret, newKDFParams(), keys)
+		if err != nil {
+			return nil, nil, -1, err
+		}
+		vh.Version, vh.Slots, i = vaultHeaderVersion, []keySlot{*slot}, 0
+		vh.KDF, vh.Check = nil, ""
+	}
+	return vh, keys, i, nil
+}
+
+// doPasswd changes the password of the key slot unlocked by oldPassword.
+// Only the vault header is rewritten, the keys wrapped in it stay the same.
+func (c *client) doPasswd(oldPassword, newPassword []byte) error {
+	vh, keys, i, err := c.unlockVaultHeader(oldPassword)
+	if err != nil {
+		return err
+	}
+
+	slot, err := newKeySlot(vh.Slots[i].Name, newPassword, newKDFParams(), keys)
+	if err != nil {
+		return err
+	}
+
+	vh.Slots[i] = *slot
+	return writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh)
+}
+
+// doKeySlotAdd adds a key slot unlocked by secret, once currentSecret has
+// unlocked an existing one.
+func (c *client) doKeySlotAdd(currentSecret []byte, name string, secret []byte) error {
+	if name == "" {
+		return errors.New(errEmptyKeySlotName)
+	} else if len(name) > maxKeySlotNameLength {
+		return errors.New(errKeySlotNameLength)
+	}
+
+	vh, keys, _, err := c.unlockVaultHeader(currentSecret)
+	if err != nil {
+		return err
+	}
+
+	if vh.findSlot(name) >= 0 {
+		return errors.New(errKeySlotExists)
+	} else if len(vh.Slots) >= maxKeySlots {
+		return errors.New(errTooManyKeySlots)
+	}
+
+	slot, err := newKeySlot(name, secret, newKDFParams(), keys)
+	if err != nil {
+		return err
+	}
+
+	vh.Slots = append(vh.Slots, *slot)
+	return writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh)
+}
+
+// doKeySlotRemove removes a key slot, the files do not need to be
+// re-encrypted since its password can no longer unwrap the vault keys.
+func (c *client) doKeySlotRemove(name string) error {
+	vh, err := readVaultHeader(c.bucket, VAULT_HEADER_FILE)
+	if err != nil {
+		return err
+	} else if vh.Version == vaultHeaderDerivedKeysV1 {
+		return errors.New(errNoKeySlots)
+	}
+
+	i := vh.findSlot(name)
+	if i < 0 {
+		return errors.New(errKeySlotNotFound)
+	} else if len(vh.Slots) == 1 {
+		return errors.New(errLastKeySlot)
+	}
+
+	vh.Slots = append(vh.Slots[:i], vh.Slots[i+1:]...)
+	return writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh)
+}
+
+// doKeySlotList writes the name and key derivation parameters of every key
+// slot to w.
+func (c *client) doKeySlotList(w io.Writer) error {
+	vh, err := readVaultHeader(c.bucket, VAULT_HEADER_FILE)
+	if err != nil {
+		return err
+	} else if vh.Version == vaultHeaderDerivedKeysV1 {
+		return errors.New(errNoKeySlots)
+	}
+
+	for _, slot := range vh.Slots {
+		if _, err := fmt.Fprintf(w, "%s\t%s N=%d r=%d p=%d\n", slot.Name, slot.KDF.Algorithm, slot.KDF.N, slot.KDF.R, slot.KDF.P); err != nil {
+			return err
+		}
+	}
+	return nil
+}
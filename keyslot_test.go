@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func useTestKDFParams() func() {
+	originalNewKDFParams := newKDFParams
+	newKDFParams = testKDFParams
+	return func() { newKDFParams = originalNewKDFParams }
+}
+
+func TestDoPasswd(t *testing.T) {
+	defer useTestKDFParams()()
+
+	fb := newFakeBucket()
+	keys, err := initVault(fb, []byte("old"), "", "", false)
+	assert.Nil(t, err)
+
+	c := newClient(keys, fb)
+	uploadContent(c, "docs/a.txt", []byte("some text"))
+	objects, _ := fb.List()
+	uploads := fb.uploads
+
+	assert.Equal(t, errors.New(errWrongPassword), c.doPasswd([]byte("wrong"), []byte("new")))
+	assert.Equal(t, errors.New(errEmptyPassword), c.doPasswd([]byte("old"), []byte{}))
+	assert.Nil(t, c.doPasswd([]byte("old"), []byte("new")))
+
+	// only the vault header was rewritten
+	assert.Equal(t, uploads+1, fb.uploads)
+	newObjects, _ := fb.List()
+	assert.Equal(t, objectNames(objects), objectNames(newObjects))
+
+	_, _, err = unlockVault(fb, []byte("old"))
+	assert.Equal(t, errors.New(errWrongPassword), err)
+
+	unlockedKeys, _, err := unlockVault(fb, []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, keys, unlockedKeys)
+
+	var out bytes.Buffer
+	assert.Nil(t, c.doCat("docs/a.txt", "", &out))
+	assert.Equal(t, "some text", out.String())
+}
+
+func TestDoPasswdUpgradesHeaderV1(t *testing.T) {
+	defer useTestKDFParams()()
+
+	fb := newFakeBucket()
+	kdf := testKDFParams()
+	derivedKeys, _ := kdf.DeriveKeys([]byte("old"))
+	check, _ := simplecrypto.EncryptText(PASSWORD_CHECK_STRING, derivedKeys.EncryptionKey)
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, &vaultHeader{Version: vaultHeaderDerivedKeysV1, KDF: kdf, Check: check}))
+
+	c := newClient(derivedKeys, fb)
+	assert.Nil(t, c.doPasswd([]byte("old"), []byte("new")))
+
+	vh, err := readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, vaultHeaderVersion, vh.Version)
+	assert.Equal(t, defaultKeySlot, vh.Slots[0].Name)
+
+	keys, _, err := unlockVault(fb, []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, derivedKeys, keys)
+}
+
+func TestDoPasswdLegacyVault(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	c := newClient(legacyKeys, fb)
+	assert.Equal(t, errors.New(errVaultLegacy), c.doPasswd([]byte("foobar"), []byte("new")))
+}
+
+func TestKeySlots(t *testing.T) {
+	defer useTestKDFParams()()
+
+	fb := newFakeBucket()
+	keys, err := initVault(fb, []byte("alice"), "", "", false)
+	assert.Nil(t, err)
+
+	keyFile, _ := ioutil.TempFile("", "gcloud-crypto-keyfile")
+	defer os.Remove(keyFile.Name())
+	keyFile.Write(randomByte(64))
+	keyFile.Close()
+
+	keyFileSecret, err := readKeyFile(keyFile.Name())
+	assert.Nil(t, err)
+
+	c := newClient(keys, fb)
+	uploadContent(c, "docs/a.txt", []byte("some text"))
+
+	addTests := []struct {
+		currentSecret string
+		name          string
+		secret        string
+		expectedError error
+	}{
+		{"alice", "bob", "bob", nil},
+		{"bob", "server", string(keyFileSecret), nil},
+		{"wrong", "carol", "carol", errors.New(errWrongPassword)},
+		{"alice", "bob", "another", errors.New(errKeySlotExists)},
+		{"alice", "", "carol", errors.New(errEmptyKeySlotName)},
+		{"alice", string(randomByte(maxKeySlotNameLength + 1)), "carol", errors.New(errKeySlotNameLength)},
+		{"alice", "carol", "", errors.New(errEmptyPassword)},
+	}
+
+	for _, e := range addTests {
+		assert.Equal(t, e.expectedError, c.doKeySlotAdd([]byte(e.currentSecret), e.name, []byte(e.secret)), e.name)
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, c.doKeySlotList(&out))
+	assert.Equal(t, "default\tscrypt N=1024 r=8 p=1\nbob\tscrypt N=1024 r=8 p=1\nserver\tscrypt N=1024 r=8 p=1\n", out.String())
+
+	// every slot unlocks the same keys
+	for _, secret := range [][]byte{[]byte("alice"), []byte("bob"), keyFileSecret} {
+		unlockedKeys, _, err := unlockVault(fb, secret)
+		assert.Nil(t, err)
+		assert.Equal(t, keys, unlockedKeys)
+	}
+
+	// changing the password of a slot leaves the others alone
+	assert.Nil(t, c.doPasswd([]byte("bob"), []byte("bob2")))
+	vh, _ := readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Equal(t, "bob", vh.Slots[1].Name)
+	_, _, err = unlockVault(fb, []byte("bob2"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, errors.New(errKeySlotNotFound), c.doKeySlotRemove("dave"))
+	assert.Nil(t, c.doKeySlotRemove("bob"))
+	_, _, err = unlockVault(fb, []byte("bob2"))
+	assert.Equal(t, errors.New(errWrongPassword), err)
+
+	assert.Nil(t, c.doKeySlotRemove("server"))
+	assert.Equal(t, errors.New(errLastKeySlot), c.doKeySlotRemove("default"))
+
+	// the files were not touched
+	out.Reset()
+	assert.Nil(t, c.doCat("docs/a.txt", "", &out))
+	assert.Equal(t, "some text", out.String())
+}
+
+func TestTooManyKeySlots(t *testing.T) {
+	defer useTestKDFParams()()
+
+	fb := newFakeBucket()
+	keys, _ := initVault(fb, []byte("password"), "", "", false)
+	c := newClient(keys, fb)
+
+	for i := 1; i < maxKeySlots; i++ {
+		assert.Nil(t, c.doKeySlotAdd([]byte("password"), string(rune('a'+i)), []byte("secret")))
+	}
+	assert.Equal(t, errors.New(errTooManyKeySlots), c.doKeySlotAdd([]byte("password"), "z", []byte("secret")))
+}
+
+func TestReadKeyFile(t *testing.T) {
+	keyFile, _ := ioutil.TempFile("", "gcloud-crypto-keyfile")
+	keyFile.Close()
+	defer os.Remove(keyFile.Name())
+
+	_, err := readKeyFile(keyFile.Name())
+	assert.Equal(t, errors.New(errEmptyKeyFile), err)
+
+	_, err = readKeyFile(keyFile.Name() + "404")
+	assert.Error(t, err)
+}
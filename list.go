@@ -1,20 +1,58 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+	"github.com/mattn/go-shellwords"
 	"github.com/ryanuber/go-glob"
 )
 
+const (
+	sortByName = iota
+	sortBySize
+	sortByTime
+
+	listTimeFormat = "2006-01-02 15:04"
+	listHashLength = 12
+)
+
+// listOptions are the flags of ls: -l for the long listing, -h for human
+// readable sizes, -S and -t to sort by size or modification time, largest
+// or newest first, and -r to reverse the order.
+type listOptions struct {
+	long    bool
+	human   bool
+	sortBy  int
+	reverse bool
+}
+
+// fileInfo describes a file of the vault in long listings. size is -1 when
+// unknown, and modTime the upload time when the original one is unknown.
+type fileInfo struct {
+	path     string
+	size     int64
+	modTime  time.Time
+	uploaded time.Time
+	sha256   []byte
+}
+
 func (c *client) getDirList(matchGlob string) ([]string, error) {
-	objects, err := c.bucket.List()
+	decToEncPaths, err := c.listFiles()
 	if err != nil {
 		return nil, err
 	}
 
 	dirs := []string{}
-	decToEncPaths := getDecryptedToEncryptedFileMapping(objects, c.keys)
 
 	for e := range decToEncPaths {
 		e = filepath.Dir(e)
@@ -34,13 +72,16 @@ func (c *client) getDirList(matchGlob string) ([]string, error) {
 }
 
 func (c *client) getFileList(matchGlob string) ([]string, error) {
-	objects, err := c.bucket.List()
+	decToEncPaths, err := c.listFiles()
 	if err != nil {
 		return nil, err
 	}
+	return matchFiles(decToEncPaths, matchGlob), nil
+}
 
-	decToEncPaths := getDecryptedToEncryptedFileMapping(objects, c.keys)
-
+// matchFiles returns the sorted decrypted paths matching matchGlob, or all of
+// them when it is empty.
+func matchFiles(decToEncPaths decryptedToEncryptedFilePath, matchGlob string) []string {
 	var keys []string
 	for k := range decToEncPaths {
 		if k == PASSWORD_CHECK_FILE {
@@ -55,5 +96,230 @@ func (c *client) getFileList(matchGlob string) ([]string, error) {
 	}
 
 	sort.Strings(keys)
-	return keys, nil
+	return keys
+}
+
+// getFileInfoList describes the files matching matchGlob. What the manifest
+// does not know is taken from the listing of the bucket: the upload time,
+// and the size of the plaintext, worked out from the size of the object and
+// the format its header tells.
+func (c *client) getFileInfoList(matchGlob string) ([]fileInfo, error) {
+	decToEncPaths, err := c.listFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects map[string]objectInfo
+	var unsized []int
+	infos := []fileInfo{}
+
+	for _, plaintextPath := range matchFiles(decToEncPaths, matchGlob) {
+		if plaintextPath == "" {
+			continue
+		}
+
+		entry := manifestEntry{Object: decToEncPaths[plaintextPath], Size: -1}
+		if c.manifest != nil {
+			if e, ok := c.manifest.Files[plaintextPath]; ok {
+				entry = e
+			}
+		}
+
+		if entry.Size < 0 || entry.Uploaded.IsZero() {
+			if objects == nil {
+				if objects, err = c.listObjects(); err != nil {
+					return nil, err
+				}
+			}
+
+			if object, ok := objects[entry.Object]; ok {
+				if entry.Size < 0 {
+					unsized = append(unsized, len(infos))
+				}
+				if entry.Uploaded.IsZero() {
+					entry.Uploaded = object.updated
+				}
+			}
+		}
+
+		if entry.ModTime.IsZero() {
+			entry.ModTime = entry.Uploaded
+		}
+		infos = append(infos, fileInfo{plaintextPath, entry.Size, entry.ModTime, entry.Uploaded, entry.SHA256})
+	}
+
+	runTransfers(c.concurrency, len(unsized), func(i int) error {
+		info := &infos[unsized[i]]
+		info.size = c.plaintextSize(objects[decToEncPaths[info.path]])
+		return nil
+	})
+	return infos, nil
+}
+
+// plaintextSize reads the first bytes of an object to find out the size of
+// its plaintext, which is -1 when its format is unknown.
+func (c *client) plaintextSize(object objectInfo) int64 {
+	r, _, err := c.bucket.Download(object.name, 0, int64(simplecrypto.HeaderPrefixSize))
+	if err != nil {
+		log.WithFields(logrus.Fields{"object": object.name, "error": err}).Warn("unable to read the header of the object")
+		return -1
+	}
+	defer r.Close()
+
+	prefix, err := ioutil.ReadAll(io.LimitReader(r, int64(simplecrypto.HeaderPrefixSize)))
+	if err != nil {
+		log.WithFields(logrus.Fields{"object": object.name, "error": err}).Warn("unable to read the header of the object")
+		return -1
+	}
+	return simplecrypto.PlaintextSize(prefix, object.size)
+}
+
+// listObjects maps the objects of the bucket to their listing.
+func (c *client) listObjects() (map[string]objectInfo, error) {
+	objects, err := c.bucket.List()
+	if err != nil {
+		return nil, errors.New("failed getting objects: " + err.Error())
+	}
+
+	m := make(map[string]objectInfo, len(objects))
+	for _, object := range objects {
+		m[object.name] = object
+	}
+	return m, nil
+}
+
+// parseListCommand parses the flags and the glob of an ls command, flags
+// can be combined as in 'ls -lh'.
+func parseListCommand(line string) (listOptions, string, error) {
+	var o listOptions
+
+	args, err := shellwords.Parse(line)
+	if err != nil {
+		return o, "", errors.New(invalidList)
+	}
+
+	matchGlob := ""
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if matchGlob != "" {
+				return o, "", errors.New(invalidList)
+			}
+			matchGlob = arg
+			continue
+		}
+
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'l':
+				o.long = true
+			case 'h':
+				o.human = true
+			case 'S':
+				o.sortBy = sortBySize
+			case 't':
+				o.sortBy = sortByTime
+			case 'r':
+				o.reverse = true
+			default:
+				return o, "", errors.New(invalidList)
+			}
+		}
+	}
+	return o, matchGlob, nil
+}
+
+// sortFileInfos sorts files already sorted by path as requested by o.
+func sortFileInfos(files []fileInfo, o listOptions) {
+	switch o.sortBy {
+	case sortBySize:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+	case sortByTime:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	}
+
+	if o.reverse {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+}
+
+// formatSize formats a size in bytes, or with a binary unit when human is
+// set, "-" standing for an unknown size.
+func formatSize(size int64, human bool) string {
+	if size < 0 {
+		return "-"
+	} else if !human || size < 1024 {
+		return fmt.Sprintf("%d", size)
+	}
+
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < len("KMGTPE")-1 {
+		value /= 1024
+		unit++
+	}
+
+	if value < 10 {
+		return fmt.Sprintf("%.1f%c", value, "KMGTPE"[unit])
+	}
+	return fmt.Sprintf("%.0f%c", value, "KMGTPE"[unit])
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(listTimeFormat)
+}
+
+// printLongList writes a line per file: its size, modification and upload
+// times, the start of its SHA-256 and its path, then the totals.
+func printLongList(w io.Writer, files []fileInfo, human bool) error {
+	var total int64
+	for _, f := range files {
+		hash := "-"
+		if len(f.sha256) > 0 {
+			hash = hex.EncodeToString(f.sha256)[:listHashLength]
+		}
+
+		if _, err := fmt.Fprintf(w, "%8s  %s  %s  %-*s  %s\n", formatSize(f.size, human), formatTime(f.modTime), formatTime(f.uploaded), listHashLength, hash, f.path); err != nil {
+			return err
+		}
+
+		if f.size > 0 {
+			total += f.size
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "total %s in %d files\n", formatSize(total, human), len(files))
+	return err
+}
+
+// doList lists the files matching matchGlob, numbered as by enumeratePrint
+// unless o asks for the long listing.
+func (c *client) doList(o listOptions, matchGlob string, w io.Writer) error {
+	if !o.long && o.sortBy == sortByName && !o.reverse {
+		files, err := c.getFileList(matchGlob)
+		if err == nil {
+			enumerateFprint(w, files)
+		}
+		return err
+	}
+
+	files, err := c.getFileInfoList(matchGlob)
+	if err != nil {
+		return err
+	}
+	sortFileInfos(files, o)
+
+	if o.long {
+		return printLongList(w, files, o.human)
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	enumerateFprint(w, paths)
+	return nil
 }
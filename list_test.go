@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDirsListing(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	dirListTests := []struct {
@@ -70,7 +79,7 @@ func TestDirsListing(t *testing.T) {
 func TestFileListing(t *testing.T) {
 	bs, keys := setupUp()
 
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	dirListTests := []struct {
@@ -114,3 +123,142 @@ func TestFileListing(t *testing.T) {
 	}
 
 }
+
+func TestParseListCommand(t *testing.T) {
+	parseTests := []struct {
+		line          string
+		expected      listOptions
+		expectedGlob  string
+		expectedError error
+	}{
+		{"", listOptions{}, "", nil},
+		{"docs/*", listOptions{}, "docs/*", nil},
+		{"-l", listOptions{long: true}, "", nil},
+		{"-lh docs/*", listOptions{long: true, human: true}, "docs/*", nil},
+		{"-l -S -r", listOptions{long: true, sortBy: sortBySize, reverse: true}, "", nil},
+		{"-t 'my docs/*'", listOptions{sortBy: sortByTime}, "my docs/*", nil},
+		{"-x", listOptions{}, "", errors.New(invalidList)},
+		{"a b", listOptions{}, "", errors.New(invalidList)},
+	}
+
+	for _, e := range parseTests {
+		o, matchGlob, err := parseListCommand(e.line)
+		assert.Equal(t, e.expectedError, err, e.line)
+		if err == nil {
+			assert.Equal(t, e.expected, o, e.line)
+			assert.Equal(t, e.expectedGlob, matchGlob, e.line)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	sizeTests := []struct {
+		size     int64
+		human    bool
+		expected string
+	}{
+		{-1, true, "-"},
+		{0, false, "0"},
+		{1023, true, "1023"},
+		{1024, true, "1.0K"},
+		{1536, true, "1.5K"},
+		{20 * 1024 * 1024, true, "20M"},
+		{20 * 1024 * 1024, false, "20971520"},
+		{3 << 40, true, "3.0T"},
+	}
+
+	for _, e := range sizeTests {
+		assert.Equal(t, e.expected, formatSize(e.size, e.human), e.size)
+	}
+}
+
+func TestLongListing(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+
+	// without a manifest the sizes come from the objects
+	uploadContent(c, "docs/a.txt", []byte("some text"))
+	uploadContent(c, "docs/b.txt", bytes.Repeat([]byte("b"), 2000))
+	uploadContent(c, "photos/c.jpg", []byte("c"))
+
+	files, err := c.getFileInfoList("docs/*")
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "docs/a.txt", files[0].path)
+	assert.Equal(t, int64(9), files[0].size)
+	assert.Equal(t, int64(2000), files[1].size)
+	assert.False(t, files[0].uploaded.IsZero())
+	assert.Equal(t, files[0].uploaded, files[0].modTime)
+
+	var b bytes.Buffer
+	assert.Nil(t, c.doList(listOptions{sortBy: sortBySize}, "", &b))
+	assert.Equal(t, "0:\tdocs/b.txt\n1:\tdocs/a.txt\n2:\tphotos/c.jpg\n", b.String())
+
+	b.Reset()
+	assert.Nil(t, c.doList(listOptions{sortBy: sortBySize, reverse: true}, "", &b))
+	assert.Equal(t, "0:\tphotos/c.jpg\n1:\tdocs/a.txt\n2:\tdocs/b.txt\n", b.String())
+
+	b.Reset()
+	assert.Nil(t, c.doList(listOptions{long: true, human: true}, "docs/*", &b))
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "       9  "), lines[0])
+	assert.True(t, strings.HasSuffix(lines[0], "-             docs/a.txt"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "    2.0K  "), lines[1])
+	assert.Equal(t, "total 2.0K in 2 files", lines[2])
+
+	// the format of the objects is read from their header
+	id, _ := simplecrypto.NewIdentity()
+	vaultID, _ := c.keys.Identity()
+	recipients := []*simplecrypto.Recipient{id.Recipient(), vaultID.Recipient()}
+	encryptedReader, _ := simplecrypto.NewRecipientEncryptReader(bytes.NewReader(bytes.Repeat([]byte("r"), 3000)), recipients)
+	fb.Upload(encryptedReader, encryptFilePath("shared/photo.jpg", c.keys))
+
+	legacyFile, _ := ioutil.ReadFile("simplecrypto/test_data/test-legacy_encrypted-1")
+	expected, _ := ioutil.ReadFile("simplecrypto/test_data/test-encrypt_decrypt_1")
+	fb.Upload(bytes.NewReader(legacyFile), encryptFilePath("old/file", c.keys))
+	fb.Upload(bytes.NewReader(nil), encryptFilePath("old/empty", c.keys))
+
+	files, err = c.getFileInfoList("")
+	assert.Nil(t, err)
+	sizes := map[string]int64{}
+	for _, file := range files {
+		sizes[file.path] = file.size
+	}
+	assert.Equal(t, map[string]int64{"docs/a.txt": 9, "docs/b.txt": 2000, "photos/c.jpg": 1,
+		"shared/photo.jpg": 3000, "old/file": int64(len(expected)), "old/empty": -1}, sizes)
+
+	b.Reset()
+	assert.Nil(t, c.doList(listOptions{long: true}, "old/empty", &b))
+	assert.True(t, strings.HasPrefix(b.String(), "       -  "), b.String())
+
+	// with a manifest the original modification time and hash are known
+	fb = newFakeBucket()
+	c = newManifestClient(fb)
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-list")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("some text")
+	localFile.Close()
+
+	modTime := time.Date(2020, 5, 17, 8, 30, 0, 0, time.UTC)
+	os.Chtimes(localFile.Name(), modTime, modTime)
+	_, err = c.listFiles()
+	assert.Nil(t, err)
+	assert.Nil(t, c.prepareAndDoUpload(localFile.Name(), "docs/a.txt"))
+	c.endManifestUpdate()
+	lists := fb.lists
+
+	files, err = c.getFileInfoList("")
+	assert.Nil(t, err)
+	hash := sha256.Sum256([]byte("some text"))
+	assert.Equal(t, hash[:], files[0].sha256)
+	assert.Equal(t, int64(9), files[0].size)
+	assert.True(t, modTime.Equal(files[0].modTime))
+	assert.True(t, files[0].uploaded.After(modTime))
+	assert.Equal(t, lists, fb.lists)
+
+	b.Reset()
+	assert.Nil(t, c.doList(listOptions{long: true}, "", &b))
+	assert.Contains(t, b.String(), hex.EncodeToString(hash[:])[:listHashLength]+"  docs/a.txt\n")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	localTempFilePrefix = ".upload-"
+	localLockTimeout    = time.Minute
+	localLockRetry      = 50 * time.Millisecond
+
+	errLocalObjectPath     = "invalid object path"
+	errLocalObjectNotFound = "object does not exist"
+	errLocalLocked         = "timed out waiting for the lock of the object"
+)
+
+// localBucketService stores objects as files in a directory tree, each "/"
+// separated segment of the object name becoming a directory.
+type localBucketService struct {
+	root string
+}
+
+func NewLocalBucketService(root string) *localBucketService {
+	return &localBucketService{filepath.Clean(root)}
+}
+
+// objectPath returns the path on disk of an object, refusing any name that
+// would end up outside of the root directory.
+func (ls localBucketService) objectPath(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", errors.New(errLocalObjectPath)
+	}
+
+	p := filepath.Join(ls.root, filepath.FromSlash(name))
+	if !strings.HasPrefix(p, ls.root+string(filepath.Separator)) {
+		return "", errors.New(errLocalObjectPath)
+	}
+	return p, nil
+}
+
+// removeEmptyParents removes the empty directories left behind after an
+// object is deleted or moved, stopping at the root.
+func (ls localBucketService) removeEmptyParents(p string) {
+	for dir := filepath.Dir(p); dir != ls.root && strings.HasPrefix(dir, ls.root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// CreateBucket creates the root directory, there is no location or storage
+// class for local directories.
+func (ls localBucketService) CreateBucket(location, storageClass string) error {
+	if location != "" || storageClass != "" {
+		log.Warn("location and storage class are ignored by the local backend")
+	}
+	return os.MkdirAll(ls.root, 0700)
+}
+
+func (ls localBucketService) Delete(encryptedFilePath string) error {
+	p, err := ls.objectPath(encryptedFilePath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return errors.New("Failed to delete <" + encryptedFilePath + ">: " + err.Error())
+	}
+
+	ls.removeEmptyParents(p)
+	return nil
+}
+
+func (ls localBucketService) Upload(r io.Reader, encryptedUploadPath string) error {
+	p, err := ls.objectPath(encryptedUploadPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	_, err = ls.upload(r, encryptedUploadPath, p)
+	return err
+}
+
+// upload writes an object to p, and returns its MD5.
+func (ls localBucketService) upload(r io.Reader, encryptedUploadPath, p string) ([]byte, error) {
+	// write to a temporary file first, so a failed upload never leaves a
+	// partial object behind
+	tmp, err := ioutil.TempFile(filepath.Dir(p), localTempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	md5Hash := md5.New()
+	if _, err := io.Copy(tmp, io.TeeReader(r, md5Hash)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		ls.removeEmptyParents(p)
+		return nil, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	expectedMD5Hash := md5Hash.Sum(nil)
+	actualMD5Hash, err := getFileMD5(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(expectedMD5Hash, actualMD5Hash) {
+		log.WithFields(logrus.Fields{"expected md5": expectedMD5Hash, "actual md5": actualMD5Hash}).Warn("Uploaded file is corrupted")
+		os.Remove(tmp.Name())
+		ls.removeEmptyParents(p)
+		return nil, errors.New(hashMismatchErr)
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{"filename": encryptedUploadPath}).Debug("Created object successfully.")
+	return actualMD5Hash, nil
+}
+
+// lock creates the lock file of the object at p, so that only one process
+// at a time replaces it conditionally, and returns the function removing it.
+// A lock older than localLockTimeout was left behind by a process which
+// died, and is taken over.
+func (ls localBucketService) lock(p string) (func(), error) {
+	lockPath := filepath.Join(filepath.Dir(p), localTempFilePrefix+"lock-"+filepath.Base(p))
+
+	for start := time.Now(); ; time.Sleep(localLockRetry) {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > localLockTimeout {
+			log.WithFields(logrus.Fields{"lock": lockPath}).Warn("Removing a stale lock.")
+			os.Remove(lockPath)
+		} else if time.Since(start) > localLockTimeout {
+			return nil, errors.New(errLocalLocked)
+		}
+	}
+}
+
+// DownloadVersion reads the whole object at once, so that the version, the
+// MD5 of the data, is the one of what is returned.
+func (ls localBucketService) DownloadVersion(encryptedFilePath string) (io.ReadCloser, string, error) {
+	p, err := ls.objectPath(encryptedFilePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, "", errors.New(errLocalObjectNotFound)
+	} else if err != nil {
+		return nil, "", errors.New("Error trying to download file:" + err.Error())
+	}
+
+	md5Hash := md5.Sum(data)
+	return ioutil.NopCloser(bytes.NewReader(data)), hex.EncodeToString(md5Hash[:]), nil
+}
+
+// UploadIfVersion compares the MD5 of the current object with version and
+// replaces it while holding its lock file.
+func (ls localBucketService) UploadIfVersion(r io.Reader, encryptedUploadPath, version string) (string, error) {
+	p, err := ls.objectPath(encryptedUploadPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+
+	unlock, err := ls.lock(p)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	current := ""
+	if md5Hash, err := getFileMD5(p); err == nil {
+		current = hex.EncodeToString(md5Hash)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if current != version {
+		return "", errors.New(errPreconditionFailed)
+	}
+
+	md5Hash, err := ls.upload(r, encryptedUploadPath, p)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(md5Hash), nil
+}
+
+func (ls localBucketService) Download(encryptedFilePath string, offset, length int64) (io.ReadCloser, int64, error) {
+	p, err := ls.objectPath(encryptedFilePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, 0, errors.New(errLocalObjectNotFound)
+	} else if err != nil {
+		return nil, 0, errors.New("Error trying to download file:" + err.Error())
+	}
+
+	fileStat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	if length < 0 {
+		return file, fileStat.Size(), nil
+	}
+	return readCloser{io.LimitReader(file, length), file}, fileStat.Size(), nil
+}
+
+func (ls localBucketService) List() ([]objectInfo, error) {
+	var objects []objectInfo
+
+	err := filepath.Walk(ls.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTempFilePrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ls.root, p)
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, objectInfo{filepath.ToSlash(rel), info.Size(), info.ModTime()})
+		return nil
+	})
+
+	if err != nil {
+		log.Errorf("error while getting object list: %s", err.Error())
+		return nil, errors.New("failed to get objects in bucket")
+	}
+	return objects, nil
+}
+
+func (ls localBucketService) Move(src, dst string) error {
+	srcPath, err := ls.objectPath(src)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err := ls.objectPath(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	ls.removeEmptyParents(srcPath)
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupLocalBucket() (*localBucketService, func()) {
+	root, err := ioutil.TempDir("", "gcloud-crypto-local")
+	if err != nil {
+		panic(err)
+	}
+	return NewLocalBucketService(root), func() { os.RemoveAll(root) }
+}
+
+func TestLocalBucketUploadDownload(t *testing.T) {
+	ls, done := setupLocalBucket()
+	defer done()
+
+	expected := randomByte(1000)
+
+	err := ls.Upload(bytes.NewReader(expected), "a/b/c")
+	assert.Nil(t, err)
+
+	download, size, err := ls.Download("a/b/c", 0, -1)
+	assert.Nil(t, err)
+
+	actual, _ := ioutil.ReadAll(download)
+	download.Close()
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, int64(len(expected)), size)
+
+	rangeTests := []struct {
+		offset, length int64
+		expected       []byte
+	}{
+		{0, 10, expected[:10]},
+		{990, -1, expected[990:]},
+		{500, 100, expected[500:600]},
+		{990, 100, expected[990:]},
+	}
+
+	for _, e := range rangeTests {
+		download, size, err := ls.Download("a/b/c", e.offset, e.length)
+		assert.Nil(t, err)
+
+		actual, _ := ioutil.ReadAll(download)
+		download.Close()
+		assert.Equal(t, e.expected, actual)
+		assert.Equal(t, int64(len(expected)), size)
+	}
+
+	_, _, err = ls.Download("a/b/404", 0, -1)
+	assert.Equal(t, errors.New(errLocalObjectNotFound), err)
+}
+
+func TestLocalBucketUploadFails(t *testing.T) {
+	ls, done := setupLocalBucket()
+	defer done()
+
+	err := ls.Upload(iotest.ErrReader(errors.New(errFakeInjected)), "dir/test0")
+	assert.Equal(t, errors.New(errFakeInjected), err)
+
+	objects, err := ls.List()
+	assert.Nil(t, err)
+	assert.Empty(t, objects)
+
+	_, err = os.Stat(filepath.Join(ls.root, "dir"))
+	assert.True(t, os.IsNotExist(err), "empty directories should be removed")
+}
+
+func TestLocalBucketUploadIfVersion(t *testing.T) {
+	ls, done := setupLocalBucket()
+	defer done()
+
+	// sessions incrementing a counter at the same time never lose an
+	// increment
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; {
+				count, version := 0, ""
+				if r, v, err := ls.DownloadVersion("counter"); err == nil {
+					data, _ := ioutil.ReadAll(r)
+					r.Close()
+					count, _ = strconv.Atoi(string(data))
+					version = v
+				}
+
+				_, err := ls.UploadIfVersion(strings.NewReader(strconv.Itoa(count+1)), "counter", version)
+				if err == nil {
+					n++
+				} else if err.Error() != errPreconditionFailed {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	r, _, err := ls.DownloadVersion("counter")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "40", string(data))
+
+	// a lock left behind by a process which died is taken over, and locks
+	// are not listed
+	lockPath := filepath.Join(ls.root, localTempFilePrefix+"lock-counter")
+	ioutil.WriteFile(lockPath, nil, 0600)
+	old := time.Now().Add(-2 * localLockTimeout)
+	os.Chtimes(lockPath, old, old)
+
+	_, version, _ := ls.DownloadVersion("counter")
+	_, err = ls.UploadIfVersion(strings.NewReader("41"), "counter", version)
+	assert.Nil(t, err)
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = ls.UploadIfVersion(strings.NewReader("42"), "counter", version)
+	assert.EqualError(t, err, errPreconditionFailed)
+
+	objects, _ := ls.List()
+	assert.Len(t, objects, 1)
+}
+
+func TestLocalBucketListMoveDelete(t *testing.T) {
+	ls, done := setupLocalBucket()
+	defer done()
+
+	for _, name := range []string{"a/test0", "a/b/test1", "test2"} {
+		assert.Nil(t, ls.Upload(bytes.NewReader(randomByte(10)), name))
+	}
+
+	objects, err := ls.List()
+	names := objectNames(objects)
+	sort.Strings(names)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/b/test1", "a/test0", "test2"}, names)
+	for _, object := range objects {
+		assert.Equal(t, int64(10), object.size)
+		assert.False(t, object.updated.IsZero())
+	}
+
+	assert.Nil(t, ls.Move("a/b/test1", "c/test1"))
+	assert.Nil(t, ls.Delete("a/test0"))
+	assert.NotNil(t, ls.Delete("a/test0"))
+
+	objects, err = ls.List()
+	names = objectNames(objects)
+	sort.Strings(names)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c/test1", "test2"}, names)
+
+	_, err = os.Stat(filepath.Join(ls.root, "a"))
+	assert.True(t, os.IsNotExist(err), "empty directories should be removed")
+}
+
+func TestLocalBucketObjectPath(t *testing.T) {
+	ls := NewLocalBucketService("/srv/vault")
+
+	objectPathTests := []struct {
+		name         string
+		expectedPath string
+		expectedErr  error
+	}{
+		{"abc", "/srv/vault/abc", nil},
+		{"abc/def", "/srv/vault/abc/def", nil},
+		{"", "", errors.New(errLocalObjectPath)},
+		{"/abc", "", errors.New(errLocalObjectPath)},
+		{"../abc", "", errors.New(errLocalObjectPath)},
+		{"abc/../..", "", errors.New(errLocalObjectPath)},
+	}
+
+	for _, e := range objectPathTests {
+		p, err := ls.objectPath(e.name)
+		assert.Equal(t, e.expectedErr, err)
+		assert.Equal(t, e.expectedPath, p)
+	}
+}
+
+func TestLocalBucketCreateBucket(t *testing.T) {
+	ls, done := setupLocalBucket()
+	defer done()
+
+	ls.root = filepath.Join(ls.root, "a", "vault")
+	assert.Nil(t, ls.CreateBucket("", ""))
+
+	info, err := os.Stat(ls.root)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	// already exists
+	assert.Nil(t, ls.CreateBucket("", ""))
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"syscall"
 
+	"github.com/GregorioDiStefano/gcloud-crypto/progress"
 	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -16,6 +23,7 @@ import (
 	"google.golang.org/api/storage/v1"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -30,6 +38,33 @@ type client struct {
 	keys   *simplecrypto.Keys
 	bucket Bucket
 	bcache bucketCache
+
+	// cwd is the current remote directory of the shell, "" being the root
+	cwd string
+
+	// manifest is read from the bucket when useManifest is set, nil until
+	// then or when it has to be rebuilt
+	manifest    *manifest
+	useManifest bool
+
+	// concurrency is how many files uploads and downloads transfer at once,
+	// mu guards the cache and the manifest while they do
+	concurrency int
+	mu          sync.Mutex
+
+	// files of resumableThreshold bytes or more are uploaded through
+	// resumable sessions, the state of which is kept in stateDir
+	stateDir           string
+	resumableThreshold int64
+
+	// recipients are the ones new files are encrypted to, read from the
+	// vault header by the first upload of the session, and read again after
+	// the recipient commands change them
+	recipients []*simplecrypto.Recipient
+}
+
+func newClient(keys *simplecrypto.Keys, bucket Bucket) *client {
+	return &client{keys: keys, bucket: bucket, bcache: bucketCache{}, concurrency: 1}
 }
 
 func init() {
@@ -39,7 +74,17 @@ func init() {
 	flag.String("delete", "", "delete object")
 	flag.String("download", "", "file to download to local disk")
 	flag.String("upload", "", "file to upload to cloud")
-	flag.String("dir", "", "directory to store uploaded file to")
+	flag.String("dir", "", "remote directory for -upload and -list, local directory for -download")
+	flag.String("c", "", "run shell commands, separated by ';'")
+	flag.String("script", "", "run the shell commands of a file, '-' for stdin")
+	flag.Bool("exit-on-error", false, "stop -c and -script at the first failed command")
+	flag.String("keyfile", "", "unlock the vault with a keyfile instead of a password")
+	flag.Int("password-fd", -1, "read the password from this file descriptor")
+	flag.Int("j", 0, "number of files uploaded or downloaded at once, 'concurrency' in the config file by default")
+	flag.Bool("quiet", false, "do not show the progress of transfers")
+	flag.Bool("no-cache", false, "do not keep the decrypted names of the bucket on disk")
+	flag.String("header", "", "local copy of the vaultheader object, for the offline commands")
+	flag.String("recipient", "", "upload the -upload file encrypted to these comma separated recipients, without the password")
 }
 
 const (
@@ -55,65 +100,215 @@ func main() {
 		log.Debug("Debug logging enabled")
 	}
 
+	progress.Default = getProgressReporter()
+
 	if flag.Lookup("version").Value.String() == "true" {
 		log.Infof("Version: %s", Version)
 		log.Infof("Build date: %s", BuildTime)
 		log.Infof("Compiler version: %s", CompilerVersion)
-		os.Exit(0)
+		os.Exit(exitOK)
+	}
+
+	if flag.Arg(0) == "keygen" {
+		if err := runKeygen(); err != nil {
+			log.Warn(err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitOK)
+	}
+
+	if isOfflineCommand(flag.Arg(0)) {
+		if err := runOffline(flag.Args()); err != nil {
+			log.Warn(err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitOK)
 	}
 
 	userData := parseConfig()
-	rl, err := setupReadline()
 
+	if recipients := flag.Lookup("recipient").Value.String(); recipients != "" {
+		if err := runWriteOnlyUpload(newBucket(userData), recipients, flag.Lookup("upload").Value.String(), flag.Lookup("dir").Value.String()); err != nil {
+			log.Warn(err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitOK)
+	}
+
+	if flag.Arg(0) == "init" {
+		if err := runInit(newBucket(userData), flag.Args()[1:]); err != nil {
+			log.Warn(err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitOK)
+	}
+
+	password, err := getSecret()
 	if err != nil {
-		panic(err)
+		log.Warn(err)
+		os.Exit(exitFailure)
 	}
 
-	password := getPasswordFromTerminal()
-	keys, err := simplecrypto.GetKeyFromPassphrase(password, userData.salt, 8192, 16, 128)
+	bucket := newBucket(userData)
+	keys, legacy, err := unlockVault(bucket, password)
+
+	if err != nil {
+		log.Warn(err)
+		os.Exit(exitFailure)
+	} else if legacy {
+		log.Warn("this vault uses the legacy salt shared by all vaults, run 'migrate' to give it its own")
+	}
+
+	c := newClient(keys, bucket)
+	c.useManifest = userData.configFile.GetBool("manifest")
+	if _, ok := bucket.(conditionalBucket); c.useManifest && !ok {
+		log.Warn(errManifestUnconditional + ", the bucket is listed instead")
+		c.useManifest = false
+	}
+	c.concurrency = getConcurrency()
+	c.stateDir = userData.stateDir()
+	c.resumableThreshold = userData.configFile.GetInt64("resumable_threshold")
+	if flag.Lookup("no-cache").Value.String() != "true" {
+		if err := c.bcache.load(userData.cacheDir(), keys); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warn("unable to load the name cache, it will be rebuilt")
+		}
+	}
+
+	if opts := getBatchOptions(); opts.isBatch() {
+		err := runBatch(c, opts, os.Stdout)
+		if err != nil {
+			log.Warn(err)
+		}
+		c.saveCache()
+		os.Exit(batchExitStatus(err))
+	}
+
+	rl, err := setupReadline(c)
 
 	if err != nil {
 		panic(err)
 	}
 
-	googleClient, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
+	interactiveMode(c, rl)
+	os.Exit(exitOK)
+}
+
+// newBucket creates the Bucket implementation selected by the 'backend'
+// setting of the config file.
+func newBucket(userData *userData) Bucket {
+	switch userData.configFile.GetString("backend") {
+	case backendLocal:
+		return NewLocalBucketService(userData.configFile.GetString("path"))
+	case backendS3:
+		bucket, err := NewS3BucketService(http.DefaultClient,
+			userData.configFile.GetString("endpoint"),
+			userData.configFile.GetString("region"),
+			userData.configFile.GetString("access_key"),
+			userData.configFile.GetString("secret_key"),
+			userData.configFile.GetString("bucket"))
+
+		if err != nil {
+			panic(err)
+		}
+
+		return bucket
+	default:
+		googleClient, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
+
+		if err != nil {
+			panic(fmt.Sprintf("Unable to get default client: %v", err))
+		}
+
+		service, err := storage.New(googleClient)
+
+		if err != nil {
+			panic(fmt.Sprintf("Unable to create storage service: %v", err))
+		}
+
+		return NewGoogleBucketService(googleClient, service, nil, userData.configFile.GetString("bucket"), userData.configFile.GetString("project_id"))
+	}
+}
+
+// runInit sets up a new vault in the bucket, creating it if needed.
+func runInit(bucket Bucket, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	location := flags.String("location", "", "location of the bucket, when it is created")
+	storageClass := flags.String("storage-class", "", "storage class of the bucket, when it is created")
+	force := flags.Bool("force", false, "create the vault even if the bucket is not empty")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
 
+	password, err := getNewPasswordFromTerminal()
 	if err != nil {
-		panic(fmt.Sprintf("Unable to get default client: %v", err))
+		return err
+	}
+
+	if _, err := initVault(bucket, password, *location, *storageClass, *force); err != nil {
+		return err
 	}
 
-	service, err := storage.New(googleClient)
+	log.Info("Vault created")
+	return nil
+}
 
+// runOffline unlocks the keys without the bucket and runs an offline command.
+func runOffline(args []string) error {
+	password, err := getSecret()
 	if err != nil {
-		panic(fmt.Sprintf("Unable to create storage service: %v", err))
+		return err
 	}
 
-	bucket := NewGoogleBucketService(service, keys, userData.configFile.GetString("bucket"), userData.configFile.GetString("project_id"))
+	keys, err := offlineKeys(flag.Lookup("header").Value.String(), password)
+	if err != nil {
+		return err
+	}
+	return runOfflineCommand(args, keys, os.Stdout)
+}
 
-	if err := verifyPassword(bucket, keys); err != nil {
-		log.Warn(err)
-		os.Exit(1)
+// runKeygen prints a new identity, to be kept secret, and its recipient,
+// which can be added to vaults.
+func runKeygen() error {
+	id, err := simplecrypto.NewIdentity()
+	if err != nil {
+		return err
 	}
 
-	c := &client{keys, bucket, bucketCache{}}
-	interactiveMode(c, rl)
-	os.Exit(0)
+	fmt.Printf("identity:  %s\n", id)
+	fmt.Printf("recipient: %s\n", id.Recipient())
+	return nil
 }
 
-func verifyPassword(bucket Bucket, keys *simplecrypto.Keys) error {
-	testdata, err := simplecrypto.EncryptText(PASSWORD_CHECK_STRING, keys.EncryptionKey)
+// runWriteOnlyUpload uploads a file encrypted to recipients, for clients
+// which must not be able to read the vault.
+func runWriteOnlyUpload(bucket Bucket, recipientList, uploadFile, remoteDirectory string) error {
+	if uploadFile == "" {
+		return errors.New(errWriteOnlyUploadMissing)
+	}
 
+	recipients, err := parseRecipients(recipientList)
 	if err != nil {
-		return errors.New("unable to encrypt test string: " + err.Error())
+		return err
+	}
+
+	remotePath := path.Join(remoteDirectory, filepath.Base(uploadFile))
+	if err := uploadToRecipients(bucket, recipients, uploadFile, remotePath); err != nil {
+		return err
 	}
 
-	testfile, err := bucket.Download(PASSWORD_CHECK_FILE)
-	defer os.Remove(testfile)
+	log.Infof("Uploaded %s", remotePath)
+	return nil
+}
+
+func verifyPassword(bucket Bucket, keys *simplecrypto.Keys) error {
+	testfile, _, err := bucket.Download(PASSWORD_CHECK_FILE, 0, -1)
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("failed to find a '%s' file, if this is a new bucket, create a file called '%s' containing: %s", PASSWORD_CHECK_FILE, PASSWORD_CHECK_FILE, testdata))
+		return errors.New(fmt.Sprintf("failed to find a vault header or a '%s' file, if this is a new bucket, run 'gcloud-crypto init' to set it up", PASSWORD_CHECK_FILE))
 	} else {
-		testfileBytes, _ := ioutil.ReadFile(testfile)
+		defer testfile.Close()
+		testfileBytes, _ := ioutil.ReadAll(testfile)
 		if plainText, err := simplecrypto.DecryptText(string(testfileBytes), keys.EncryptionKey); err != nil || plainText != PASSWORD_CHECK_STRING {
 			return errors.New("failed to verify password: " + err.Error())
 		}
@@ -121,17 +316,91 @@ func verifyPassword(bucket Bucket, keys *simplecrypto.Keys) error {
 	return nil
 }
 
-func getPasswordFromTerminal() []byte {
-	fmt.Print("Password: ")
-	password, err := terminal.ReadPassword(syscall.Stdin)
+// getBatchOptions reads the flags of the non-interactive mode.
+func getBatchOptions() batchOptions {
+	return batchOptions{
+		list:     flag.Lookup("list").Value.String() == "true",
+		delete:   flag.Lookup("delete").Value.String(),
+		download: flag.Lookup("download").Value.String(),
+		upload:   flag.Lookup("upload").Value.String(),
+		dir:      flag.Lookup("dir").Value.String(),
 
-	fmt.Println()
-	fmt.Println()
+		command:     flag.Lookup("c").Value.String(),
+		script:      flag.Lookup("script").Value.String(),
+		exitOnError: flag.Lookup("exit-on-error").Value.String() == "true",
+	}
+}
+
+// getConcurrency returns how many files are transferred at once, -j taking
+// precedence over the config file.
+func getConcurrency() int {
+	if j, _ := strconv.Atoi(flag.Lookup("j").Value.String()); j > 0 {
+		return j
+	}
+	return viper.GetInt("concurrency")
+}
+
+// getProgressReporter draws progress bars on terminals, and prints lines
+// for other output, unless -quiet is given.
+func getProgressReporter() progress.Reporter {
+	switch {
+	case flag.Lookup("quiet").Value.String() == "true":
+		return progress.Discard
+	case terminal.IsTerminal(int(os.Stdout.Fd())):
+		return progress.NewTerminal(os.Stdout)
+	}
+	return progress.NewLines(os.Stdout)
+}
+
+// getSecret returns the secret unlocking the vault, from the first password
+// source set.
+func getSecret() ([]byte, error) {
+	return getPasswordSources().provider().password()
+}
 
+// getPasswordSources reads the password sources from the flags, the
+// environment and the config file.
+func getPasswordSources() passwordSources {
+	passwordFD, _ := strconv.Atoi(flag.Lookup("password-fd").Value.String())
+
+	return passwordSources{
+		keyFile:         flag.Lookup("keyfile").Value.String(),
+		passwordFD:      passwordFD,
+		password:        os.Getenv(passwordEnv),
+		passwordFile:    os.Getenv(passwordFileEnv),
+		passwordCommand: viper.GetString("password_command"),
+		terminalFD:      int(syscall.Stdin),
+	}
+}
+
+// getCurrentSecret returns the secret unlocking the vault again, for the
+// commands checking it, from the same source as getSecret.
+func getCurrentSecret() ([]byte, error) {
+	provider := getPasswordSources().provider()
+	if _, ok := provider.(terminalProvider); ok {
+		fmt.Println("Current password")
+	}
+	return provider.password()
+}
+
+// getNewPasswordFromTerminal asks for a new password twice, to catch typos.
+func getNewPasswordFromTerminal() ([]byte, error) {
+	password, err := readPasswordFromTerminal("New password: ")
 	if err != nil {
-		// panic since this is fatal.
-		panic(err)
+		return nil, err
 	}
 
-	return password
+	confirmation, err := readPasswordFromTerminal("Repeat password: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(password, confirmation) {
+		return nil, errors.New(errPasswordMismatch)
+	}
+	return password, nil
+}
+
+func readPasswordFromTerminal(prompt string) ([]byte, error) {
+	return terminalProvider{int(syscall.Stdin), prompt}.password()
 }
@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -29,7 +30,26 @@ func init() {
 	testStartTime = strconv.FormatInt(time.Now().Unix(), 10)
 }
 
-func setupUp() (*bucketService, simplecrypto.Keys) {
+func testKeys() simplecrypto.Keys {
+	keys, err := simplecrypto.GetKeyFromPassphrase([]byte("testing"), []byte("salt1234"), 4096, 16, 1)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return *keys
+}
+
+// setupUp returns the bucket used by the tests: an in-memory fake, or a fresh
+// bucket in the GCS testing project when GCLOUD_CRYPTO_TEST_GCS is set.
+func setupUp() (Bucket, simplecrypto.Keys) {
+	if os.Getenv("GCLOUD_CRYPTO_TEST_GCS") != "" {
+		return setupGoogleBucket()
+	}
+	return newFakeBucket(), testKeys()
+}
+
+func setupGoogleBucket() (*bucketService, simplecrypto.Keys) {
 	client, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
 
 	if err != nil {
@@ -43,17 +63,17 @@ func setupUp() (*bucketService, simplecrypto.Keys) {
 
 	testingBucketPrefix := "gct-" + testStartTime + "-"
 	testingBucket := testingBucketPrefix + strings.ToLower(base64.RawURLEncoding.EncodeToString(randomByte(4)))
-	keys, err := simplecrypto.GetKeyFromPassphrase([]byte("testing"), []byte("salt1234"), 4096, 16, 1)
+	keys := testKeys()
 
-	bs := NewGoogleBucketService(service, keys, testingBucket, gcsProjectID)
+	bs := NewGoogleBucketService(client, service, &keys, testingBucket, gcsProjectID)
 
 	existingBucketsObj, _ := service.Buckets.List(gcsProjectID).Do()
 	for _, b := range existingBucketsObj.Items {
 		if strings.HasPrefix(b.Name, testingBucketPrefix) {
 
-			objs, _ := NewGoogleBucketService(service, keys, b.Name, gcsProjectID).List()
-			for _, e := range objs {
-				NewGoogleBucketService(service, keys, b.Name, gcsProjectID).Delete(e)
+			objs, _ := NewGoogleBucketService(client, service, &keys, b.Name, gcsProjectID).List()
+			for _, e := range objectNames(objs) {
+				NewGoogleBucketService(client, service, &keys, b.Name, gcsProjectID).Delete(e)
 			}
 
 			log.Info("Removing old testing bucket: " + b.Name)
@@ -65,42 +85,19 @@ func setupUp() (*bucketService, simplecrypto.Keys) {
 		panic(err)
 	}
 
-	if err != nil {
-		panic(err)
-	}
-
-	return bs, *keys
+	return bs, keys
 }
 
-func brokenSetupUp() (*bucketService, simplecrypto.Keys) {
-	client, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
-
-	if err != nil {
-		log.Fatalf("Unable to get default client: %v", err)
-	}
-	service, err := storage.New(client)
-
-	if err != nil {
-		panic(err)
-	}
-
-	userData := parseConfig()
-	userData.configFile.Set("bucket", "bad")
-	userData.configFile.Set("project_id", "bad")
-
-	keys, err := simplecrypto.GetKeyFromPassphrase([]byte("testing"), []byte("salt1234"), 4096, 16, 1)
-	bs := NewGoogleBucketService(service, keys, "bad", "bad")
-
-	if err != nil {
-		panic(err)
-	}
-
-	return bs, *keys
+// brokenSetupUp returns a bucket that fails to list its objects.
+func brokenSetupUp() (*fakeBucket, simplecrypto.Keys) {
+	fb := newFakeBucket()
+	fb.listErr = errors.New("failed to get objects in bucket")
+	return fb, testKeys()
 }
 
 func cleanUp(c *client) {
 	objs, _ := c.bucket.List()
-	for _, e := range objs {
+	for _, e := range objectNames(objs) {
 		c.bucket.Delete(e)
 	}
 
@@ -110,7 +107,7 @@ func cleanUp(c *client) {
 func randomFile() string {
 	tmpfile, _ := ioutil.TempFile(".", "test")
 	tmpfile.Write([]byte("this is a test string"))
-	return tmpfile.Name()
+	return filepath.Clean(tmpfile.Name())
 }
 
 func searchForString(slice []string, s string) bool {
@@ -124,29 +121,21 @@ func searchForString(slice []string, s string) bool {
 
 func TestVerifyPassword(t *testing.T) {
 	bs, keys := setupUp()
-	c := client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 
-	tf, _ := ioutil.TempFile("/tmp", "testing")
-	defer os.Remove(tf.Name())
+	// test without a keycheck file
+	err := verifyPassword(bs, &keys)
+	assert.NotNil(t, err)
 
 	// test with correct password
-	tf.WriteString("oEFyYW0rbdcMOif8pzS8McO4tVRvHvX6uVNTkmYad4sPcQ4M")
-	md5hex, err := hex.DecodeString("3483ba92a60078005e30a70200e0827b")
-	assert.Nil(t, err)
-
-	err = c.bucket.Upload(tf.Name(), PASSWORD_CHECK_FILE, md5hex)
+	err = c.bucket.Upload(strings.NewReader("oEFyYW0rbdcMOif8pzS8McO4tVRvHvX6uVNTkmYad4sPcQ4M"), PASSWORD_CHECK_FILE)
 	assert.Nil(t, err)
 
 	err = verifyPassword(bs, &keys)
 	assert.Nil(t, err)
 
 	// test when keycontents doesn't match password
-	tf2, _ := ioutil.TempFile("/tmp", "testing")
-	tf2.WriteString("wrongpasssword")
-	md5hex, err = hex.DecodeString("deadbeef")
-	assert.Nil(t, err)
-
-	err = c.bucket.Upload(tf2.Name(), PASSWORD_CHECK_FILE, md5hex)
+	err = c.bucket.Upload(strings.NewReader("wrongpasssword"), PASSWORD_CHECK_FILE)
 	assert.Nil(t, err)
 
 	err = verifyPassword(bs, &keys)
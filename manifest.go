@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// VAULT_MANIFEST_FILE holds the manifest, encrypted with the vault keys.
+	// VAULT_MANIFEST_PENDING_FILE holds a random mark, written anew before
+	// the manifest is updated and after a file was added without updating
+	// it. The manifest records the mark it accounts for, and is rebuilt when
+	// the current one differs.
+	VAULT_MANIFEST_FILE         = "manifest"
+	VAULT_MANIFEST_PENDING_FILE = "manifest.pending"
+
+	manifestVersion = 1
+	manifestMarkLen = 16
+	// manifestCommitAttempts bounds how many times the manifest is rebuilt
+	// when other sessions keep writing it first.
+	manifestCommitAttempts = 5
+
+	errManifestVersion       = "unsupported manifest version"
+	errPreconditionFailed    = "the object was replaced since it was read"
+	errManifestUnconditional = "the storage service cannot replace the manifest conditionally"
+)
+
+// conditionalBucket is implemented by the backends which can replace an
+// object only if nobody else replaced it since it was read, so a session
+// never writes the manifest over the changes of another one. The version of
+// an object is opaque, and empty when the object does not exist.
+type conditionalBucket interface {
+	// DownloadVersion downloads a whole object along with its version.
+	DownloadVersion(name string) (io.ReadCloser, string, error)
+	// UploadIfVersion uploads an object only if its current version is
+	// version, failing with errPreconditionFailed otherwise, and returns the
+	// version of the new object.
+	UploadIfVersion(r io.Reader, name, version string) (string, error)
+}
+
+// manifestEntry describes a file of the vault. Size is -1 and the other
+// fields are empty for the files found by listing the bucket, which were not
+// uploaded along with the manifest.
+type manifestEntry struct {
+	Object   string    `json:"object"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime,omitempty"`
+	Uploaded time.Time `json:"uploaded,omitempty"`
+	SHA256   []byte    `json:"sha256,omitempty"`
+}
+
+// manifest maps the decrypted paths of the files of the vault to their
+// objects, so files can be found by reading a single object instead of
+// listing the bucket and decrypting every name. It is read once per session
+// and written back after the commands changing it.
+//
+// A session only writes the manifest over the version of the object it read,
+// and rebuilds it otherwise, so the changes of another session are not lost.
+// Mark is the pending mark the files account for; mark is the one this
+// session wrote for its current changes.
+type manifest struct {
+	Version int                      `json:"version"`
+	Mark    string                   `json:"mark"`
+	Files   map[string]manifestEntry `json:"files"`
+
+	version string
+	mark    string
+	dirty   bool
+}
+
+func readManifest(bucket Bucket, keys *simplecrypto.Keys) (*manifest, error) {
+	m, _, err := readManifestVersion(bucket, keys)
+	return m, err
+}
+
+// readManifestVersion also returns the version of the manifest object, which
+// is known whenever it could be downloaded, even if it could not be read.
+func readManifestVersion(bucket Bucket, keys *simplecrypto.Keys) (*manifest, string, error) {
+	var r io.ReadCloser
+	var version string
+	var err error
+	if cb, ok := bucket.(conditionalBucket); ok {
+		r, version, err = cb.DownloadVersion(VAULT_MANIFEST_FILE)
+	} else {
+		r, _, err = bucket.Download(VAULT_MANIFEST_FILE, 0, -1)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(simplecrypto.NewDecryptReader(r, keys))
+	if err != nil {
+		return nil, version, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, version, err
+	} else if m.Version != manifestVersion {
+		return nil, version, errors.New(errManifestVersion)
+	}
+	m.version = version
+	return &m, version, nil
+}
+
+// writeManifest replaces the version of the manifest that was read, failing
+// with errPreconditionFailed when another session replaced it since.
+func writeManifest(bucket Bucket, keys *simplecrypto.Keys, m *manifest) error {
+	cb, ok := bucket.(conditionalBucket)
+	if !ok {
+		return errors.New(errManifestUnconditional)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	encryptedReader, err := simplecrypto.NewEncryptReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return err
+	}
+
+	version, err := cb.UploadIfVersion(encryptedReader, VAULT_MANIFEST_FILE, m.version)
+	if err != nil {
+		return err
+	}
+	m.version = version
+	return nil
+}
+
+func newManifestMark() (string, error) {
+	b := make([]byte, manifestMarkLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// markManifestStale writes a new pending mark, which the manifest does not
+// account for, and returns it. The clients adding files without updating
+// the manifest call it once the files were added.
+func markManifestStale(bucket Bucket) (string, error) {
+	mark, err := newManifestMark()
+	if err != nil {
+		return "", err
+	}
+	return mark, bucket.Upload(strings.NewReader(mark), VAULT_MANIFEST_PENDING_FILE)
+}
+
+// readManifestMark returns the current pending mark, which is empty when
+// there is none.
+func readManifestMark(bucket Bucket) string {
+	r, _, err := bucket.Download(VAULT_MANIFEST_PENDING_FILE, 0, -1)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+
+	mark, err := ioutil.ReadAll(io.LimitReader(r, 2*manifestMarkLen))
+	if err != nil {
+		// an unreadable mark is never accounted for
+		return "-"
+	}
+	return string(mark)
+}
+
+// loadManifest reads the manifest, unless it is missing or stale, in which
+// case c.manifest stays nil.
+func (c *client) loadManifest() {
+	mark := readManifestMark(c.bucket)
+
+	m, err := readManifest(c.bucket, c.keys)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Debug("unable to read the manifest, it will be rebuilt")
+		return
+	}
+
+	if mark != m.Mark {
+		log.Debug("the manifest is stale, it will be rebuilt")
+		return
+	}
+	c.manifest = m
+}
+
+// listFiles maps the decrypted paths of the files of the vault to their
+// objects, from the manifest when there is one. Otherwise the bucket is
+// listed and, with useManifest set, the manifest rebuilt from the listing.
+func (c *client) listFiles() (decryptedToEncryptedFilePath, error) {
+	if c.useManifest && c.manifest == nil {
+		c.loadManifest()
+	}
+
+	if c.manifest != nil {
+		m := make(decryptedToEncryptedFilePath, len(c.manifest.Files))
+		for plaintextPath, entry := range c.manifest.Files {
+			m[plaintextPath] = entry.Object
+		}
+		c.bcache.replace(m)
+		return m, nil
+	}
+
+	if c.useManifest {
+		m, err := c.rebuildManifest()
+		if m == nil {
+			return nil, err
+		} else if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warn("unable to write the manifest")
+		}
+		return m, nil
+	}
+
+	objects, err := c.bucket.List()
+	if err != nil {
+		return nil, errors.New("failed getting objects: " + err.Error())
+	}
+	return c.getDecryptedToEncryptedFileMapping(objectNames(objects)), nil
+}
+
+// rebuildManifest replaces the manifest with the files found by listing the
+// bucket, and writes it when that changes it. The files are returned once
+// the bucket was listed, even if the manifest could not be written.
+func (c *client) rebuildManifest() (decryptedToEncryptedFilePath, error) {
+	files, err := c.buildManifest()
+	if err != nil {
+		return nil, err
+	}
+	return files, c.commitManifest()
+}
+
+// buildManifest replaces the manifest of the session with the files found by
+// listing the bucket, which account for the pending mark read before,
+// keeping what the stored manifest and the one of the session knew about
+// the objects still there. The stored manifest is read before listing, so
+// that writing over its version cannot lose the files of a session which
+// wrote it later. The manifest is only dirty when it differs from the stored
+// one.
+func (c *client) buildManifest() (decryptedToEncryptedFilePath, error) {
+	mark := readManifestMark(c.bucket)
+	stored, version, storedErr := readManifestVersion(c.bucket, c.keys)
+	objects, err := c.bucket.List()
+	if err != nil {
+		return nil, errors.New("failed getting objects: " + err.Error())
+	}
+	files := c.getDecryptedToEncryptedFileMapping(objectNames(objects))
+
+	m := &manifest{Version: manifestVersion, Mark: mark, Files: make(map[string]manifestEntry, len(files)), version: version}
+	known := map[string]manifestEntry{}
+	for _, old := range []*manifest{stored, c.manifest} {
+		if old != nil {
+			for _, entry := range old.Files {
+				known[entry.Object] = entry
+			}
+		}
+	}
+
+	for plaintextPath, object := range files {
+		if plaintextPath == "" {
+			continue
+		}
+
+		entry, ok := known[object]
+		if !ok {
+			entry = manifestEntry{Object: object, Size: -1}
+		}
+		m.Files[plaintextPath] = entry
+	}
+
+	m.dirty = storedErr != nil || stored.Mark != m.Mark || !reflect.DeepEqual(stored.Files, m.Files)
+	c.manifest = m
+	return files, nil
+}
+
+// beginManifestUpdate writes a new pending mark before the first change of a
+// command, so that the manifest is rebuilt if the command does not get to
+// commit it. A manifest which does not account for the current mark any
+// more is rebuilt first.
+func (c *client) beginManifestUpdate() error {
+	if c.manifest == nil || c.manifest.mark != "" {
+		return nil
+	}
+
+	if readManifestMark(c.bucket) != c.manifest.Mark {
+		log.Debug("files were added since the manifest was read, rebuilding it")
+		if _, err := c.rebuildManifest(); err != nil {
+			return err
+		}
+	}
+
+	mark, err := markManifestStale(c.bucket)
+	if err != nil {
+		return err
+	}
+	c.manifest.mark = mark
+	return nil
+}
+
+func (c *client) manifestAdd(plaintextPath string, entry manifestEntry) {
+	if c.manifest != nil {
+		c.manifest.Files[plaintextPath] = entry
+		c.manifest.dirty = true
+	}
+}
+
+func (c *client) manifestRemove(plaintextPath string) {
+	if c.manifest != nil {
+		delete(c.manifest.Files, plaintextPath)
+		c.manifest.dirty = true
+	}
+}
+
+func (c *client) manifestMove(src, dst, dstObject string) {
+	if c.manifest != nil {
+		entry := c.manifest.Files[src]
+		entry.Object = dstObject
+		delete(c.manifest.Files, src)
+		c.manifest.Files[dst] = entry
+		c.manifest.dirty = true
+	}
+}
+
+// commitManifest writes the manifest changed by a command, accounting for
+// the pending mark of the command. The manifest is rebuilt instead when
+// another session wrote it since it was read, until it is written over the
+// version it was rebuilt from.
+func (c *client) commitManifest() error {
+	for attempt := 1; c.manifest != nil && c.manifest.dirty; attempt++ {
+		if c.manifest.mark != "" {
+			c.manifest.Mark = c.manifest.mark
+		}
+
+		err := writeManifest(c.bucket, c.keys, c.manifest)
+		if err == nil {
+			c.manifest.dirty, c.manifest.mark = false, ""
+			return nil
+		} else if err.Error() != errPreconditionFailed || attempt == manifestCommitAttempts {
+			return err
+		}
+
+		log.Debug("the manifest was written by another session, rebuilding it")
+		if _, err := c.buildManifest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endManifestUpdate commits the manifest at the end of a command. A failed
+// commit leaves the pending mark, so the manifest is rebuilt later.
+func (c *client) endManifestUpdate() {
+	if err := c.commitManifest(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warn("unable to write the manifest, it will be rebuilt")
+		c.manifest = nil
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newManifestClient(fb *fakeBucket) *client {
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	c.useManifest = true
+	return c
+}
+
+// uploadThroughClient uploads data as remotePath like the upload command,
+// so the manifest is updated.
+func uploadThroughClient(t *testing.T, c *client, remotePath string, data []byte) {
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-manifest")
+	defer os.Remove(localFile.Name())
+	localFile.Write(data)
+	localFile.Close()
+
+	_, err := c.listFiles()
+	assert.Nil(t, err)
+	assert.Nil(t, c.prepareAndDoUpload(localFile.Name(), remotePath))
+	c.endManifestUpdate()
+}
+
+// manifestFresh is true when the stored manifest accounts for the pending
+// mark, so it is read instead of listing the bucket.
+func manifestFresh(fb *fakeBucket, keys *simplecrypto.Keys) bool {
+	m, err := readManifest(fb, keys)
+	return err == nil && m.Mark == readManifestMark(fb)
+}
+
+func TestManifest(t *testing.T) {
+	fb := newFakeBucket()
+	c := newManifestClient(fb)
+
+	// the first listing builds the manifest
+	uploadThroughClient(t, c, "docs/a.txt", []byte("some text"))
+	uploadThroughClient(t, c, "docs/b.txt", []byte("more text"))
+	assert.True(t, manifestFresh(fb, c.keys))
+
+	m, err := readManifest(fb, c.keys)
+	assert.Nil(t, err)
+	assert.Len(t, m.Files, 2)
+
+	entry := m.Files["docs/a.txt"]
+	hash := sha256.Sum256([]byte("some text"))
+	assert.Equal(t, int64(9), entry.Size)
+	assert.Equal(t, hash[:], entry.SHA256)
+	assert.False(t, entry.Uploaded.IsZero())
+	assert.Contains(t, fb.objects, entry.Object)
+
+	// other sessions find the files without listing the bucket
+	assert.Nil(t, c.doMoveObject("docs/a.txt", "archive/a.txt"))
+	assert.Nil(t, c.doDeleteObject("docs/b.txt", false))
+	lists := fb.lists
+
+	c = newManifestClient(fb)
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"archive/a.txt"}, files)
+	assert.Equal(t, lists, fb.lists)
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-manifest")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, c.doDownload("archive/a.txt", dir))
+	data, _ := ioutil.ReadFile(dir + "/a.txt")
+	assert.Equal(t, []byte("some text"), data)
+	assert.Equal(t, lists, fb.lists)
+
+	m, _ = readManifest(fb, c.keys)
+	assert.Equal(t, hash[:], m.Files["archive/a.txt"].SHA256)
+	assert.True(t, manifestFresh(fb, c.keys))
+}
+
+func TestManifestRebuild(t *testing.T) {
+	fb := newFakeBucket()
+	c := newManifestClient(fb)
+	uploadThroughClient(t, c, "docs/a.txt", []byte("some text"))
+
+	// a write-only upload marks the manifest as stale
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-manifest")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("uploaded by a write-only client")
+	localFile.Close()
+
+	id, _ := c.keys.Identity()
+	assert.Nil(t, uploadToRecipients(fb, []*simplecrypto.Recipient{id.Recipient()}, localFile.Name(), "camera/photo.jpg"))
+	assert.False(t, manifestFresh(fb, c.keys))
+
+	lists := fb.lists
+	c = newManifestClient(fb)
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"camera/photo.jpg", "docs/a.txt"}, files)
+	assert.Equal(t, lists+1, fb.lists)
+
+	// the rebuilt manifest keeps what it knew about the other files
+	m, err := readManifest(fb, c.keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), m.Files["docs/a.txt"].Size)
+	assert.Equal(t, int64(-1), m.Files["camera/photo.jpg"].Size)
+	assert.True(t, manifestFresh(fb, c.keys))
+
+	// a missing manifest is rebuilt too
+	delete(fb.objects, VAULT_MANIFEST_FILE)
+	c = newManifestClient(fb)
+	files, _ = c.getFileList("")
+	assert.Len(t, files, 2)
+	assert.Contains(t, fb.objects, VAULT_MANIFEST_FILE)
+}
+
+func TestManifestInterruptedUpdate(t *testing.T) {
+	fb := newFakeBucket()
+	c := newManifestClient(fb)
+	uploadThroughClient(t, c, "docs/a.txt", []byte("some text"))
+
+	// the pending mark stays when a command fails half way
+	fb.moveErr = errors.New(errFakeInjected)
+	assert.Equal(t, fb.moveErr, c.doMoveObject("docs/a.txt", "docs/b.txt"))
+	assert.False(t, manifestFresh(fb, c.keys))
+	fb.moveErr = nil
+
+	lists := fb.lists
+	c = newManifestClient(fb)
+	files, _ := c.getFileList("")
+	assert.Equal(t, []string{"docs/a.txt"}, files)
+	assert.Equal(t, lists+1, fb.lists)
+	assert.True(t, manifestFresh(fb, c.keys))
+}
+
+func TestManifestRebuildOnlyWhenChanged(t *testing.T) {
+	fb := newFakeBucket()
+	c := newManifestClient(fb)
+	uploadThroughClient(t, c, "docs/a.txt", []byte("some text"))
+	mark, _ := markManifestStale(fb)
+
+	// two sessions find the manifest stale, the second one finds the
+	// manifest the first one rebuilt
+	first, second := newManifestClient(fb), newManifestClient(fb)
+	second.loadManifest()
+	assert.Nil(t, second.manifest)
+
+	_, err := first.getFileList("")
+	assert.Nil(t, err)
+	assert.True(t, manifestFresh(fb, c.keys))
+	uploads := fb.uploads
+
+	files, err := second.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"docs/a.txt"}, files)
+	assert.Equal(t, uploads, fb.uploads)
+	assert.Equal(t, mark, readManifestMark(fb))
+}
+
+func TestManifestConcurrentSessions(t *testing.T) {
+	fb := newFakeBucket()
+	c := newManifestClient(fb)
+	uploadThroughClient(t, c, "docs/a.txt", []byte("some text"))
+
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-manifest")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("uploaded by a write-only client")
+	localFile.Close()
+
+	// a write-only upload made after the manifest was read is kept by the
+	// next change of the session
+	id, _ := c.keys.Identity()
+	assert.Nil(t, uploadToRecipients(fb, []*simplecrypto.Recipient{id.Recipient()}, localFile.Name(), "camera/photo.jpg"))
+	uploadThroughClient(t, c, "docs/b.txt", []byte("more text"))
+	assert.True(t, manifestFresh(fb, c.keys))
+
+	// as are the changes of two sessions made at the same time
+	first, second := newManifestClient(fb), newManifestClient(fb)
+	_, err := first.listFiles()
+	assert.Nil(t, err)
+	assert.Nil(t, first.beginManifestUpdate())
+	uploadThroughClient(t, second, "docs/c.txt", []byte("from the second session"))
+	uploadThroughClient(t, first, "docs/d.txt", []byte("from the first session"))
+	assert.True(t, manifestFresh(fb, c.keys))
+
+	lists := fb.lists
+	c = newManifestClient(fb)
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"camera/photo.jpg", "docs/a.txt", "docs/b.txt", "docs/c.txt", "docs/d.txt"}, files)
+	assert.Equal(t, lists, fb.lists)
+
+	// the rebuilt manifest keeps what the sessions knew about their files
+	m, _ := readManifest(fb, c.keys)
+	assert.Equal(t, int64(len("from the first session")), m.Files["docs/d.txt"].Size)
+	assert.Equal(t, int64(len("from the second session")), m.Files["docs/c.txt"].Size)
+}
+
+// interleavedBucket runs beforeWrite right before the next write of the
+// manifest, once the session writing it already checked it was up to date.
+type interleavedBucket struct {
+	*fakeBucket
+	beforeWrite func()
+}
+
+func (ib *interleavedBucket) UploadIfVersion(r io.Reader, name, version string) (string, error) {
+	if f := ib.beforeWrite; f != nil && name == VAULT_MANIFEST_FILE {
+		ib.beforeWrite = nil
+		f()
+	}
+	return ib.fakeBucket.UploadIfVersion(r, name, version)
+}
+
+func TestManifestInterleavedCommits(t *testing.T) {
+	fb := newFakeBucket()
+	uploadThroughClient(t, newManifestClient(fb), "docs/a.txt", []byte("some text"))
+
+	// the second session commits while the first one is writing the
+	// manifest it read, the first one finds out and rebuilds it instead of
+	// writing over the file of the second one
+	ib := &interleavedBucket{fakeBucket: fb}
+	keys := testKeys()
+	first, second := newClient(&keys, ib), newManifestClient(fb)
+	first.useManifest = true
+	_, err := second.listFiles()
+	assert.Nil(t, err)
+
+	ib.beforeWrite = func() {
+		uploadThroughClient(t, second, "docs/c.txt", []byte("from the second session"))
+	}
+	uploadThroughClient(t, first, "docs/b.txt", []byte("from the first session"))
+	assert.Nil(t, ib.beforeWrite)
+	assert.True(t, manifestFresh(fb, first.keys))
+
+	m, err := readManifest(fb, first.keys)
+	assert.Nil(t, err)
+	assert.Len(t, m.Files, 3)
+	assert.Equal(t, int64(len("from the first session")), m.Files["docs/b.txt"].Size)
+	assert.Equal(t, int64(len("from the second session")), m.Files["docs/c.txt"].Size)
+
+	// a manifest replaced after it was read is never overwritten
+	stale, version, err := readManifestVersion(fb, first.keys)
+	assert.Nil(t, err)
+	assert.Nil(t, writeManifest(fb, first.keys, m))
+	assert.NotEqual(t, version, m.version)
+	err = writeManifest(fb, first.keys, stale)
+	assert.EqualError(t, err, errPreconditionFailed)
+}
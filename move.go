@@ -11,36 +11,44 @@ import (
 )
 
 func (c *client) doMoveObject(src, dst string) error {
-	objects, err := c.bucket.List()
+	decToEncPaths, err := c.listFiles()
 
 	if err != nil {
-		return errors.New("failed getting objects: " + err.Error())
+		return err
 	}
 
-	if len(objects) == 0 {
+	if len(decToEncPaths) == 0 {
 		return errors.New("no objects exist remotely, nothing to move")
 	}
 
-	decToEncPaths := getDecryptedToEncryptedFileMapping(objects, c.keys)
+	// the names of the moved files are listed again when needed
+	defer c.bcache.empty()
+	defer c.endManifestUpdate()
+
 	isGlob := strings.Contains(src, "*")
 
 	for plaintextFilename := range decToEncPaths {
 		var finalDst string
 
 		// this is a single file rename
-		if !strings.HasSuffix(src, "/") && !strings.HasSuffix(dst, "/") {
+		if !isGlob && !strings.HasSuffix(src, "/") && !strings.HasSuffix(dst, "/") {
+			if plaintextFilename != src {
+				continue
+			}
+
 			encryptedFilename := decToEncPaths[plaintextFilename]
 			finalDstEncrypted := encryptFilePath(dst, c.keys)
 
-			log.WithFields(logrus.Fields{"original": plaintextFilename, "new location": finalDst}).Debug("file moved")
-			return c.bucket.Move(encryptedFilename, finalDstEncrypted)
+			log.WithFields(logrus.Fields{"original": plaintextFilename, "new location": dst}).Debug("file moved")
+			return c.moveObject(plaintextFilename, dst, encryptedFilename, finalDstEncrypted)
 		}
 
 		// this is a directory rename
 		if strings.HasSuffix(src, "/") && strings.HasSuffix(dst, "/") && strings.HasPrefix(plaintextFilename, src) {
 			encryptedFilename := decToEncPaths[plaintextFilename]
-			finalDstEncrypted := encryptFilePath(filepath.Clean(filepath.Join(dst, plaintextFilename)), c.keys)
-			if err := c.bucket.Move(encryptedFilename, finalDstEncrypted); err != nil {
+			finalDst = filepath.Clean(filepath.Join(dst, plaintextFilename))
+			finalDstEncrypted := encryptFilePath(finalDst, c.keys)
+			if err := c.moveObject(plaintextFilename, finalDst, encryptedFilename, finalDstEncrypted); err != nil {
 				return err
 			}
 			continue
@@ -59,12 +67,28 @@ func (c *client) doMoveObject(src, dst string) error {
 			}
 
 			finalDstEncrypted := encryptFilePath(finalDst, c.keys)
-			if err := c.bucket.Move(encryptedFilename, finalDstEncrypted); err != nil {
+			if err := c.moveObject(plaintextFilename, finalDst, encryptedFilename, finalDstEncrypted); err != nil {
 				return err
 			}
 			log.WithFields(logrus.Fields{"original": plaintextFilename, "new location": finalDst}).Debug("file moved")
 		}
 	}
 
+	if !isGlob && !strings.HasSuffix(src, "/") && !strings.HasSuffix(dst, "/") {
+		return errors.New(fileNotFoundRemotelyError)
+	}
+	return nil
+}
+
+// moveObject moves the object of a file and records it in the manifest.
+func (c *client) moveObject(src, dst, encryptedSrc, encryptedDst string) error {
+	if err := c.beginManifestUpdate(); err != nil {
+		return err
+	}
+
+	if err := c.bucket.Move(encryptedSrc, encryptedDst); err != nil {
+		return err
+	}
+	c.manifestMove(src, dst, encryptedDst)
 	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"testing"
@@ -10,7 +11,7 @@ import (
 
 func TestDoMove(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	//TODO: add error tests
@@ -61,7 +62,7 @@ func TestDoMove(t *testing.T) {
 
 func TestMovePartialDirectoryWithoutGlob(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	err := c.processUpload("testdata/", "")
@@ -96,7 +97,7 @@ func TestMovePartialDirectoryWithoutGlob(t *testing.T) {
 
 func TestMovePartialDirectoryWithGlob(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	err := c.processUpload("testdata/", "")
@@ -131,7 +132,7 @@ func TestMovePartialDirectoryWithGlob(t *testing.T) {
 
 func TestMoveInEmptyBucket(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	err := c.doMoveObject("12345/*", "test/")
@@ -152,14 +153,14 @@ func TestMoveOfNonExistingFile(t *testing.T) {
 
 func TestMoveFailGettingObjects(t *testing.T) {
 	bs, keys := brokenSetupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	err := c.doMoveObject("12345/*", "test/")
 	assert.Error(t, err)
 }
 
 func TestTransativeMove(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 	c.doMoveObject("12345/*", "test/")
 
@@ -216,3 +217,40 @@ func TestTransativeMove(t *testing.T) {
 		cleanUp(c)
 	}
 }
+
+func TestMoveFails(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+
+	err := c.processUpload("testdata/nested_3/", "")
+	assert.Nil(t, err)
+
+	fb := bs.(*fakeBucket)
+	fb.moveErr = errors.New(errFakeInjected)
+
+	err = c.doMoveObject("testdata/nested_3/*", "dst/")
+	assert.Equal(t, fb.moveErr, err)
+
+	filesInBucket, _ := c.getFileList("")
+	assert.Equal(t, []string{
+		"testdata/nested_3/testdata1",
+		"testdata/nested_3/testdata2",
+		"testdata/nested_3/testdata3",
+		"testdata/nested_3/testdata4"}, filesInBucket)
+}
+
+func TestMoveSingleFile(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	uploadContent(c, "docs/a.txt", []byte("a"))
+	uploadContent(c, "docs/b.txt", []byte("b"))
+	uploadContent(c, "docs/c.txt", []byte("c"))
+
+	assert.Nil(t, c.doMoveObject("docs/b.txt", "archive/b.txt"))
+	assert.Equal(t, errors.New(fileNotFoundRemotelyError), c.doMoveObject("docs/missing.txt", "archive/missing.txt"))
+
+	filesInBucket, _ := c.getFileList("")
+	assert.Equal(t, []string{"archive/b.txt", "docs/a.txt", "docs/c.txt"}, filesInBucket)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+)
+
+// nameDecrypter decrypts object names, each encrypted directory only once:
+// files uploaded to the same directory share its encrypted path, so the
+// directories holding thousands of files are decrypted for the first one.
+type nameDecrypter struct {
+	keys *simplecrypto.Keys
+
+	mu       sync.RWMutex
+	segments map[string]string
+}
+
+func newNameDecrypter(keys *simplecrypto.Keys) *nameDecrypter {
+	return &nameDecrypter{keys: keys, segments: make(map[string]string)}
+}
+
+// decryptSegment decrypts a segment of a name, remembering the decrypted
+// directories; the names of the files are not shared, so they are not kept.
+func (nd *nameDecrypter) decryptSegment(segment string, isDir bool) (string, error) {
+	if !isDir {
+		return simplecrypto.DecryptText(segment, nd.keys.EncryptionKey)
+	}
+
+	nd.mu.RLock()
+	plaintext, ok := nd.segments[segment]
+	nd.mu.RUnlock()
+	if ok {
+		return plaintext, nil
+	}
+
+	plaintext, err := simplecrypto.DecryptText(segment, nd.keys.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	nd.mu.Lock()
+	nd.segments[segment] = plaintext
+	nd.mu.Unlock()
+	return plaintext, nil
+}
+
+func (nd *nameDecrypter) decryptPath(encryptedPath string) (string, error) {
+	if strings.HasPrefix(encryptedPath, sealedNamePrefix) {
+		return openSealedPath(encryptedPath, nd.keys)
+	}
+
+	splitPath := strings.Split(encryptedPath, "/")
+	decryptedPath := []string{}
+
+	for i, e := range splitPath {
+		if e == PASSWORD_CHECK_FILE {
+			continue
+		} else if t, err := nd.decryptSegment(e, i < len(splitPath)-1); err == nil {
+			decryptedPath = append(decryptedPath, t)
+		} else {
+			return "", errors.New("failed to decrypt file: " + encryptedPath)
+		}
+	}
+
+	return strings.Join(decryptedPath, "/"), nil
+}
+
+// decryptPaths decrypts object names on every CPU, returning the decrypted
+// names and errors in the order of encryptedPaths.
+func (nd *nameDecrypter) decryptPaths(encryptedPaths []string) ([]string, []error) {
+	paths := make([]string, len(encryptedPaths))
+	errs := make([]error, len(encryptedPaths))
+
+	workers := runtime.NumCPU()
+	if workers > len(encryptedPaths) {
+		workers = len(encryptedPaths)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(encryptedPaths); i += workers {
+				paths[i], errs[i] = nd.decryptPath(encryptedPaths[i])
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	return paths, errs
+}
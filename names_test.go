@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// syntheticNames encrypts dirs*subdirs*files names the way uploads do, the
+// files of a directory sharing its encrypted path.
+func syntheticNames(keys *simplecrypto.Keys, dirs, subdirs, files int) (encrypted, plaintext []string) {
+	for d := 0; d < dirs; d++ {
+		dir := fmt.Sprintf("dir%d", d)
+		encryptedDir, _ := simplecrypto.EncryptText(dir, keys.EncryptionKey)
+
+		for s := 0; s < subdirs; s++ {
+			subdir := fmt.Sprintf("sub%d", s)
+			encryptedSubdir, _ := simplecrypto.EncryptText(subdir, keys.EncryptionKey)
+
+			for f := 0; f < files; f++ {
+				file := fmt.Sprintf("file%d.txt", f)
+				encryptedFile, _ := simplecrypto.EncryptText(file, keys.EncryptionKey)
+
+				encrypted = append(encrypted, encryptedDir+"/"+encryptedSubdir+"/"+encryptedFile)
+				plaintext = append(plaintext, dir+"/"+subdir+"/"+file)
+			}
+		}
+	}
+	return encrypted, plaintext
+}
+
+func TestNameDecrypter(t *testing.T) {
+	keys := testKeys()
+	encrypted, plaintext := syntheticNames(&keys, 3, 4, 50)
+	encrypted = append(encrypted, "not-encrypted/name")
+
+	nd := newNameDecrypter(&keys)
+	paths, errs := nd.decryptPaths(encrypted)
+	assert.Equal(t, plaintext, paths[:len(plaintext)])
+	for _, err := range errs[:len(plaintext)] {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, "failed to decrypt file: not-encrypted/name", errs[len(plaintext)].Error())
+
+	// the shared directories are decrypted once
+	assert.Len(t, nd.segments, 3+3*4)
+
+	for i, e := range encrypted[:len(plaintext)] {
+		decrypted, err := decryptFilePath(e, &keys)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext[i], decrypted)
+	}
+
+	paths, errs = newNameDecrypter(&keys).decryptPaths(nil)
+	assert.Empty(t, paths)
+	assert.Empty(t, errs)
+}
+
+var (
+	benchmarkNamesOnce sync.Once
+	benchmarkKeys      simplecrypto.Keys
+	benchmarkNames     []string
+)
+
+// benchmarkNameSet returns 100k names in 100 directories of 10 subdirectories.
+func benchmarkNameSet() (*simplecrypto.Keys, []string) {
+	benchmarkNamesOnce.Do(func() {
+		benchmarkKeys = testKeys()
+		benchmarkNames, _ = syntheticNames(&benchmarkKeys, 100, 10, 100)
+	})
+	return &benchmarkKeys, benchmarkNames
+}
+
+// BenchmarkDecryptNamesSequential decrypts every segment of every name one
+// after another, as listings did before names were decrypted in parallel.
+func BenchmarkDecryptNamesSequential(b *testing.B) {
+	keys, names := benchmarkNameSet()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for _, name := range names {
+			for _, segment := range strings.Split(name, "/") {
+				simplecrypto.DecryptText(segment, keys.EncryptionKey)
+			}
+		}
+	}
+}
+
+func BenchmarkDecryptNamesParallel(b *testing.B) {
+	keys, names := benchmarkNameSet()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		newNameDecrypter(keys).decryptPaths(names)
+	}
+}
+
+func BenchmarkRefreshNameCache(b *testing.B) {
+	keys, names := benchmarkNameSet()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		bc := bucketCache{}
+		bc.refresh(names, keys)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+)
+
+const (
+	errOfflineUsage     = "invalid offline command; try using 'encrypt-object <file> <output>', 'decrypt-object <file> <output>', 'encrypt-name <path>' or 'decrypt-name <encrypted path>'"
+	errOutputFileExists = "the output file already exists"
+)
+
+// isOfflineCommand is true for the commands working on local files, which
+// never touch the bucket.
+func isOfflineCommand(command string) bool {
+	switch command {
+	case "encrypt-object", "decrypt-object", "encrypt-name", "decrypt-name":
+		return true
+	}
+	return false
+}
+
+// offlineKeys unlocks the keys of a vault with a local copy of its header
+// object, or derives them from the legacy salt when there is none, in which
+// case the password can not be verified before decrypting.
+func offlineKeys(headerFile string, password []byte) (*simplecrypto.Keys, error) {
+	if headerFile == "" {
+		log.Warn("no vault header given, using the legacy salt of vaults created before vault headers")
+		return legacyKDFParams().DeriveKeys(password)
+	}
+
+	data, err := ioutil.ReadFile(headerFile)
+	if err != nil {
+		return nil, err
+	}
+
+	vh, err := parseVaultHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	return vh.unlock(password)
+}
+
+// transformLocalFile writes what transform produces from the input file to
+// a temporary file next to output, which is only moved in place once
+// transform succeeded, so no unauthenticated plaintext is left behind.
+func transformLocalFile(input, output string, transform func(io.Reader) (io.Reader, error)) error {
+	if _, err := os.Stat(output); err == nil {
+		return errors.New(errOutputFileExists)
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := transform(in)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(output), ".offline-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+// runOfflineCommand runs an offline command, writing the names it encrypts
+// or decrypts to w.
+func runOfflineCommand(args []string, keys *simplecrypto.Keys, w io.Writer) error {
+	switch {
+	case len(args) == 3 && args[0] == "encrypt-object":
+		return transformLocalFile(args[1], args[2], func(r io.Reader) (io.Reader, error) {
+			return simplecrypto.NewEncryptReader(r, keys)
+		})
+	case len(args) == 3 && args[0] == "decrypt-object":
+		return transformLocalFile(args[1], args[2], func(r io.Reader) (io.Reader, error) {
+			return simplecrypto.NewDecryptReader(r, keys), nil
+		})
+	case len(args) == 2 && args[0] == "encrypt-name":
+		_, err := fmt.Fprintln(w, encryptFilePath(args[1], keys))
+		return err
+	case len(args) == 2 && args[0] == "decrypt-name":
+		plaintextPath, err := decryptFilePath(args[1], keys)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, plaintextPath)
+		return err
+	}
+	return errors.New(errOfflineUsage)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineKeys(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-offline")
+	defer os.RemoveAll(dir)
+
+	headerFile := filepath.Join(dir, VAULT_HEADER_FILE)
+	ioutil.WriteFile(headerFile, fb.objects[VAULT_HEADER_FILE], 0600)
+
+	keys, err := offlineKeys(headerFile, []byte("password"))
+	assert.Nil(t, err)
+	assert.Equal(t, c.keys, keys)
+
+	_, err = offlineKeys(headerFile, []byte("wrong"))
+	assert.Equal(t, errors.New(errWrongPassword), err)
+
+	_, err = offlineKeys(filepath.Join(dir, "404"), []byte("password"))
+	assert.Error(t, err)
+}
+
+func TestOfflineKeysLegacy(t *testing.T) {
+	_, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	keys, err := offlineKeys("", []byte("foobar"))
+	assert.Nil(t, err)
+	assert.Equal(t, legacyKeys, keys)
+}
+
+func TestRunOfflineCommand(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-offline")
+	defer os.RemoveAll(dir)
+
+	// an object pulled from the bucket by another tool
+	data := randomByte(100000)
+	uploadContent(c, "backup/data.bin", data)
+
+	var encryptedName string
+	for name, object := range fb.objects {
+		if name != VAULT_HEADER_FILE {
+			encryptedName = name
+			ioutil.WriteFile(filepath.Join(dir, "object"), object, 0600)
+		}
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, runOfflineCommand([]string{"decrypt-name", encryptedName}, c.keys, &out))
+	assert.Equal(t, "backup/data.bin\n", out.String())
+
+	assert.Nil(t, runOfflineCommand([]string{"decrypt-object", filepath.Join(dir, "object"), filepath.Join(dir, "data.bin")}, c.keys, &out))
+	decrypted, _ := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	assert.Equal(t, data, decrypted)
+
+	// the output is never overwritten
+	assert.Equal(t, errors.New(errOutputFileExists), runOfflineCommand([]string{"decrypt-object", filepath.Join(dir, "object"), filepath.Join(dir, "data.bin")}, c.keys, &out))
+
+	// encrypt-object and encrypt-name produce objects the vault can read
+	assert.Nil(t, runOfflineCommand([]string{"encrypt-object", filepath.Join(dir, "data.bin"), filepath.Join(dir, "object2")}, c.keys, &out))
+	out.Reset()
+	assert.Nil(t, runOfflineCommand([]string{"encrypt-name", "restored/data.bin"}, c.keys, &out))
+
+	object2, _ := ioutil.ReadFile(filepath.Join(dir, "object2"))
+	assert.Nil(t, fb.Upload(bytes.NewReader(object2), strings.TrimSpace(out.String())))
+
+	out.Reset()
+	assert.Nil(t, c.doCat("restored/data.bin", "", &out))
+	assert.Equal(t, data, out.Bytes())
+
+	invalidTests := [][]string{
+		{"decrypt-name"},
+		{"decrypt-object", "a"},
+		{"encrypt-object", "a", "b", "c"},
+		{"unknown", "a"},
+	}
+
+	for _, args := range invalidTests {
+		assert.Equal(t, errors.New(errOfflineUsage), runOfflineCommand(args, c.keys, &out))
+	}
+}
+
+func TestDecryptObjectTampered(t *testing.T) {
+	_, c, done := setupRecipientVault(t)
+	defer done()
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-offline")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "plain"), randomByte(1000), 0600)
+	assert.Nil(t, runOfflineCommand([]string{"encrypt-object", filepath.Join(dir, "plain"), filepath.Join(dir, "object")}, c.keys, ioutil.Discard))
+
+	object, _ := ioutil.ReadFile(filepath.Join(dir, "object"))
+	object[len(object)/2] ^= 0xFF
+	ioutil.WriteFile(filepath.Join(dir, "object"), object, 0600)
+
+	assert.Error(t, runOfflineCommand([]string{"decrypt-object", filepath.Join(dir, "object"), filepath.Join(dir, "out")}, c.keys, ioutil.Discard))
+
+	// neither the output nor the temporary file are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+	_, err := os.Stat(filepath.Join(dir, "out"))
+	assert.True(t, os.IsNotExist(err))
+}
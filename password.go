@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// passwordEnv holds the password itself, passwordFileEnv the path of a
+	// file holding it.
+	passwordEnv     = "GCLOUD_CRYPTO_PASSWORD"
+	passwordFileEnv = "GCLOUD_CRYPTO_PASSWORD_FILE"
+
+	errNoPasswordSource = "no terminal to read the password from, use -keyfile, -password-fd, " + passwordEnv + ", " + passwordFileEnv + " or 'password_command' in the config file"
+)
+
+// passwordProvider is a source of the secret unlocking the vault.
+type passwordProvider interface {
+	password() ([]byte, error)
+}
+
+// keyFileProvider reads a keyfile, used as it is.
+type keyFileProvider struct {
+	path string
+}
+
+func (p keyFileProvider) password() ([]byte, error) {
+	return readKeyFile(p.path)
+}
+
+// staticProvider returns a password known in advance, like the one set in
+// the environment.
+type staticProvider struct {
+	value string
+}
+
+func (p staticProvider) password() ([]byte, error) {
+	return checkPassword([]byte(p.value))
+}
+
+// readerProvider reads the password from r, up to the end of the first line.
+type readerProvider struct {
+	r io.Reader
+}
+
+func (p readerProvider) password() ([]byte, error) {
+	data, err := ioutil.ReadAll(p.r)
+	if err != nil {
+		return nil, err
+	}
+	return checkPassword(firstLine(data))
+}
+
+// fdProvider reads the password from a file descriptor once, and returns
+// the same password when asked again, like by the commands checking the
+// current password.
+type fdProvider struct {
+	fd int
+}
+
+var fdPasswords = map[int][]byte{}
+
+func (p fdProvider) password() ([]byte, error) {
+	if password, ok := fdPasswords[p.fd]; ok {
+		return password, nil
+	}
+
+	password, err := readerProvider{os.NewFile(uintptr(p.fd), "password-fd")}.password()
+	if err != nil {
+		return nil, err
+	}
+	fdPasswords[p.fd] = password
+	return password, nil
+}
+
+// passwordFileProvider reads the password from the first line of a file.
+type passwordFileProvider struct {
+	path string
+}
+
+func (p passwordFileProvider) password() ([]byte, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return checkPassword(firstLine(data))
+}
+
+// commandProvider runs a command through the shell, like 'pass show vault',
+// and reads the password from the first line of its output.
+type commandProvider struct {
+	command string
+}
+
+func (p commandProvider) password() ([]byte, error) {
+	cmd := exec.Command("sh", "-c", p.command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("password command failed: %s", err)
+	}
+	return checkPassword(firstLine(output))
+}
+
+// terminalProvider asks for the password on the terminal fd.
+type terminalProvider struct {
+	fd     int
+	prompt string
+}
+
+func (p terminalProvider) password() ([]byte, error) {
+	if !terminal.IsTerminal(p.fd) {
+		return nil, errors.New(errNoPasswordSource)
+	}
+
+	fmt.Print(p.prompt)
+	password, err := terminal.ReadPassword(p.fd)
+
+	fmt.Println()
+	fmt.Println()
+
+	return password, err
+}
+
+// passwordSources holds the settings selecting where the password comes
+// from, passwordFD is negative when -password-fd is not given.
+type passwordSources struct {
+	keyFile         string
+	passwordFD      int
+	password        string
+	passwordFile    string
+	passwordCommand string
+	terminalFD      int
+}
+
+// provider returns the provider of the first source set, in the order of
+// the fields of passwordSources, the terminal being the last one.
+func (s passwordSources) provider() passwordProvider {
+	switch {
+	case s.keyFile != "":
+		return keyFileProvider{s.keyFile}
+	case s.passwordFD >= 0:
+		return fdProvider{s.passwordFD}
+	case s.password != "":
+		return staticProvider{s.password}
+	case s.passwordFile != "":
+		return passwordFileProvider{s.passwordFile}
+	case s.passwordCommand != "":
+		return commandProvider{s.passwordCommand}
+	}
+	return terminalProvider{s.terminalFD, "Password: "}
+}
+
+// firstLine returns data up to its first line break.
+func firstLine(data []byte) []byte {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return data[:i]
+	}
+	return data
+}
+
+func checkPassword(password []byte) ([]byte, error) {
+	if len(password) == 0 {
+		return nil, errors.New(errEmptyPassword)
+	}
+	return password, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordProviders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-password")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("from a file\nsecond line\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "empty"), []byte("\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "keyfile"), []byte("key\n"), 0600)
+
+	pipeReader, pipeWriter, _ := os.Pipe()
+	defer pipeReader.Close()
+
+	providerTests := []struct {
+		provider         passwordProvider
+		expectedPassword []byte
+		expectedError    error
+	}{
+		{keyFileProvider{filepath.Join(dir, "keyfile")}, []byte("key\n"), nil},
+		{staticProvider{"from the environment"}, []byte("from the environment"), nil},
+		{staticProvider{""}, nil, errors.New(errEmptyPassword)},
+		{readerProvider{strings.NewReader("from a descriptor\r\n")}, []byte("from a descriptor"), nil},
+		{passwordFileProvider{filepath.Join(dir, "password")}, []byte("from a file"), nil},
+		{passwordFileProvider{filepath.Join(dir, "empty")}, nil, errors.New(errEmptyPassword)},
+		{commandProvider{"echo from a command"}, []byte("from a command"), nil},
+		{commandProvider{"exit 3"}, nil, errors.New("password command failed: exit status 3")},
+		{terminalProvider{int(pipeWriter.Fd()), "Password: "}, nil, errors.New(errNoPasswordSource)},
+	}
+
+	for _, e := range providerTests {
+		password, err := e.provider.password()
+		assert.Equal(t, e.expectedError, err, "%#v", e.provider)
+		assert.Equal(t, e.expectedPassword, password, "%#v", e.provider)
+	}
+
+	pipeWriter.Close()
+}
+
+func TestPasswordFromFD(t *testing.T) {
+	r, w, _ := os.Pipe()
+	w.WriteString("through a pipe\n")
+	w.Close()
+
+	password, err := passwordSources{passwordFD: int(r.Fd())}.provider().password()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("through a pipe"), password)
+
+	// the commands checking the current password get it again
+	password, err = passwordSources{passwordFD: int(r.Fd())}.provider().password()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("through a pipe"), password)
+}
+
+func TestPasswordSourcesProvider(t *testing.T) {
+	providerTests := []struct {
+		sources  passwordSources
+		expected passwordProvider
+	}{
+		{passwordSources{keyFile: "key", passwordFD: -1, password: "p", passwordFile: "f", passwordCommand: "c"}, keyFileProvider{"key"}},
+		{passwordSources{passwordFD: -1, password: "p", passwordFile: "f", passwordCommand: "c"}, staticProvider{"p"}},
+		{passwordSources{passwordFD: -1, passwordFile: "f", passwordCommand: "c"}, passwordFileProvider{"f"}},
+		{passwordSources{passwordFD: -1, passwordCommand: "c"}, commandProvider{"c"}},
+		{passwordSources{passwordFD: -1, terminalFD: 5}, terminalProvider{5, "Password: "}},
+	}
+
+	for _, e := range providerTests {
+		assert.Equal(t, e.expected, e.sources.provider())
+	}
+
+	assert.Equal(t, fdProvider{0}, passwordSources{passwordFD: 0, password: "p"}.provider())
+}
@@ -0,0 +1,67 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// linesInterval is how often the progress of a transfer is printed.
+const linesInterval = 10 * time.Second
+
+// lines prints the progress of transfers as plain lines, for output that
+// is not a terminal: a line every linesInterval, and one once done.
+type lines struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+type linesBar struct {
+	l         *lines
+	task      string
+	name      string
+	lastPrint time.Time
+	stats
+}
+
+// NewLines returns a Reporter printing lines to w.
+func NewLines(w io.Writer) Reporter {
+	return &lines{w: w, now: time.Now}
+}
+
+func (l *lines) Start(task, name string, total int64) Bar {
+	now := l.now()
+	return &linesBar{l: l, task: task, name: name, lastPrint: now, stats: stats{total: total, start: now}}
+}
+
+func (b *linesBar) Add(n int64) {
+	b.done += n
+
+	now := b.l.now()
+	if now.Sub(b.lastPrint) < linesInterval {
+		return
+	}
+	b.lastPrint = now
+
+	if percent := b.percent(); percent >= 0 {
+		b.l.printf("%s %s: %d%%, %s of %s, %s/s, ETA %s\n", b.task, b.name, percent,
+			FormatBytes(b.done), FormatBytes(b.total), FormatBytes(int64(b.rate(now))), formatETA(b.eta(now)))
+	} else {
+		b.l.printf("%s %s: %s, %s/s\n", b.task, b.name, FormatBytes(b.done), FormatBytes(int64(b.rate(now))))
+	}
+}
+
+func (b *linesBar) Done() {
+	now := b.l.now()
+	b.l.printf("%s %s: %s in %s (%s/s)\n", b.task, b.name, FormatBytes(b.done), now.Sub(b.start).Round(time.Second), FormatBytes(int64(b.rate(now))))
+}
+
+// printf prints a whole line at once, the bars of concurrent transfers
+// sharing the writer.
+func (l *lines) printf(format string, a ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, format, a...)
+}
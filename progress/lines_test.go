@@ -0,0 +1,35 @@
+package progress
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLines(t *testing.T) {
+	var out bytes.Buffer
+	clock := &fakeClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := &lines{w: &out, now: clock.now}
+
+	bar := l.Start("Downloading", "a.txt", 4096)
+	clock.advance(time.Second)
+	bar.Add(1024)
+	assert.Empty(t, out.String())
+
+	clock.advance(linesInterval)
+	bar.Add(1024)
+	assert.Equal(t, "Downloading a.txt: 50%, 2.0 KiB of 4.0 KiB, 186 B/s, ETA 11s\n", out.String())
+
+	out.Reset()
+	bar.Add(2048)
+	bar.Done()
+	assert.Equal(t, "Downloading a.txt: 4.0 KiB in 11s (372 B/s)\n", out.String())
+
+	out.Reset()
+	bar = l.Start("Uploading", "b.txt", 0)
+	clock.advance(linesInterval)
+	bar.Add(100)
+	assert.Equal(t, "Uploading b.txt: 100 B, 10 B/s\n", out.String())
+}
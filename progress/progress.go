@@ -3,14 +3,121 @@ package progress
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
+// Reporter follows the progress of transfers, several of which can run at
+// the same time.
+type Reporter interface {
+	// Start begins following the transfer of total bytes of name, total
+	// being 0 or less when unknown.
+	Start(task, name string, total int64) Bar
+}
+
+// Bar is the progress of a single transfer. Add and Done are not called
+// concurrently for the same Bar.
+type Bar interface {
+	// Add counts n more bytes transferred.
+	Add(n int64)
+	// Done ends the transfer.
+	Done()
+}
+
+// Default is the Reporter the transfers report to.
+var Default Reporter = Discard
+
+// Discard is a Reporter showing nothing.
+var Discard Reporter = discard{}
+
+type discard struct{}
+
+func (discard) Start(task, name string, total int64) Bar {
+	return discard{}
+}
+
+func (discard) Add(n int64) {}
+
+func (discard) Done() {}
+
+// stats are the bytes transferred since start, out of total.
+type stats struct {
+	total, done int64
+	start       time.Time
+}
+
+// rate returns the bytes transferred per second.
+func (s *stats) rate(now time.Time) float64 {
+	elapsed := now.Sub(s.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.done) / elapsed
+}
+
+// eta returns the time left, or -1 when it is unknown.
+func (s *stats) eta(now time.Time) time.Duration {
+	rate := s.rate(now)
+	if s.total <= 0 || rate <= 0 {
+		return -1
+	}
+
+	left := s.total - s.done
+	if left < 0 {
+		left = 0
+	}
+	return time.Duration(float64(left)/rate) * time.Second
+}
+
+// percent returns how much of total was transferred, or -1 when total is
+// unknown.
+func (s *stats) percent() int {
+	if s.total <= 0 {
+		return -1
+	}
+
+	percent := int(s.done * 100 / s.total)
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// FormatBytes formats a number of bytes with a binary unit.
+func FormatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len("KMGTPE")-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[unit])
+}
+
+func formatETA(eta time.Duration) string {
+	if eta < 0 {
+		return "--"
+	}
+	return eta.Round(time.Second).String()
+}
+
+// drawBar returns a bar of width characters filled up to percent.
+func drawBar(percent, width int) string {
+	filled := percent * width / 100
+	return strings.Repeat("=", filled) + ">" + strings.Repeat(" ", width-filled)
+}
+
+// DrawProgress draws a single bar, overwriting the current line.
 func DrawProgress(task string, current, total int64) {
-	percent := (float64(current) / float64(total)) * 100
-	progress := strings.Repeat("=", int(percent)/2) + ">"
-	spaces := strings.Repeat(" ", 50-(int(percent)/2))
+	if total <= 0 {
+		fmt.Print(fmt.Sprintf("%s\t%d\r", task, current))
+		return
+	}
 
-	fmt.Print(fmt.Sprintf("%s\t%s\t%d%%\t\t(%d/%d)\r", task, progress+spaces, int(percent), current, total))
+	percent := (float64(current) / float64(total)) * 100
+	fmt.Print(fmt.Sprintf("%s\t%s\t%d%%\t\t(%d/%d)\r", task, drawBar(int(percent), 50), int(percent), current, total))
 
 	if percent == 100 {
 		fmt.Println()
@@ -1,11 +1,74 @@
 package progress
 
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
 func ExampleDrawProgress() {
 	DrawProgress("Test", 10, 100)
 	// Output:Test	=====>                                             	10%		(10/100)
 }
 
-func ExampleDrawProgressTotal() {
+func ExampleDrawProgress_total() {
 	DrawProgress("Test", 100, 100)
 	// Output:Test	==================================================>	100%		(100/100)
 }
+
+func ExampleDrawProgress_unknownTotal() {
+	DrawProgress("Test", 10, 0)
+	// Output:Test	10
+}
+
+// fakeClock is a clock moved forward by the tests.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestStats(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := stats{total: 1000, done: 250, start: start}
+
+	assert.Equal(t, 25, s.percent())
+	assert.Equal(t, float64(0), s.rate(start))
+	assert.Equal(t, time.Duration(-1), s.eta(start))
+	assert.Equal(t, float64(50), s.rate(start.Add(5*time.Second)))
+	assert.Equal(t, 15*time.Second, s.eta(start.Add(5*time.Second)))
+
+	s.total = 0
+	assert.Equal(t, -1, s.percent())
+	assert.Equal(t, time.Duration(-1), s.eta(start.Add(5*time.Second)))
+}
+
+func TestFormatBytes(t *testing.T) {
+	formatTests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+
+	for _, e := range formatTests {
+		assert.Equal(t, e.expected, FormatBytes(e.n))
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	bar := Discard.Start("Uploading", "a.txt", 10)
+	bar.Add(10)
+	bar.Done()
+}
@@ -0,0 +1,154 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// terminalRefresh is how often the bars are redrawn at most.
+	terminalRefresh   = 100 * time.Millisecond
+	terminalBarWidth  = 20
+	terminalNameWidth = 32
+)
+
+// terminal draws a bar per transfer running, followed by the overall
+// progress of the transfers running together, redrawing them in place with
+// ANSI escape sequences. A line is left for every finished transfer.
+type terminal struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+
+	bars     []*terminalBar
+	finished []string
+	// lines is the number of lines drawn last time, redrawn the next
+	lines    int
+	lastDraw time.Time
+
+	// the overall progress of the transfers started since none was running
+	overall          stats
+	files, filesDone int
+}
+
+type terminalBar struct {
+	t    *terminal
+	task string
+	name string
+	stats
+}
+
+// NewTerminal returns a Reporter drawing bars on the terminal w writes to.
+func NewTerminal(w io.Writer) Reporter {
+	return &terminal{w: w, now: time.Now}
+}
+
+func (t *terminal) Start(task, name string, total int64) Bar {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.bars) == 0 {
+		t.overall = stats{start: now}
+		t.files, t.filesDone = 0, 0
+	}
+
+	b := &terminalBar{t: t, task: task, name: name, stats: stats{total: total, start: now}}
+	t.bars = append(t.bars, b)
+	t.files++
+	if total > 0 {
+		t.overall.total += total
+	}
+
+	t.draw(true)
+	return b
+}
+
+func (b *terminalBar) Add(n int64) {
+	b.t.mu.Lock()
+	defer b.t.mu.Unlock()
+
+	b.done += n
+	b.t.overall.done += n
+	b.t.draw(false)
+}
+
+func (b *terminalBar) Done() {
+	t := b.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, bar := range t.bars {
+		if bar == b {
+			t.bars = append(t.bars[:i], t.bars[i+1:]...)
+			break
+		}
+	}
+
+	now := t.now()
+	t.filesDone++
+	t.finished = append(t.finished, fmt.Sprintf("%s %s: %s in %s (%s/s)",
+		b.task, b.name, FormatBytes(b.done), now.Sub(b.start).Round(time.Second), FormatBytes(int64(b.rate(now)))))
+
+	if len(t.bars) == 0 && t.files > 1 {
+		t.finished = append(t.finished, fmt.Sprintf("Total: %d files, %s in %s (%s/s)",
+			t.files, FormatBytes(t.overall.done), now.Sub(t.overall.start).Round(time.Second), FormatBytes(int64(t.overall.rate(now)))))
+	}
+	t.draw(true)
+}
+
+// draw redraws the bars, at most every terminalRefresh unless forced.
+func (t *terminal) draw(force bool) {
+	now := t.now()
+	if !force && now.Sub(t.lastDraw) < terminalRefresh {
+		return
+	}
+	t.lastDraw = now
+
+	lines := t.finished
+	for _, b := range t.bars {
+		lines = append(lines, b.line(now))
+	}
+	if len(t.bars) > 0 && t.files > 1 {
+		lines = append(lines, t.overallLine(now))
+	}
+
+	out := ""
+	if t.lines > 0 {
+		out += fmt.Sprintf("\x1b[%dA", t.lines)
+	}
+	for _, line := range lines {
+		out += "\r\x1b[2K" + line + "\n"
+	}
+	// clear what is left of the lines drawn last time
+	for i := len(lines); i < t.lines; i++ {
+		out += "\r\x1b[2K\n"
+	}
+	if extra := t.lines - len(lines); extra > 0 {
+		out += fmt.Sprintf("\x1b[%dA", extra)
+	}
+
+	fmt.Fprint(t.w, out)
+	t.lines = len(lines) - len(t.finished)
+	t.finished = nil
+}
+
+func (b *terminalBar) line(now time.Time) string {
+	name := b.name
+	if len(name) > terminalNameWidth {
+		name = "..." + name[len(name)-terminalNameWidth+3:]
+	}
+
+	if percent := b.percent(); percent >= 0 {
+		return fmt.Sprintf("%-11s %-*s %s %3d%% %10s/s ETA %s", b.task, terminalNameWidth, name,
+			drawBar(percent, terminalBarWidth), percent, FormatBytes(int64(b.rate(now))), formatETA(b.eta(now)))
+	}
+	return fmt.Sprintf("%-11s %-*s %s %10s/s", b.task, terminalNameWidth, name, FormatBytes(b.done), FormatBytes(int64(b.rate(now))))
+}
+
+func (t *terminal) overallLine(now time.Time) string {
+	return fmt.Sprintf("Total: %d/%d files, %s/%s, %s/s, ETA %s", t.filesDone, t.files,
+		FormatBytes(t.overall.done), FormatBytes(t.overall.total), FormatBytes(int64(t.overall.rate(now))), formatETA(t.overall.eta(now)))
+}
@@ -0,0 +1,94 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// screen replays what the terminal renderer wrote, returning the lines left
+// on the screen.
+func screen(output string) []string {
+	lines := []string{""}
+	row := 0
+
+	for len(output) > 0 {
+		switch {
+		case strings.HasPrefix(output, "\x1b[2K"):
+			lines[row] = ""
+			output = output[len("\x1b[2K"):]
+		case strings.HasPrefix(output, "\x1b["):
+			end := strings.Index(output, "A")
+			n := 0
+			for _, digit := range output[2:end] {
+				n = n*10 + int(digit-'0')
+			}
+			row -= n
+			output = output[end+1:]
+		case output[0] == '\r':
+			output = output[1:]
+		case output[0] == '\n':
+			row++
+			if row == len(lines) {
+				lines = append(lines, "")
+			}
+			output = output[1:]
+		default:
+			lines[row] += output[:1]
+			output = output[1:]
+		}
+	}
+	return lines[:len(lines)-1]
+}
+
+func TestTerminal(t *testing.T) {
+	var out bytes.Buffer
+	clock := &fakeClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	term := &terminal{w: &out, now: clock.now}
+
+	a := term.Start("Uploading", "a.txt", 1000)
+	b := term.Start("Uploading", "b.txt", 0)
+
+	clock.advance(2 * time.Second)
+	a.Add(500)
+	b.Add(100)
+
+	lines := screen(out.String())
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "Uploading   a.txt")
+	assert.Contains(t, lines[0], "==========>            50%")
+	assert.Contains(t, lines[0], "250 B/s ETA 2s")
+	// b was redrawn too soon to show what was added
+	assert.Contains(t, lines[1], "0 B")
+	assert.Equal(t, "Total: 0/2 files, 500 B/1000 B, 250 B/s, ETA 2s", lines[2])
+
+	clock.advance(time.Second)
+	a.Add(500)
+	a.Done()
+
+	lines = screen(out.String())
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "Uploading a.txt: 1000 B in 3s (333 B/s)", lines[0])
+	assert.Contains(t, lines[1], "b.txt")
+	assert.Contains(t, lines[1], "100 B")
+	assert.Contains(t, lines[2], "Total: 1/2 files")
+
+	b.Done()
+	lines = screen(out.String())
+	assert.Equal(t, []string{
+		"Uploading a.txt: 1000 B in 3s (333 B/s)",
+		"Uploading b.txt: 100 B in 3s (33 B/s)",
+		"Total: 2 files, 1.1 KiB in 3s (366 B/s)",
+	}, lines)
+
+	// a single transfer has no total
+	out.Reset()
+	c := term.Start("Downloading", strings.Repeat("x", 40), 10)
+	c.Add(10)
+	c.Done()
+	lines = screen(out.String())
+	assert.Equal(t, []string{"Downloading " + strings.Repeat("x", 40) + ": 10 B in 0s (0 B/s)"}, lines)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// sealedNamePrefix starts the names of the objects uploaded by clients
+	// holding only recipients, it is not part of the base64 alphabet used by
+	// encrypted paths.
+	sealedNamePrefix = "~"
+
+	// vaultRecipientName names the recipient of the vault identity.
+	vaultRecipientName = "vault"
+
+	errRecipientExists        = "a recipient with this name already exists"
+	errRecipientNotFound      = "no recipient with this name"
+	errEmptyRecipientName     = "the recipient name must not be empty"
+	errReservedRecipientName  = "the vault recipient can not be added or removed"
+	errRecipientsTampered     = "the recipients of the vault header failed authentication"
+	errRecipientsNeedHeader   = "this vault has no vault header, run 'migrate' before adding recipients"
+	errWriteOnlyUploadMissing = "-recipient needs a file to upload with -upload"
+	errInvalidSealedPath      = "sealed paths must be relative, without empty, '.' or '..' segments"
+)
+
+// vaultRecipient is a recipient every file uploaded by the vault is also
+// encrypted to, so its identity can decrypt them without the vault keys.
+type vaultRecipient struct {
+	Name      string `json:"name"`
+	Recipient string `json:"recipient"`
+}
+
+// recipientsMAC authenticates the recipients of the header with the vault
+// keys, so that no recipient can be slipped in by someone able to write to
+// the bucket.
+func (vh *vaultHeader) recipientsMAC(keys *simplecrypto.Keys) []byte {
+	data, _ := json.Marshal(vh.Recipients)
+	mac := hmac.New(sha256.New, keys.HMACKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (vh *vaultHeader) findRecipient(name string) int {
+	for i := range vh.Recipients {
+		if vh.Recipients[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// readRecipients returns the vault header, nil for legacy vaults, and the
+// recipients the files of the vault are encrypted to: the vault recipient
+// first, followed by the recipients of the header.
+func (c *client) readRecipients() (*vaultHeader, []*simplecrypto.Recipient, error) {
+	id, err := c.keys.Identity()
+	if err != nil {
+		return nil, nil, err
+	}
+	recipients := []*simplecrypto.Recipient{id.Recipient()}
+
+	vh, err := readVaultHeader(c.bucket, VAULT_HEADER_FILE)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Debug("no vault header, the vault has no other recipient")
+		return nil, recipients, nil
+	}
+
+	if len(vh.Recipients) > 0 && !hmac.Equal(vh.RecipientsMAC, vh.recipientsMAC(c.keys)) {
+		return nil, nil, errors.New(errRecipientsTampered)
+	}
+
+	for _, vr := range vh.Recipients {
+		r, err := simplecrypto.ParseRecipient(vr.Recipient)
+		if err != nil {
+			return nil, nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return vh, recipients, nil
+}
+
+// encryptionRecipients returns the recipients new files are encrypted to,
+// reading them only once for all the uploads of the session.
+func (c *client) encryptionRecipients() ([]*simplecrypto.Recipient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.recipients == nil {
+		_, recipients, err := c.readRecipients()
+		if err != nil {
+			return nil, err
+		}
+		c.recipients = recipients
+	}
+	return c.recipients, nil
+}
+
+// forgetRecipients makes the next upload read the recipients again.
+func (c *client) forgetRecipients() {
+	c.mu.Lock()
+	c.recipients = nil
+	c.mu.Unlock()
+}
+
+// newEncryptReader encrypts src with the vault keys, or to the vault
+// recipients when the vault has more than its own.
+func (c *client) newEncryptReader(src io.Reader) (io.Reader, error) {
+	recipients, err := c.encryptionRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 1 {
+		return simplecrypto.NewEncryptReader(src, c.keys)
+	}
+	return simplecrypto.NewRecipientEncryptReader(src, recipients)
+}
+
+func (c *client) doRecipientAdd(name, recipient string) error {
+	if name == "" {
+		return errors.New(errEmptyRecipientName)
+	} else if name == vaultRecipientName {
+		return errors.New(errReservedRecipientName)
+	}
+
+	if _, err := simplecrypto.ParseRecipient(recipient); err != nil {
+		return err
+	}
+
+	vh, _, err := c.readRecipients()
+	if err != nil {
+		return err
+	} else if vh == nil {
+		return errors.New(errRecipientsNeedHeader)
+	} else if vh.findRecipient(name) >= 0 {
+		return errors.New(errRecipientExists)
+	}
+
+	vh.Recipients = append(vh.Recipients, vaultRecipient{Name: name, Recipient: recipient})
+	vh.RecipientsMAC = vh.recipientsMAC(c.keys)
+	defer c.forgetRecipients()
+	return writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh)
+}
+
+// doRecipientRemove stops encrypting new files to a recipient, the files
+// already encrypted to it can still be decrypted by its identity.
+func (c *client) doRecipientRemove(name string) error {
+	if name == vaultRecipientName {
+		return errors.New(errReservedRecipientName)
+	}
+
+	vh, _, err := c.readRecipients()
+	if err != nil {
+		return err
+	}
+
+	i := -1
+	if vh != nil {
+		i = vh.findRecipient(name)
+	}
+	if i < 0 {
+		return errors.New(errRecipientNotFound)
+	}
+
+	vh.Recipients = append(vh.Recipients[:i], vh.Recipients[i+1:]...)
+	vh.RecipientsMAC = vh.recipientsMAC(c.keys)
+	defer c.forgetRecipients()
+	return writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh)
+}
+
+// doRecipientList writes the name of every recipient, starting with the one
+// of the vault, and the recipient itself to w.
+func (c *client) doRecipientList(w io.Writer) error {
+	vh, recipients, err := c.readRecipients()
+	if err != nil {
+		return err
+	}
+
+	names := []string{vaultRecipientName}
+	if vh != nil {
+		for _, vr := range vh.Recipients {
+			names = append(names, vr.Name)
+		}
+	}
+
+	for i, r := range recipients {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", names[i], r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRecipients parses a comma separated list of recipients.
+func parseRecipients(list string) ([]*simplecrypto.Recipient, error) {
+	var recipients []*simplecrypto.Recipient
+	for _, s := range strings.Split(list, ",") {
+		r, err := simplecrypto.ParseRecipient(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// uploadToRecipients uploads a file encrypted to recipients, without the
+// vault keys, so a write-only client can not read anything back. The name of
+// the object is sealed to the first recipient, which must be the recipient
+// of the vault for the file to be listed. Sealed names are random, so
+// uploading to the same path twice leaves two objects holding it: listings
+// report them, and deleting the file removes both.
+func uploadToRecipients(bucket Bucket, recipients []*simplecrypto.Recipient, localPath, remotePath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	pt := &PassThrough{Reader: file, contentLength: fileStat.Size(), task: "Uploading", name: localPath}
+	defer pt.finish()
+
+	encryptedReader, err := simplecrypto.NewRecipientEncryptReader(pt, recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSealedPath(remotePath); err != nil {
+		return err
+	}
+
+	sealedName, err := simplecrypto.SealName(remotePath, recipients[0])
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Upload(encryptedReader, sealedNamePrefix+sealedName); err != nil {
+		return err
+	}
+
+	// the manifest can only be updated with the vault keys
+	_, err = markManifestStale(bucket)
+	return err
+}
+
+// openSealedPath decrypts the name of an object uploaded by uploadToRecipients.
+func openSealedPath(encryptedPath string, keys *simplecrypto.Keys) (string, error) {
+	id, err := keys.Identity()
+	if err != nil {
+		return "", err
+	}
+
+	plaintextPath, err := simplecrypto.OpenName(strings.TrimPrefix(encryptedPath, sealedNamePrefix), id)
+	if err != nil {
+		return "", errors.New("failed to decrypt file: " + encryptedPath)
+	}
+
+	// anyone holding the recipient can seal a name, which must not lead
+	// the downloads out of their destination
+	if err := checkSealedPath(plaintextPath); err != nil {
+		return "", err
+	}
+	return plaintextPath, nil
+}
+
+// checkSealedPath refuses the paths which are absolute, or have empty, '.'
+// or '..' segments.
+func checkSealedPath(plaintextPath string) error {
+	for _, segment := range strings.Split(plaintextPath, "/") {
+		switch segment {
+		case "", ".", "..":
+			return errors.New(errInvalidSealedPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRecipientVault(t *testing.T) (*fakeBucket, *client, func()) {
+	done := useTestKDFParams()
+
+	fb := newFakeBucket()
+	keys, err := initVault(fb, []byte("password"), "", "", false)
+	assert.Nil(t, err)
+
+	return fb, newClient(keys, fb), done
+}
+
+func TestRecipients(t *testing.T) {
+	_, c, done := setupRecipientVault(t)
+	defer done()
+
+	collaborator, _ := simplecrypto.NewIdentity()
+	vaultID, _ := c.keys.Identity()
+
+	addTests := []struct {
+		name          string
+		recipient     string
+		expectedError error
+	}{
+		{"alice", collaborator.Recipient().String(), nil},
+		{"alice", collaborator.Recipient().String(), errors.New(errRecipientExists)},
+		{"", collaborator.Recipient().String(), errors.New(errEmptyRecipientName)},
+		{vaultRecipientName, collaborator.Recipient().String(), errors.New(errReservedRecipientName)},
+		{"bob", "gcpub1invalid", errors.New("Invalid recipient")},
+	}
+
+	for _, e := range addTests {
+		assert.Equal(t, e.expectedError, c.doRecipientAdd(e.name, e.recipient), e.name)
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, c.doRecipientList(&out))
+	assert.Equal(t, "vault\t"+vaultID.Recipient().String()+"\nalice\t"+collaborator.Recipient().String()+"\n", out.String())
+
+	assert.Equal(t, errors.New(errRecipientNotFound), c.doRecipientRemove("bob"))
+	assert.Equal(t, errors.New(errReservedRecipientName), c.doRecipientRemove(vaultRecipientName))
+	assert.Nil(t, c.doRecipientRemove("alice"))
+
+	out.Reset()
+	assert.Nil(t, c.doRecipientList(&out))
+	assert.Equal(t, "vault\t"+vaultID.Recipient().String()+"\n", out.String())
+}
+
+func TestRecipientsTampered(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	collaborator, _ := simplecrypto.NewIdentity()
+	assert.Nil(t, c.doRecipientAdd("alice", collaborator.Recipient().String()))
+
+	attacker, _ := simplecrypto.NewIdentity()
+	vh, _ := readVaultHeader(fb, VAULT_HEADER_FILE)
+	vh.Recipients = append(vh.Recipients, vaultRecipient{Name: "mallory", Recipient: attacker.Recipient().String()})
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, vh))
+
+	_, err := c.newEncryptReader(strings.NewReader("secret"))
+	assert.Equal(t, errors.New(errRecipientsTampered), err)
+}
+
+func TestUploadToVaultRecipients(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	// without other recipients, files are encrypted with the vault keys
+	uploadContent(c, "a.txt", []byte("some text"))
+
+	collaborator, _ := simplecrypto.NewIdentity()
+	assert.Nil(t, c.doRecipientAdd("alice", collaborator.Recipient().String()))
+
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-recipient")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("more text")
+	localFile.Close()
+
+	assert.Nil(t, c.processUpload(localFile.Name(), "docs"))
+
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	for _, e := range []struct {
+		file            string
+		expected        string
+		expectedVersion byte
+	}{
+		{"a.txt", "some text", 2},
+		{files[1], "more text", 3},
+	} {
+		var out bytes.Buffer
+		assert.Nil(t, c.doCat(e.file, "", &out))
+		assert.Equal(t, e.expected, out.String())
+
+		// version 3 files hold a stanza for the vault and one for alice
+		var data []byte
+		for name, object := range fb.objects {
+			if plaintextPath, _ := decryptFilePath(name, c.keys); plaintextPath == e.file {
+				data = object
+			}
+		}
+		assert.Equal(t, e.expectedVersion, data[7])
+		if e.expectedVersion == 3 {
+			assert.Equal(t, byte(2), data[28])
+		}
+	}
+}
+
+// headerCountingBucket counts the downloads of the vault header.
+type headerCountingBucket struct {
+	*fakeBucket
+	headerDownloads int32
+}
+
+func (hb *headerCountingBucket) Download(name string, offset, length int64) (io.ReadCloser, int64, error) {
+	if name == VAULT_HEADER_FILE {
+		atomic.AddInt32(&hb.headerDownloads, 1)
+	}
+	return hb.fakeBucket.Download(name, offset, length)
+}
+
+func TestUploadReadsRecipientsOnce(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	collaborator, _ := simplecrypto.NewIdentity()
+	assert.Nil(t, c.doRecipientAdd("alice", collaborator.Recipient().String()))
+
+	dir, _ := ioutil.TempDir("", "gcloud-crypto-recipient")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600)
+	}
+
+	hb := &headerCountingBucket{fakeBucket: fb}
+	c.bucket, c.concurrency = hb, 2
+	assert.Nil(t, c.processUpload(dir, "docs"))
+	assert.Equal(t, int32(1), hb.headerDownloads)
+
+	// removing a recipient makes the next upload read them again
+	assert.Nil(t, c.doRecipientRemove("alice"))
+	hb.headerDownloads = 0
+	assert.Nil(t, c.processUpload(filepath.Join(dir, "a.txt"), "more"))
+	assert.Equal(t, int32(1), hb.headerDownloads)
+
+	uploaded := 0
+	for name, object := range fb.objects {
+		if plaintextPath, _ := decryptFilePath(name, c.keys); strings.HasPrefix(plaintextPath, "more/") {
+			assert.Equal(t, byte(2), object[7], "files uploaded after the removal are not encrypted to alice")
+			uploaded++
+		}
+	}
+	assert.Equal(t, 1, uploaded)
+}
+
+func TestUploadToRecipients(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-recipient")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("uploaded by a write-only client")
+	localFile.Close()
+
+	vaultID, _ := c.keys.Identity()
+	otherKeys := simplecrypto.NewRandomKeys()
+	otherID, _ := otherKeys.Identity()
+
+	assert.Equal(t, errors.New(errWriteOnlyUploadMissing), runWriteOnlyUpload(fb, vaultID.Recipient().String(), "", "camera"))
+	assert.Error(t, runWriteOnlyUpload(fb, "gcpub1invalid", localFile.Name(), "camera"))
+
+	recipients := vaultID.Recipient().String() + "," + otherID.Recipient().String()
+	assert.Nil(t, runWriteOnlyUpload(fb, recipients, localFile.Name(), "camera"))
+
+	var sealedName string
+	for name := range fb.objects {
+		if strings.HasPrefix(name, sealedNamePrefix) {
+			sealedName = name
+		}
+	}
+	assert.NotContains(t, sealedName, "camera", "the path of the file should be sealed")
+
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasPrefix(files[0], "camera/gcloud-crypto-recipient"))
+
+	var out bytes.Buffer
+	assert.Nil(t, c.doCat(files[0], "", &out))
+	assert.Equal(t, "uploaded by a write-only client", out.String())
+
+	// the other recipient can not open the name, which is sealed to the vault
+	_, err = decryptFilePath(sealedName, otherKeys)
+	assert.Equal(t, errors.New("failed to decrypt file: "+sealedName), err)
+}
+
+func TestUploadToRecipientsTwice(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-recipient")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("uploaded by a write-only client")
+	localFile.Close()
+
+	vaultID, _ := c.keys.Identity()
+	assert.Nil(t, runWriteOnlyUpload(fb, vaultID.Recipient().String(), localFile.Name(), "camera"))
+	assert.Nil(t, runWriteOnlyUpload(fb, vaultID.Recipient().String(), localFile.Name(), "camera"))
+
+	sealedNames := func() (names []string) {
+		for name := range fb.objects {
+			if strings.HasPrefix(name, sealedNamePrefix) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	assert.Len(t, sealedNames(), 2)
+
+	// the file is listed once, and deleting it removes both objects
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Len(t, c.bcache.duplicates[files[0]], 1)
+
+	assert.Nil(t, c.doDeleteObject(files[0], false))
+	assert.Empty(t, sealedNames())
+	files, _ = c.getFileList("")
+	assert.Empty(t, files)
+}
+
+func TestSealedPathsStayRelative(t *testing.T) {
+	fb, c, done := setupRecipientVault(t)
+	defer done()
+
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-recipient")
+	defer os.Remove(localFile.Name())
+	localFile.WriteString("uploaded by a write-only client")
+	localFile.Close()
+
+	vaultID, _ := c.keys.Identity()
+	recipients := []*simplecrypto.Recipient{vaultID.Recipient()}
+	for _, invalid := range []string{"../../.ssh/authorized_keys", "/etc/passwd", "camera//photo", "./photo", "camera/..", ""} {
+		assert.Equal(t, errors.New(errInvalidSealedPath), uploadToRecipients(fb, recipients, localFile.Name(), invalid), invalid)
+	}
+
+	// nor are such names opened when sealed by another client
+	sealedName, _ := simplecrypto.SealName("../../.ssh/authorized_keys", vaultID.Recipient())
+	_, err := openSealedPath(sealedNamePrefix+sealedName, c.keys)
+	assert.Equal(t, errors.New(errInvalidSealedPath), err)
+
+	assert.Nil(t, uploadToRecipients(fb, recipients, localFile.Name(), "camera/photo.jpg"))
+	fb.Upload(strings.NewReader("forged"), sealedNamePrefix+sealedName)
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"camera/photo.jpg"}, files)
+}
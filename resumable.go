@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	uploadStateVersion = 1
+
+	// defaultResumableThreshold is the size from which files are uploaded
+	// through resumable upload sessions, and objects downloaded to the state
+	// directory before being decrypted.
+	defaultResumableThreshold = 64 * 1024 * 1024
+	// resumableRetries is how many times an upload goes on after failing,
+	// before it is left for the next upload of the file.
+	resumableRetries = 3
+
+	errUploadStateVersion = "unsupported upload state version"
+)
+
+// resumableBucket is implemented by the backends able to go on with an
+// upload interrupted midway, through upload sessions outliving the process.
+type resumableBucket interface {
+	// StartUpload opens a session uploading an object of size bytes.
+	StartUpload(name string, size int64) (string, error)
+	// UploadStatus returns how many bytes of the object the session holds,
+	// and the MD5 of the object once they all are.
+	UploadStatus(session string, size int64) (int64, []byte, error)
+	// ResumeUpload sends the rest of the object, read from r, updating u as
+	// the session stores it, and returns the MD5 of the stored object.
+	ResumeUpload(u *resumableUpload, r io.Reader) ([]byte, error)
+}
+
+// resumableUpload is a session uploading an object of size bytes, holding
+// its first offset bytes, which md5 hashed. committed is called each time
+// the session stores more of them.
+type resumableUpload struct {
+	session   string
+	size      int64
+	offset    int64
+	md5       hash.Hash
+	committed func()
+}
+
+// uploadState is what an interrupted upload needs to go on after a restart:
+// the session, and the header of the encrypted file, from which the same
+// encrypted bytes are produced again. MD5 is the marshaled hash of the first
+// Offset bytes held by the session, SHA256 the hash of the whole file, which
+// must not have changed: encrypting other content with the same header
+// would reuse the nonces of its key.
+type uploadState struct {
+	Version int       `json:"version"`
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Object  string    `json:"object"`
+	Session string    `json:"session"`
+	Header  []byte    `json:"header"`
+	Offset  int64     `json:"offset"`
+	MD5     []byte    `json:"md5"`
+	SHA256  []byte    `json:"sha256"`
+}
+
+// isResumable is true when files of size bytes are uploaded through
+// resumable sessions, and downloaded so that they can be resumed.
+func (c *client) isResumable(size int64) bool {
+	return c.stateDir != "" && c.resumableThreshold > 0 && size >= c.resumableThreshold
+}
+
+// uploadStateFileName names the state of the upload of a local file to a
+// remote path.
+func uploadStateFileName(dir string, keys *simplecrypto.Keys, file, remoteUploadPath string) string {
+	return stateFileName(dir, keys, "gcloud-crypto upload\x00"+file+"\x00"+remoteUploadPath, ".upload")
+}
+
+// loadUploadState returns the state of an interrupted upload of the file,
+// or nil when there is none or the file changed since, even when keeping
+// its size and modification time.
+func (c *client) loadUploadState(stateFile string, fileStat os.FileInfo, sha256Hash []byte) *uploadState {
+	data, err := readStateFile(stateFile, c.keys)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	var state uploadState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil && state.Version != uploadStateVersion {
+		err = errors.New(errUploadStateVersion)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warn("unable to read the state of the interrupted upload, starting over")
+		return nil
+	}
+
+	if state.Size != fileStat.Size() || !state.ModTime.Equal(fileStat.ModTime()) || !bytes.Equal(state.SHA256, sha256Hash) {
+		log.WithFields(logrus.Fields{"file": state.File}).Info("the file changed since its upload was interrupted, starting over")
+		return nil
+	}
+	return &state
+}
+
+// saveUploadState saves the state of an upload, which can only be resumed
+// by this process when that fails.
+func (c *client) saveUploadState(stateFile string, state *uploadState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeStateFile(stateFile, c.keys, data)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warn("unable to save the state of the upload")
+	}
+}
+
+// doResumableUpload uploads a file through a resumable session, going on
+// with the session of an interrupted upload of the file to the same path.
+func (c *client) doResumableUpload(rb resumableBucket, file *os.File, fileStat os.FileInfo, uploadFile, remoteUploadPath string) error {
+	// what the session already holds is not read again by the upload, so the
+	// file is hashed for the manifest first
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	absFile, err := filepath.Abs(uploadFile)
+	if err != nil {
+		return err
+	}
+
+	stateFile := uploadStateFileName(c.stateDir, c.keys, absFile, remoteUploadPath)
+	state := c.loadUploadState(stateFile, fileStat, hash.Sum(nil))
+	if state == nil {
+		state = &uploadState{Version: uploadStateVersion, File: absFile, Size: fileStat.Size(), ModTime: fileStat.ModTime(), SHA256: hash.Sum(nil)}
+	}
+
+	finalEncryptedUploadPath, err := c.reserveUpload(remoteUploadPath, state.Object)
+	if err != nil {
+		// the upload of the file was done, only its state was left behind
+		os.Remove(stateFile)
+		return err
+	}
+	state.Object = finalEncryptedUploadPath
+
+	err = c.resumeUpload(rb, file, uploadFile, stateFile, state)
+	if err == nil || err.Error() == hashMismatchErr || err.Error() == errUploadShortRead {
+		os.Remove(stateFile)
+	} else {
+		log.WithFields(logrus.Fields{"file": uploadFile}).Warn("upload interrupted, uploading the file again resumes it")
+	}
+
+	c.endUpload(remoteUploadPath, finalEncryptedUploadPath, fileStat, hash.Sum(nil), err)
+	return err
+}
+
+// resumeUpload sends the encrypted file to the session of state, starting a
+// new one when there is none or it expired, and checks the MD5 of the stored
+// object. Failed parts are sent again, up to resumableRetries times.
+func (c *client) resumeUpload(rb resumableBucket, file *os.File, uploadFile, stateFile string, state *uploadState) error {
+	if state.Header == nil {
+		encryptedReader, err := c.newEncryptReader(file)
+		if err != nil {
+			return err
+		}
+		state.Header = simplecrypto.EncryptHeader(encryptedReader)
+	}
+
+	re, err := simplecrypto.NewResumableEncrypter(state.Header, c.keys)
+	if err != nil {
+		return err
+	}
+
+	u := &resumableUpload{session: state.Session, size: re.Size(state.Size), offset: state.Offset, md5: md5.New()}
+	if err := u.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.MD5); err != nil {
+		u.offset = 0
+		u.md5.Reset()
+	}
+	u.committed = func() {
+		state.Session, state.Offset = u.session, u.offset
+		state.MD5, _ = u.md5.(encoding.BinaryMarshaler).MarshalBinary()
+		c.saveUploadState(stateFile, state)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if u.session == "" {
+			if u.session, err = rb.StartUpload(state.Object, u.size); err != nil {
+				return err
+			}
+			u.offset = 0
+			u.md5.Reset()
+			u.committed()
+		}
+
+		objectMD5, err := c.sendUpload(rb, re, file, uploadFile, u)
+		if err == nil {
+			if !bytes.Equal(u.md5.Sum(nil), objectMD5) {
+				log.WithFields(logrus.Fields{"expected md5": u.md5.Sum(nil), "actual md5": objectMD5}).Warn("Uploaded file is corrupted")
+				c.bucket.Delete(state.Object)
+				return errors.New(hashMismatchErr)
+			}
+			return nil
+		}
+
+		if attempt == resumableRetries || err.Error() == errUploadShortRead {
+			return err
+		} else if err.Error() == errUploadSessionExpired {
+			u.session = ""
+		}
+		log.WithFields(logrus.Fields{"file": uploadFile, "error": err}).Warn("upload failed, resuming it")
+	}
+}
+
+// sendUpload sends what the session of u does not hold yet, returning the
+// MD5 of the stored object.
+func (c *client) sendUpload(rb resumableBucket, re *simplecrypto.ResumableEncrypter, file *os.File, uploadFile string, u *resumableUpload) ([]byte, error) {
+	offset, objectMD5, err := rb.UploadStatus(u.session, u.size)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < u.offset {
+		u.offset = 0
+		u.md5.Reset()
+	}
+
+	r, err := re.NewReader(file, u.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session holds more than was saved when the process stopped before
+	// saving the state of the upload
+	if _, err := io.CopyN(u.md5, r, offset-u.offset); err != nil {
+		return nil, err
+	}
+	u.offset = offset
+
+	if offset == u.size {
+		return objectMD5, nil
+	}
+
+	pt := &PassThrough{Reader: r, contentLength: u.size - u.offset, task: "Uploading", name: uploadFile}
+	defer pt.finish()
+
+	return rb.ResumeUpload(u, pt)
+}
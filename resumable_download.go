@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	errObjectChanged        = "the object changed during the download"
+	errDownloadHashMismatch = "hash mismatch of downloaded file"
+)
+
+// versionedBucket is implemented by the backends keeping a generation and
+// the hashes of every object, so an interrupted download can go on with the
+// same object, and be checked before it is decrypted.
+type versionedBucket interface {
+	// Stat returns the current generation of an object.
+	Stat(name string) (objectVersion, error)
+	// DownloadGeneration downloads a generation of an object from offset
+	// on, failing with errObjectChanged once it was replaced.
+	DownloadGeneration(name string, generation, offset int64) (io.ReadCloser, error)
+}
+
+// objectVersion is a generation of an object, with its MD5 and CRC32C,
+// either of which may be unknown.
+type objectVersion struct {
+	generation int64
+	size       int64
+	md5        []byte
+	crc32c     []byte
+}
+
+// partialDownloadName names the partial download of a generation of an
+// object, the name of which it does not reveal.
+func partialDownloadName(dir string, keys *simplecrypto.Keys, object string, generation int64) string {
+	return partialDownloadPrefix(dir, keys, object) + strconv.FormatInt(generation, 10) + ".part"
+}
+
+func partialDownloadPrefix(dir string, keys *simplecrypto.Keys, object string) string {
+	return stateFileName(dir, keys, "gcloud-crypto download\x00"+object, "-")
+}
+
+// downloadPartial downloads an object to the state directory, going on with
+// the partial download of the same generation left by a previous attempt,
+// and returns the file once its hashes were checked. Failed downloads are
+// resumed up to resumableRetries times.
+func (c *client) downloadPartial(vb versionedBucket, object, destination string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		partial, version, err := c.fetchPartial(vb, object, destination)
+		if err == nil {
+			if err := checkDownloadHashes(partial, version); err != nil {
+				os.Remove(partial)
+				return "", err
+			}
+			return partial, nil
+		}
+
+		if attempt == resumableRetries {
+			log.WithFields(logrus.Fields{"file": destination}).Warn("download interrupted, downloading the file again resumes it")
+			return "", err
+		}
+		log.WithFields(logrus.Fields{"file": destination, "error": err}).Warn("download failed, resuming it")
+	}
+}
+
+// fetchPartial downloads what the partial download of the current
+// generation of an object lacks, removing the ones of other generations.
+func (c *client) fetchPartial(vb versionedBucket, object, destination string) (string, objectVersion, error) {
+	version, err := vb.Stat(object)
+	if err != nil {
+		return "", version, err
+	}
+
+	partial := partialDownloadName(c.stateDir, c.keys, object, version.generation)
+	others, _ := filepath.Glob(partialDownloadPrefix(c.stateDir, c.keys, object) + "*.part")
+	for _, other := range others {
+		if other != partial {
+			os.Remove(other)
+		}
+	}
+
+	if err := os.MkdirAll(c.stateDir, 0700); err != nil {
+		return "", version, err
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", version, err
+	}
+
+	err = c.appendPartial(f, vb, object, version, destination)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return partial, version, err
+}
+
+// appendPartial appends what the partial download f lacks of a generation
+// of an object.
+func (c *client) appendPartial(f *os.File, vb versionedBucket, object string, version objectVersion, destination string) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := stat.Size()
+	if offset > version.size {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if offset == version.size {
+		return nil
+	}
+
+	download, err := vb.DownloadGeneration(object, version.generation, offset)
+	if err != nil {
+		return err
+	}
+	defer download.Close()
+
+	pt := &PassThrough{Reader: download, contentLength: version.size - offset, task: "Downloading", name: destination}
+	defer pt.finish()
+
+	n, err := io.Copy(f, pt)
+	if err == nil && offset+n < version.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// checkDownloadHashes compares the MD5 and CRC32C of a downloaded object to
+// the known ones.
+func checkDownloadHashes(file string, version objectVersion) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	md5Hash, crc32cHash := md5.New(), crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(md5Hash, crc32cHash), f); err != nil {
+		return err
+	}
+
+	if (version.md5 != nil && !bytes.Equal(md5Hash.Sum(nil), version.md5)) ||
+		(version.crc32c != nil && !bytes.Equal(crc32cHash.Sum(nil), version.crc32c)) {
+		log.WithFields(logrus.Fields{"expected md5": version.md5, "actual md5": md5Hash.Sum(nil),
+			"expected crc32c": version.crc32c, "actual crc32c": crc32cHash.Sum(nil)}).Warn("Downloaded file is corrupted")
+		return errors.New(errDownloadHashMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func partialDownloads(stateDir string) []string {
+	partials, _ := filepath.Glob(filepath.Join(stateDir, "*.part"))
+	return partials
+}
+
+func TestResumableDownload(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	c.stateDir, _ = ioutil.TempDir("", "gcloud-crypto-state")
+	c.resumableThreshold = 1
+	defer os.RemoveAll(c.stateDir)
+
+	data := randomByte(300 * 1024)
+	uploadThroughClient(t, c, "big/file", data)
+	files, _ := c.listFiles()
+	object := files["big/file"]
+
+	tempDir, _ := ioutil.TempDir("", "gcloud-crypto-download")
+	defer os.RemoveAll(tempDir)
+	destination := filepath.Join(tempDir, "file")
+
+	// the downloads failing halfway are resumed right away
+	fb.dropDownloads = 2
+	assert.Nil(t, c.doDownload("big/file", tempDir))
+	downloaded, _ := ioutil.ReadFile(destination)
+	assert.Equal(t, data, downloaded)
+	assert.Len(t, fb.downloadOffsets, 3)
+	assert.True(t, fb.downloadOffsets[1] > 0 && fb.downloadOffsets[2] > fb.downloadOffsets[1], "offsets: %v", fb.downloadOffsets)
+	assert.Empty(t, partialDownloads(c.stateDir))
+	os.Remove(destination)
+
+	// the partial download is kept for the next attempt
+	fb.dropDownloads, fb.downloadOffsets = resumableRetries+1, nil
+	assert.NotNil(t, c.doDownload("big/file", tempDir))
+	assert.Len(t, partialDownloads(c.stateDir), 1)
+	_, err := os.Stat(destination)
+	assert.True(t, os.IsNotExist(err))
+
+	stat, _ := os.Stat(partialDownloads(c.stateDir)[0])
+	fb.downloadOffsets = nil
+	assert.Nil(t, c.doDownload("big/file", tempDir))
+	assert.Equal(t, []int64{stat.Size()}, fb.downloadOffsets)
+	downloaded, _ = ioutil.ReadFile(destination)
+	assert.Equal(t, data, downloaded)
+	assert.Empty(t, partialDownloads(c.stateDir))
+	os.Remove(destination)
+
+	// unless the object was replaced since
+	fb.dropDownloads = resumableRetries + 1
+	assert.NotNil(t, c.doDownload("big/file", tempDir))
+	fb.Lock()
+	fb.store(object, fb.objects[object])
+	fb.Unlock()
+
+	fb.downloadOffsets = nil
+	assert.Nil(t, c.doDownload("big/file", tempDir))
+	assert.Equal(t, []int64{0}, fb.downloadOffsets)
+	downloaded, _ = ioutil.ReadFile(destination)
+	assert.Equal(t, data, downloaded)
+	assert.Empty(t, partialDownloads(c.stateDir))
+	os.Remove(destination)
+
+	// a corrupted download is never decrypted, nor resumed
+	fb.corruptDownload = true
+	err = c.doDownload("big/file", tempDir)
+	assert.Equal(t, errDownloadHashMismatch, err.(*transferError).failures[0].err.Error())
+	assert.Empty(t, partialDownloads(c.stateDir))
+	_, err = os.Stat(destination)
+	assert.True(t, os.IsNotExist(err))
+	fb.corruptDownload = false
+
+	// smaller objects are streamed through decryption
+	c.resumableThreshold = int64(len(fb.objects[object]) + 1)
+	fb.downloadOffsets = nil
+	assert.Nil(t, c.doDownload("big/file", tempDir))
+	assert.Nil(t, fb.downloadOffsets)
+	downloaded, _ = ioutil.ReadFile(destination)
+	assert.Equal(t, data, downloaded)
+}
+
+func TestCheckDownloadHashes(t *testing.T) {
+	fb := newFakeBucket()
+	fb.Upload(strings.NewReader("some data"), "object")
+	version, _ := fb.Stat("object")
+
+	file, _ := ioutil.TempFile("", "gcloud-crypto-hashes")
+	defer os.Remove(file.Name())
+	file.WriteString("some data")
+	file.Close()
+
+	for _, test := range []struct {
+		md5, crc32c []byte
+		valid       bool
+	}{
+		{version.md5, version.crc32c, true},
+		{nil, version.crc32c, true},
+		{version.md5, nil, true},
+		{nil, nil, true},
+		{version.crc32c, nil, false},
+		{nil, version.md5[:4], false},
+	} {
+		err := checkDownloadHashes(file.Name(), objectVersion{md5: test.md5, crc32c: test.crc32c})
+		assert.Equal(t, test.valid, err == nil)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResumableBucket is a fakeBucket uploading through the sessions of a
+// fakeUploadServer.
+type fakeResumableBucket struct {
+	*fakeBucket
+	gcs *bucketService
+}
+
+func (b fakeResumableBucket) StartUpload(name string, size int64) (string, error) {
+	return b.gcs.StartUpload(name, size)
+}
+
+func (b fakeResumableBucket) UploadStatus(session string, size int64) (int64, []byte, error) {
+	return b.gcs.UploadStatus(session, size)
+}
+
+func (b fakeResumableBucket) ResumeUpload(u *resumableUpload, r io.Reader) ([]byte, error) {
+	return b.gcs.ResumeUpload(u, r)
+}
+
+// newResumableClient returns a client uploading every file through the
+// sessions of fs, in parts of 1000 bytes.
+func newResumableClient(fs *fakeUploadServer, stateDir string) *client {
+	keys := testKeys()
+	c := newClient(&keys, fakeResumableBucket{fs.bucket, fs.newBucketService(1000)})
+	c.stateDir, c.resumableThreshold = stateDir, 1
+	return c
+}
+
+func uploadResumable(c *client, localFile, remotePath string) error {
+	if _, err := c.listFiles(); err != nil {
+		return err
+	}
+	return c.prepareAndDoUpload(localFile, remotePath)
+}
+
+// assertUploaded checks that remotePath holds data, and that the state of
+// its upload is gone.
+func assertUploaded(t *testing.T, c *client, stateDir, remotePath string, data []byte) {
+	objects, err := c.listFiles()
+	assert.Nil(t, err)
+
+	encrypted, _ := c.bucket.(fakeResumableBucket).objects[objects[remotePath]]
+	decrypted, err := ioutil.ReadAll(simplecrypto.NewDecryptReader(bytes.NewReader(encrypted), c.keys))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, decrypted), "uploaded file does not match")
+
+	states, _ := filepath.Glob(filepath.Join(stateDir, "*.upload"))
+	assert.Empty(t, states)
+}
+
+func TestDoResumableUpload(t *testing.T) {
+	fs := newFakeUploadServer(newFakeBucket())
+	defer fs.Close()
+	stateDir, _ := ioutil.TempDir("", "gcloud-crypto-state")
+	defer os.RemoveAll(stateDir)
+
+	data := randomByte(200 * 1024)
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-resumable")
+	defer os.Remove(localFile.Name())
+	localFile.Write(data)
+	localFile.Close()
+
+	// failed parts are sent again right away
+	fs.failAfter, fs.failParts, fs.storeLess = 20, 2, 24
+	c := newResumableClient(fs, stateDir)
+	c.useManifest = true
+	assert.Nil(t, uploadResumable(c, localFile.Name(), "big/file"))
+	assert.Equal(t, 1, fs.started)
+	assert.Len(t, fs.sessions["/session/1"].resumedAt, 1)
+	assertUploaded(t, c, stateDir, "big/file", data)
+
+	hash := sha256.Sum256(data)
+	assert.Equal(t, hash[:], c.manifest.Files["big/file"].SHA256)
+	assert.Equal(t, int64(len(data)), c.manifest.Files["big/file"].Size)
+
+	// files below the threshold are uploaded at once
+	c.resumableThreshold = int64(len(data) + 1)
+	assert.Nil(t, uploadResumable(c, localFile.Name(), "small/file"))
+	assert.Equal(t, 1, fs.started)
+	assertUploaded(t, c, stateDir, "small/file", data)
+
+	// a corrupted upload is deleted
+	c.resumableThreshold = 1
+	fs.corrupt = true
+	assert.Equal(t, hashMismatchErr, uploadResumable(c, localFile.Name(), "corrupt/file").Error())
+	objects, _ := c.listFiles()
+	assert.NotContains(t, objects, "corrupt/file")
+}
+
+func TestDoResumableUploadAfterRestart(t *testing.T) {
+	fs := newFakeUploadServer(newFakeBucket())
+	defer fs.Close()
+	stateDir, _ := ioutil.TempDir("", "gcloud-crypto-state")
+	defer os.RemoveAll(stateDir)
+
+	data := randomByte(100 * 1024)
+	localFile, _ := ioutil.TempFile("", "gcloud-crypto-resumable")
+	defer os.Remove(localFile.Name())
+	localFile.Write(data)
+	localFile.Close()
+
+	// the connection drops for longer than the retries
+	fs.failAfter, fs.failParts = 30, resumableRetries+1
+	assert.NotNil(t, uploadResumable(newResumableClient(fs, stateDir), localFile.Name(), "big/file"))
+	states, _ := filepath.Glob(filepath.Join(stateDir, "*.upload"))
+	assert.Len(t, states, 1)
+
+	// another process goes on where the upload stopped
+	c := newResumableClient(fs, stateDir)
+	assert.Nil(t, uploadResumable(c, localFile.Name(), "big/file"))
+	assert.Equal(t, 1, fs.started)
+	assert.Equal(t, []int64{30 * 1000}, fs.sessions["/session/1"].resumedAt)
+	assertUploaded(t, c, stateDir, "big/file", data)
+
+	// a changed file, even keeping its size and modification time, or an
+	// expired session, start over
+	for _, change := range []string{"mtime", "content", "session"} {
+		started := fs.started
+		fs.failAfter, fs.failParts = fs.parts+10, resumableRetries+1
+		assert.NotNil(t, uploadResumable(newResumableClient(fs, stateDir), localFile.Name(), "other/file"))
+
+		switch change {
+		case "mtime":
+			modTime := time.Now().Add(-time.Hour)
+			os.Chtimes(localFile.Name(), modTime, modTime)
+		case "content":
+			stat, _ := os.Stat(localFile.Name())
+			data = randomByte(len(data))
+			ioutil.WriteFile(localFile.Name(), data, 0600)
+			os.Chtimes(localFile.Name(), stat.ModTime(), stat.ModTime())
+		case "session":
+			fs.Lock()
+			for id := range fs.sessions {
+				delete(fs.sessions, id)
+			}
+			fs.Unlock()
+		}
+
+		c := newResumableClient(fs, stateDir)
+		assert.Nil(t, uploadResumable(c, localFile.Name(), "other/file"), change)
+		assert.Equal(t, started+2, fs.started, change)
+		assertUploaded(t, c, stateDir, "other/file", data)
+		assert.Nil(t, c.doDeleteObject("other/file", false))
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	s3Service         = "s3"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DateFormat      = "20060102T150405Z"
+	s3PartSize        = 8 * 1024 * 1024
+
+	errS3BadDigest = "BadDigest"
+	// errS3PreconditionFailed answers a conditional write over another
+	// version, errS3ConditionalConflict one racing with another write.
+	errS3PreconditionFailed  = "PreconditionFailed"
+	errS3ConditionalConflict = "ConditionalRequestConflict"
+	errS3StorageClass        = "S3 storage classes are set per object, not per bucket"
+)
+
+// s3BucketService talks to any service speaking the S3 protocol (AWS, MinIO,
+// Ceph RGW, Backblaze B2...) using path-style requests signed with AWS
+// signature version 4.
+type s3BucketService struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	bucket    string
+	partSize  int
+}
+
+type s3CreateBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string   `xml:"LocationConstraint"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func NewS3BucketService(client *http.Client, endpoint, region, accessKey, secretKey, bucketName string) (*s3BucketService, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("invalid S3 endpoint: " + endpoint)
+	}
+
+	return &s3BucketService{client, u, region, accessKey, secretKey, bucketName, s3PartSize}, nil
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, as required for the canonical request. Slashes are kept when
+// escaping a path.
+func s3Escape(s string, path bool) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+// sign adds the AWS signature version 4 headers to a request. Every header
+// already set on the request is signed.
+func (s3 s3BucketService) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := strings.Join([]string{amzDate[:8], s3.region, s3Service, "aws4_request"}, "/")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var signedHeaders []string
+	for k := range headers {
+		signedHeaders = append(signedHeaders, k)
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders bytes.Buffer
+	for _, k := range signedHeaders {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.secretKey), amzDate[:8])
+	signingKey = hmacSHA256(signingKey, s3.region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s3.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// newRequest creates a signed request for an object, or for the bucket itself
+// when the object name is empty.
+func (s3 s3BucketService) newRequest(method, object string, query url.Values, body io.Reader, header http.Header) (*http.Request, error) {
+	p := strings.TrimSuffix(s3.endpoint.Path, "/") + "/" + s3.bucket
+	if object != "" {
+		p += "/" + object
+	}
+
+	u := *s3.endpoint
+	u.Path = p
+	u.RawPath = s3Escape(p, true)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s3.sign(req, s3UnsignedPayload, time.Now())
+	return req, nil
+}
+
+// do sends a request and turns any non 2xx response into an error, decoding
+// the S3 error document when there is one.
+func (s3 s3BucketService) do(req *http.Request) (*http.Response, error) {
+	res, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+
+		s3Err := s3Error{}
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, errors.New(s3Err.Code + ": " + s3Err.Message)
+		}
+		return nil, errors.New(res.Status)
+	}
+	return res, nil
+}
+
+// CreateBucket creates the bucket unless it already exists. The location is
+// the region of the bucket and defaults to the configured region. S3 storage
+// classes are set per object, not per bucket.
+func (s3 s3BucketService) CreateBucket(location, storageClass string) error {
+	if storageClass != "" {
+		return errors.New(errS3StorageClass)
+	}
+
+	req, err := s3.newRequest("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s3.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		log.WithFields(logrus.Fields{"bucket": s3.bucket}).Debug("Bucket already exists.")
+		return nil
+	case http.StatusNotFound:
+	default:
+		return errors.New("Failed to get bucket: " + res.Status)
+	}
+
+	if location == "" {
+		location = s3.region
+	}
+
+	// us-east-1 is the default location, and must not be given explicitly
+	var body io.Reader
+	if location != "us-east-1" {
+		configuration, err := xml.Marshal(s3CreateBucketConfiguration{LocationConstraint: location})
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(configuration)
+	}
+
+	if req, err = s3.newRequest("PUT", "", nil, body, nil); err != nil {
+		return err
+	}
+
+	if res, err = s3.do(req); err != nil {
+		return errors.New("Failed to create bucket: " + err.Error())
+	}
+	res.Body.Close()
+
+	log.WithFields(logrus.Fields{"bucket": s3.bucket, "location": location}).Info("Created bucket.")
+	return nil
+}
+
+func (s3 s3BucketService) Delete(encryptedFilePath string) error {
+	req, err := s3.newRequest("DELETE", encryptedFilePath, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to delete <%s>: %s", encryptedFilePath, err.Error()))
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// checkETag compares the ETag returned for an object or a part with the MD5
+// of the data sent.
+func checkETag(res *http.Response, expectedMD5Hash []byte) error {
+	etag := strings.Trim(res.Header.Get("ETag"), `"`)
+	if actualMD5Hash, err := hex.DecodeString(etag); err != nil || !bytes.Equal(expectedMD5Hash, actualMD5Hash) {
+		log.WithFields(logrus.Fields{"expected md5": expectedMD5Hash, "actual md5": actualMD5Hash}).Warn("Uploaded file is corrupted")
+		return errors.New(hashMismatchErr)
+	}
+	return nil
+}
+
+// put uploads data to an object, or to a part of a multipart upload when
+// query is set, along with the conditions of the request. The server refuses
+// the data with a BadDigest error when its MD5 does not match Content-MD5.
+func (s3 s3BucketService) put(name string, query url.Values, conditions http.Header, data []byte) (string, error) {
+	md5Hash := md5.Sum(data)
+
+	header := http.Header{}
+	for k, v := range conditions {
+		header[k] = v
+	}
+	header.Set("Content-MD5", b64.StdEncoding.EncodeToString(md5Hash[:]))
+	header.Set("Content-Type", "application/octet-stream")
+
+	req, err := s3.newRequest("PUT", name, query, bytes.NewReader(data), header)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), errS3BadDigest) {
+			log.WithFields(logrus.Fields{"expected md5": md5Hash[:]}).Warn("Uploaded file is corrupted")
+			return "", errors.New(hashMismatchErr)
+		} else if strings.HasPrefix(err.Error(), errS3PreconditionFailed) || strings.HasPrefix(err.Error(), errS3ConditionalConflict) {
+			return "", errors.New(errPreconditionFailed)
+		}
+		return "", err
+	}
+	res.Body.Close()
+
+	return res.Header.Get("ETag"), checkETag(res, md5Hash[:])
+}
+
+// post sends an XML document, and decodes the XML answer into result. Like a
+// copy, completing a multipart upload can fail after answering 200 OK.
+func (s3 s3BucketService) post(name string, query url.Values, body []byte, result interface{}) error {
+	req, err := s3.newRequest("POST", name, query, bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	s3Err := s3Error{}
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return errors.New(s3Err.Code + ": " + s3Err.Message)
+	}
+
+	return xml.Unmarshal(data, result)
+}
+
+// Upload sends objects smaller than a part with a single request, and larger
+// ones as a multipart upload, since S3 needs to know the length of what is
+// uploaded in advance.
+func (s3 s3BucketService) Upload(r io.Reader, encryptedUploadPath string) error {
+	part := make([]byte, s3.partSize)
+	n, err := io.ReadFull(r, part)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if _, err := s3.put(encryptedUploadPath, nil, nil, part[:n]); err != nil {
+			if err.Error() == hashMismatchErr {
+				s3.Delete(encryptedUploadPath)
+			}
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := s3.multipartUpload(r, encryptedUploadPath, part); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{"filename": encryptedUploadPath}).Debug("Created object successfully.")
+	return nil
+}
+
+func (s3 s3BucketService) multipartUpload(r io.Reader, encryptedUploadPath string, part []byte) error {
+	initiated := s3InitiateMultipartUploadResult{}
+	if err := s3.post(encryptedUploadPath, url.Values{"uploads": {""}}, nil, &initiated); err != nil {
+		return err
+	}
+
+	complete := s3CompleteMultipartUpload{}
+	err := func() error {
+		for partNumber := 1; len(part) > 0; partNumber++ {
+			query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadID}}
+			etag, err := s3.put(encryptedUploadPath, query, nil, part)
+			if err != nil {
+				return err
+			}
+			complete.Parts = append(complete.Parts, s3CompletedPart{partNumber, etag})
+
+			n, err := io.ReadFull(r, part[:cap(part)])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			part = part[:n]
+		}
+
+		body, _ := xml.Marshal(complete)
+		return s3.post(encryptedUploadPath, url.Values{"uploadId": {initiated.UploadID}}, body, &struct{}{})
+	}()
+
+	if err != nil {
+		if req, abortErr := s3.newRequest("DELETE", encryptedUploadPath, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+			if res, abortErr := s3.do(req); abortErr == nil {
+				res.Body.Close()
+			}
+		}
+	}
+	return err
+}
+
+func (s3 s3BucketService) Download(encryptedFilePath string, offset, length int64) (io.ReadCloser, int64, error) {
+	header := http.Header{}
+	if r := rangeHeader(offset, length); r != "" {
+		header.Set("Range", r)
+	}
+
+	req, err := s3.newRequest("GET", encryptedFilePath, nil, nil, header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		return nil, 0, errors.New("Error trying to download file:" + err.Error())
+	}
+
+	size, err := objectSize(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, 0, err
+	}
+
+	// a body shorter than its Content-Length fails with io.ErrUnexpectedEOF
+	return res.Body, size, nil
+}
+
+// DownloadVersion downloads a whole object, whose version is its ETag.
+func (s3 s3BucketService) DownloadVersion(encryptedFilePath string) (io.ReadCloser, string, error) {
+	req, err := s3.newRequest("GET", encryptedFilePath, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		return nil, "", errors.New("Error trying to download file:" + err.Error())
+	}
+	return res.Body, res.Header.Get("ETag"), nil
+}
+
+// UploadIfVersion sends the object with a single request, made conditional
+// on its ETag with If-Match, or on its absence with If-None-Match.
+func (s3 s3BucketService) UploadIfVersion(r io.Reader, encryptedUploadPath, version string) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	conditions := http.Header{}
+	if version == "" {
+		conditions.Set("If-None-Match", "*")
+	} else {
+		conditions.Set("If-Match", version)
+	}
+
+	etag, err := s3.put(encryptedUploadPath, nil, conditions, data)
+	if err != nil {
+		if err.Error() == hashMismatchErr {
+			s3.Delete(encryptedUploadPath)
+		}
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{"filename": encryptedUploadPath}).Debug("Created object successfully.")
+	return etag, nil
+}
+
+func (s3 s3BucketService) List() ([]objectInfo, error) {
+	var objects []objectInfo
+	continuationToken := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := s3.newRequest("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s3.do(req)
+		if err != nil {
+			log.Errorf("error while getting object list: %s", err.Error())
+			return nil, errors.New("failed to get objects in bucket")
+		}
+
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+
+		if err != nil {
+			return nil, errors.New("failed to get objects in bucket")
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, objectInfo{object.Key, object.Size, object.LastModified})
+		}
+
+		if continuationToken = result.NextContinuationToken; !result.IsTruncated || continuationToken == "" {
+			break
+		}
+	}
+	return objects, nil
+}
+
+func (s3 s3BucketService) Move(src, dst string) error {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", s3Escape("/"+s3.bucket+"/"+src, true))
+
+	req, err := s3.newRequest("PUT", dst, nil, nil, header)
+	if err != nil {
+		return err
+	}
+
+	res, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+
+	// a copy can fail after the server already answered 200 OK, the error is
+	// then in the body
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	s3Err := s3Error{}
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return errors.New(s3Err.Code + ": " + s3Err.Message)
+	}
+
+	return s3.Delete(src)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	errScriptFailed = "at least one command of the script failed"
+)
+
+// splitCommands splits a script into the commands of the shell, one per line
+// or separated by ';' outside of quotes. Empty commands are dropped, and
+// '#' at the start of a command comments out the rest of the line.
+func splitCommands(script string) []string {
+	var (
+		commands []string
+		current  []rune
+		quote    rune
+		escaped  bool
+		comment  bool
+	)
+
+	flush := func() {
+		command := strings.TrimSpace(string(current))
+		if command != "" {
+			commands = append(commands, command)
+		}
+		current = current[:0]
+	}
+
+	for _, r := range script {
+		switch {
+		case comment:
+			comment = r != '\n'
+			continue
+		case r == '#' && strings.TrimSpace(string(current)) == "":
+			comment = true
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ';' || r == '\n':
+			flush()
+			continue
+		}
+		current = append(current, r)
+	}
+	flush()
+
+	return commands
+}
+
+// runScript runs the commands read from r as if they were typed in the
+// shell, until 'exit'. Failed commands are logged, and unless exitOnError
+// is set the following ones still run. The error of the first failed
+// command is returned when exitOnError is set, errScriptFailed otherwise.
+func runScript(c *client, r io.Reader, exitOnError bool) error {
+	script, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, command := range splitCommands(string(script)) {
+		if command == "exit" {
+			break
+		}
+
+		if err := parseInteractiveCommand(c, command); err != nil {
+			log.WithFields(logrus.Fields{"command": command}).Warn(err)
+			if exitOnError {
+				return err
+			}
+			failed = true
+		}
+	}
+
+	if failed {
+		return errors.New(errScriptFailed)
+	}
+	return nil
+}
+
+// openScript opens the script file given with -script, '-' being stdin.
+func openScript(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
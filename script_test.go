@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommands(t *testing.T) {
+	splitTests := []struct {
+		script   string
+		expected []string
+	}{
+		{"", nil},
+		{"ls", []string{"ls"}},
+		{"upload ./reports/* reports/2026; ls reports/*", []string{"upload ./reports/* reports/2026", "ls reports/*"}},
+		{"ls\n\n  # a comment; still a comment\ndirs\n", []string{"ls", "dirs"}},
+		{`delete "a;b"; delete 'c;d'`, []string{`delete "a;b"`, `delete 'c;d'`}},
+		{`delete a\;b;;`, []string{`delete a\;b`}},
+		{`delete "it\"s;"; ls`, []string{`delete "it\"s;"`, "ls"}},
+	}
+
+	for _, e := range splitTests {
+		assert.Equal(t, e.expected, splitCommands(e.script), e.script)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	bs, keys := setupUp()
+	c := newClient(&keys, bs)
+	cleanUp(c)
+
+	script := "upload testdata/testdata1 docs; move docs/testdata/testdata1 docs/a.txt\nupload testdata/testdata2 docs"
+	assert.Nil(t, runScript(c, strings.NewReader(script), true))
+
+	files, _ := c.getFileList("")
+	assert.Equal(t, []string{"docs/a.txt", "docs/testdata/testdata2"}, files)
+
+	// the first command fails, the second one only runs without exitOnError
+	assert.Equal(t, errors.New(errDeleteFileNotFound), runScript(c, strings.NewReader("delete missing; delete docs/a.txt"), true))
+	files, _ = c.getFileList("")
+	assert.Len(t, files, 2)
+
+	assert.Equal(t, errors.New(errScriptFailed), runScript(c, strings.NewReader("delete missing; delete docs/a.txt"), false))
+	files, _ = c.getFileList("")
+	assert.Equal(t, []string{"docs/testdata/testdata2"}, files)
+
+	assert.Equal(t, errors.New(invalidCommand), runScript(c, strings.NewReader("frobnicate"), true))
+
+	// nothing runs after exit
+	assert.Nil(t, runScript(c, strings.NewReader("exit; delete docs/*"), true))
+	files, _ = c.getFileList("")
+	assert.Len(t, files, 1)
+}
@@ -1,7 +1,6 @@
 package simplecrypto
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -14,6 +13,7 @@ import (
 	"github.com/GregorioDiStefano/gcloud-crypto/progress"
 	"github.com/Sirupsen/logrus"
 	"golang.org/x/crypto/scrypt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -52,10 +52,6 @@ func randomBytes(length int) []byte {
 	return rb
 }
 
-func generateRandomIV() []byte {
-	return randomBytes(aes.BlockSize)
-}
-
 func GetKeyFromPassphrase(passphrase, salt []byte, N, r, p int) (*Keys, error) {
 	if passphrase == nil || salt == nil {
 		panic(noSaltOrPassword)
@@ -128,181 +124,172 @@ func DecryptText(cryptoText string, key []byte) (string, error) {
 
 func (pg *progressBar) Write(b []byte) (n int, err error) {
 	pg.bytesRead += int64(len(b))
-	progress.DrawProgress("Encrypting", pg.bytesRead, pg.totalSize)
+	pg.bar.Add(int64(len(b)))
 	return len(b), nil
 }
 
+// progressBar reports what is written to it to a progress.Bar.
 type progressBar struct {
 	io.Writer
 	bytesRead int64
-	totalSize int64
+	bar       progress.Bar
 }
 
-func EncryptFile(filename string, keys *Keys) (string, []byte, error) {
-	outputFilename := fmt.Sprintf("%s.%s", filename, "enc")
-	readFile, err := os.Open(filename)
-	pb := &progressBar{}
-
-	if readFileStat, err := readFile.Stat(); err != nil {
-		log.Error("unable to stat file that is to be encrypted")
-		return "", nil, err
-	} else {
-		readFileSize := readFileStat.Size()
-		pb.totalSize = readFileSize
-	}
-
-	md5Hash := md5.New()
+// legacyDecryptReader decrypts files written before the chunked format: the
+// IV, the AES-CTR ciphertext and the HMAC-SHA256 of both. Since the HMAC is
+// at the end of the stream, the last sha256.Size bytes read are always held
+// back until EOF, where they are checked.
+type legacyDecryptReader struct {
+	src    io.Reader
+	keys   *Keys
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+	out    []byte
+	err    error
+}
 
-	defer readFile.Close()
+func (dr *legacyDecryptReader) init() error {
+	iv := make([]byte, aes.BlockSize)
 
-	if err != nil {
-		log.Errorf("error opening: %s, err: %s", filename, err.Error())
-		return "", nil, errors.New(unableToOpenFileReading)
+	if _, err := io.ReadFull(dr.src, iv); err != nil {
+		return errors.New(errorReadingIV)
 	}
 
-	writeFile, err := os.OpenFile(outputFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	block, err := aes.NewCipher(dr.keys.EncryptionKey)
 
 	if err != nil {
-		log.Error("Unable to open file for writing: ", err.Error())
-		return "", nil, err
+		return err
 	}
-	defer writeFile.Close()
 
-	block, err := aes.NewCipher(keys.EncryptionKey)
+	dr.stream = cipher.NewCTR(block, iv)
+	dr.mac = hmac.New(sha256.New, dr.keys.HMACKey)
+	dr.mac.Write(iv)
+	dr.mac.Write(iv)
+	return nil
+}
 
-	if err != nil {
-		log.Error("Unable to initalize AES crypto cipher: ", err.Error())
-		return "", nil, err
+func (dr *legacyDecryptReader) decrypt(ciphertext []byte) {
+	dr.mac.Write(ciphertext)
+	plaintext := make([]byte, len(ciphertext))
+	dr.stream.XORKeyStream(plaintext, ciphertext)
+	dr.out = append(dr.out, plaintext...)
+}
+
+func (dr *legacyDecryptReader) fill() {
+	if dr.stream == nil {
+		if dr.err = dr.init(); dr.err != nil {
+			return
+		}
 	}
 
-	iv := generateRandomIV()
-	md5Hash.Write(iv)
+	data := make([]byte, 32*1024)
+	n, err := dr.src.Read(data)
+	dr.buf = append(dr.buf, data[:n]...)
 
-	writer := &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: io.MultiWriter(writeFile, md5Hash, pb)}
-	writeFile.Write(iv)
+	switch {
+	case err == io.EOF:
+		if len(dr.buf) < sha256.Size {
+			dr.err = errors.New(errorReadingHMAC)
+			return
+		}
 
-	if _, err := io.Copy(writer, readFile); err != nil {
-		log.Error("error during crypto: " + err.Error())
-		return "", nil, err
+		dr.decrypt(dr.buf[:len(dr.buf)-sha256.Size])
+		if !hmac.Equal(dr.mac.Sum(nil), dr.buf[len(dr.buf)-sha256.Size:]) {
+			log.Error("Failed to validate HMAC")
+			dr.out = nil
+			dr.err = errors.New(hmacValidationFailed)
+			return
+		}
+		dr.err = io.EOF
+	case err != nil:
+		dr.err = err
+	case len(dr.buf) > sha256.Size:
+		dr.decrypt(dr.buf[:len(dr.buf)-sha256.Size])
+		dr.buf = append(dr.buf[:0], dr.buf[len(dr.buf)-sha256.Size:]...)
 	}
+}
 
-	writeFile.Sync()
-
-	if hmac, err := calculateHMAC(keys.HMACKey, iv, writeFile); err == nil {
-		addHMACToFile(writeFile, hmac)
-		md5Hash.Write(hmac)
-	} else {
-		log.Error("Unable to add HMAC to file: ", err.Error())
-		return "", nil, err
+func (dr *legacyDecryptReader) Read(b []byte) (int, error) {
+	for len(dr.out) == 0 && dr.err == nil {
+		dr.fill()
 	}
 
-	return outputFilename, md5Hash.Sum(nil), nil
+	n := copy(b, dr.out)
+	dr.out = dr.out[n:]
+
+	if n > 0 {
+		return n, nil
+	}
+	return 0, dr.err
 }
 
-func DecryptFile(filename string, keys *Keys) (string, error) {
-	iv := make([]byte, aes.BlockSize)
+func EncryptFile(filename string, keys *Keys) (string, []byte, error) {
+	outputFilename := fmt.Sprintf("%s.%s", filename, "enc")
 	readFile, err := os.Open(filename)
 
-	cwd, _ := os.Getwd()
-	decryptedFilename, _ := ioutil.TempFile(cwd, "plaintext")
-
-	writeFile, err := os.OpenFile(decryptedFilename.Name(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-
 	if err != nil {
-		return "", err
+		log.Errorf("error opening: %s, err: %s", filename, err.Error())
+		return "", nil, errors.New(unableToOpenFileReading)
 	}
 
 	defer readFile.Close()
-	defer writeFile.Close()
-
-	readFile.Read(iv)
-
-	block, err := aes.NewCipher(keys.EncryptionKey)
 
+	readFileStat, err := readFile.Stat()
 	if err != nil {
-		return "", err
+		log.Error("unable to stat file that is to be encrypted")
+		return "", nil, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	reader := &cipher.StreamReader{S: stream, R: readFile}
+	pb := &progressBar{bar: progress.Default.Start("Encrypting", filename, readFileStat.Size())}
+	defer pb.bar.Done()
 
-	// Copy the input file to the output file, decrypting as we go.
-	if _, err := io.Copy(writeFile, reader); err != nil {
-		return "", err
+	writeFile, err := os.OpenFile(outputFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		log.Error("Unable to open file for writing: ", err.Error())
+		return "", nil, err
 	}
+	defer writeFile.Close()
 
-	writeFile.Sync()
-	expectedHMAC, err := truncateHMACSignature(readFile)
+	encryptReader, err := NewEncryptReader(io.TeeReader(readFile, pb), keys)
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	if actualHMAC, err := calculateHMAC(keys.HMACKey, iv, readFile); err != nil || !bytes.Equal(actualHMAC, expectedHMAC) {
-		log.Error("Failed to validate HMAC")
-		return "", errors.New(hmacValidationFailed)
-	}
+	md5Hash := md5.New()
 
-	if _, err = truncateHMACSignature(writeFile); err != nil {
-		return "", err
+	if _, err := io.Copy(io.MultiWriter(writeFile, md5Hash), encryptReader); err != nil {
+		log.Error("error during crypto: " + err.Error())
+		return "", nil, err
 	}
 
-	return decryptedFilename.Name(), nil
-
+	return outputFilename, md5Hash.Sum(nil), writeFile.Sync()
 }
 
-// compute HMAC-SHA256 as: hmac(key, IV + cipherText)
-func calculateHMAC(key, iv []byte, fh *os.File) ([]byte, error) {
-	const idealBufferSize = 16 * 1024
-	fh.Seek(0, 0)
-
-	hash := hmac.New(sha256.New, key)
-	hash.Write(iv)
-
-	for {
-		data := make([]byte, idealBufferSize)
-		actuallyRead, err := fh.Read(data)
-
-		data = data[0:actuallyRead]
-
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return nil, err
-		}
+func DecryptFile(filename string, keys *Keys) (string, error) {
+	readFile, err := os.Open(filename)
 
-		fh.Sync()
-		hash.Write(data)
+	if err != nil {
+		return "", errors.New(unableToOpenFileReading)
 	}
 
-	return hash.Sum(nil), nil
-}
+	defer readFile.Close()
 
-func truncateHMACSignature(file *os.File) ([]byte, error) {
-	extractedHMAC := make([]byte, sha256.Size)
+	cwd, _ := os.Getwd()
+	writeFile, err := ioutil.TempFile(cwd, "plaintext")
 
-	if stat, err := file.Stat(); err != nil || stat.Size() < sha256.Size {
-		return nil, errors.New(errorReadingHMAC)
-	} else {
-		if _, err := file.ReadAt(extractedHMAC, stat.Size()-sha256.Size); err != nil {
-			return nil, err
-		}
-		if err := os.Truncate(file.Name(), stat.Size()-sha256.Size); err != nil {
-			return nil, err
-		}
+	if err != nil {
+		return "", errors.New(unableToOpenFileWriting)
 	}
-	return extractedHMAC, nil
-}
 
-func addHMACToFile(file *os.File, hmac []byte) error {
-	if len(hmac) != sha256.Size {
-		panic("Adding HMAC of incorrect size, this should never happen")
-	}
+	defer writeFile.Close()
 
-	file.Write(hmac)
-	file.Sync()
+	if _, err := io.Copy(writeFile, NewDecryptReader(readFile, keys)); err != nil {
+		os.Remove(writeFile.Name())
+		return "", err
+	}
 
-	return nil
+	return writeFile.Name(), writeFile.Sync()
 }
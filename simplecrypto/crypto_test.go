@@ -8,11 +8,9 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 	"testing"
 
@@ -134,7 +132,7 @@ func TestEncryptDecryptFile(t *testing.T) {
 		dataToEncrypt, _ := ioutil.ReadFile(e.filepath)
 		encryptedDataBytes, err := ioutil.ReadFile(encryptedFilename)
 
-		assert.True(t, len(encryptedDataBytes) == len(dataToEncrypt)+aes.BlockSize+sha256.Size, "Looks like the IV/HMAC is missing from the file?")
+		assert.Equal(t, encryptedSize(int64(len(dataToEncrypt)), DefaultChunkSize), int64(len(encryptedDataBytes)), "Looks like the header or a chunk tag is missing from the file?")
 
 		assert.NotEqual(t, encryptedDataBytes, dataToEncrypt)
 
@@ -150,35 +148,6 @@ func TestEncryptDecryptFile(t *testing.T) {
 
 }
 
-func TestCalculateHMAC(t *testing.T) {
-	t.Parallel()
-
-	calculateHMACTests := []struct {
-		key      []byte
-		iv       []byte
-		filepath string
-
-		expectedHMACHex string
-		expectedError   error
-	}{
-		{[]byte("foobar"), []byte("longtestiv123456"), "test_data/test-calculate_hmac-1", "de48a455255028af130a99726a3a30144aec11cb80713cf67210d851af26774f", nil},
-		{[]byte("foobar"), []byte("longtestiv123456"), "test_data/test-calculate_hmac-2", "de48a455255028af130a99726a3a30144aec11cb80713cf67210d851af26774f", nil},
-	}
-
-	for _, h := range calculateHMACTests {
-		fh, err := os.Open(h.filepath)
-
-		HMAC, err := calculateHMAC(h.key, h.iv, fh)
-
-		if err == nil {
-			assert.True(t, hex.EncodeToString(HMAC) == h.expectedHMACHex, "HMAC calculation failed")
-		} else {
-			assert.Equal(t, h.expectedError, err, "Unexpected error")
-		}
-
-	}
-}
-
 func TestGetKeyFromPassphrase(t *testing.T) {
 	t.Parallel()
 	key, _ := GetKeyFromPassphrase([]byte("password"), []byte("salt1234"), 4096, 16, 1)
@@ -213,95 +182,38 @@ func TestGetKeyFromPassphraseError_2(t *testing.T) {
 	assert.Error(t, err, "No error returned")
 }
 
-/*
-func TestGetHMACFromFile(t *testing.T) {
+func TestDecryptLegacyTampered(t *testing.T) {
 	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
 
-	getHMACTests := []struct {
-		file string
-		hmac []byte
-		err  error
-	}{
-		{"test_data/test-get_hmac-1", bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}, 4), nil},
-		{"test_data/test-get_hmac-2", bytes.Repeat([]byte{0xFF}, 32), nil},
-		{"test_data/test-get_hmac-3", bytes.Repeat([]byte{0xFF}, 32), nil},
-		{"test_data/test-get_hmac-4", nil, errors.New(errorReadingHMAC)},
-		{"test_data/404", nil, errors.New(unableToOpenFileReading)},
-	}
-
-	for _, h := range getHMACTests {
-		fh, err := os.Open(h.file)
-		if err != nil {
-			panic(err)
-		}
-		hmac, e := getHMACFromFile(*fh)
-
-		if h.err != nil {
-			assert.Equal(t, h.err, e, "Unexpected error returned")
-		}
-
-		if h.hmac != nil {
-			assert.Equal(t, h.hmac, hmac, "Failed to read HMAC from file")
-		}
-	}
-}
-*/
-func TestAddHMACToFile(t *testing.T) {
-	t.Parallel()
+	ciphertext, _ := ioutil.ReadFile("test_data/test-legacy_encrypted-1")
 
-	addHMACTests := []struct {
-		file string
-		hmac []byte
-		err  error
+	tamperTests := []struct {
+		ciphertext    []byte
+		expectedError error
 	}{
-		{"test_data/test-add_hmac-1", bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}, 4), nil},
-		{"test_data/test-add_hmac-2", bytes.Repeat([]byte{0x07}, 4), nil},
+		{ciphertext[:len(ciphertext)-1], errors.New(hmacValidationFailed)},
+		{append(append([]byte{}, ciphertext[:500]...), append([]byte{ciphertext[500] ^ 0x01}, ciphertext[501:]...)...), errors.New(hmacValidationFailed)},
+		{ciphertext[:aes.BlockSize+sha256.Size-1], errors.New(errorReadingHMAC)},
+		{ciphertext[:aes.BlockSize-1], errors.New(errorReadingIV)},
+		{ciphertext[:4], errors.New(errorReadingIV)},
 	}
 
-	for _, h := range addHMACTests {
-		f, _ := os.Open(h.file)
-		if len(h.hmac) < 32 {
-			assert.Panics(t, func() { addHMACToFile(f, h.hmac) }, "Failed to panic")
-		} else {
-			e := addHMACToFile(f, h.hmac)
-
-			if h.err != nil {
-				assert.Equal(t, h.err.Error(), e, "Unexpected error returned")
-			}
-		}
+	for _, e := range tamperTests {
+		_, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(e.ciphertext), keys))
+		assert.Equal(t, e.expectedError, err)
 	}
 }
 
-func TestTruncateHMACSignature(t *testing.T) {
+func TestDecryptLegacyFile(t *testing.T) {
 	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
 
-	truncateHMACTests := []struct {
-		filepath string
-		err      error
+	plainTextFile, err := DecryptFile("test_data/test-legacy_encrypted-1", keys)
+	assert.Nil(t, err)
+	defer os.Remove(plainTextFile)
 
-		expectedHMAC string
-	}{
-		{"test_data/test-truncate_hmac-1", nil, "9312d9e6a4dd7571481298141165206a4de52cca5c7c01ba3b7de0122e147d08"},
-		{"test_data/test-truncate_hmac-2", errors.New(errorReadingHMAC), ""},
-	}
-
-	for _, h := range truncateHMACTests {
-		exec.Command("cp", h.filepath, "/tmp/truncate-file").Run()
-		fh, err := os.Open("/tmp/truncate-file")
-
-		if err != nil {
-			panic(err)
-		}
-
-		hmac, e := truncateHMACSignature(fh)
-
-		if h.expectedHMAC != "" {
-			assert.Equal(t, h.expectedHMAC, hex.EncodeToString(hmac))
-		}
-
-		if h.err != nil {
-			fmt.Println(h.err, e)
-			assert.Equal(t, h.err, e, "Unexpected error returned")
-		}
-	}
+	expected, _ := ioutil.ReadFile("test_data/test-encrypt_decrypt_1")
+	actual, _ := ioutil.ReadFile(plainTextFile)
+	assert.Equal(t, expected, actual)
 }
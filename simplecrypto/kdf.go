@@ -0,0 +1,77 @@
+package simplecrypto
+
+import (
+	"errors"
+)
+
+const (
+	KDFScrypt = "scrypt"
+
+	kdfSaltSize = 32
+
+	// the parameters of the vault header are bounded, so that whoever can
+	// write it cannot make unlocking the vault take all the memory or time
+	// of the machine: scrypt uses 128*N*R bytes, and its time grows with
+	// N*R*P. The legacy parameters use 16 MiB and 2^24.
+	kdfMaxN      = 1 << 20
+	kdfMaxR      = 32
+	kdfMaxP      = 256
+	kdfMaxMemory = 1 << 30
+	kdfMaxWork   = 1 << 26
+
+	unsupportedKDF   = "Unsupported key derivation function"
+	invalidKDFSalt   = "Key derivation salt is too small"
+	invalidKDFCost   = "Key derivation N must be a power of 2, and N, r and p positive"
+	excessiveKDFCost = "Key derivation parameters exceed the allowed cost"
+)
+
+// KDFParams describes how the keys of a vault are derived from its password.
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// NewKDFParams returns the parameters used for new vaults, with a random salt.
+func NewKDFParams() *KDFParams {
+	return &KDFParams{Algorithm: KDFScrypt, Salt: randomBytes(kdfSaltSize), N: 32768, R: 8, P: 1}
+}
+
+// LegacyKDFParams returns the parameters every vault used before they were
+// stored in the vault header.
+func LegacyKDFParams(salt []byte) *KDFParams {
+	return &KDFParams{Algorithm: KDFScrypt, Salt: salt, N: 8192, R: 16, P: 128}
+}
+
+// DeriveKeys derives the keys of a vault from its password.
+func (p *KDFParams) DeriveKeys(password []byte) (*Keys, error) {
+	if p.Algorithm != KDFScrypt {
+		return nil, errors.New(unsupportedKDF)
+	}
+
+	// GetKeyFromPassphrase panics on small salts, the header is not trusted
+	if len(p.Salt) < 8 {
+		return nil, errors.New(invalidKDFSalt)
+	}
+
+	if err := p.checkCost(); err != nil {
+		return nil, err
+	}
+	return GetKeyFromPassphrase(password, p.Salt, p.N, p.R, p.P)
+}
+
+// checkCost refuses the parameters scrypt cannot use, and the ones which
+// would take more than the allowed memory or time.
+func (p *KDFParams) checkCost() error {
+	if p.N < 2 || p.N&(p.N-1) != 0 || p.R < 1 || p.P < 1 {
+		return errors.New(invalidKDFCost)
+	}
+
+	if p.N > kdfMaxN || p.R > kdfMaxR || p.P > kdfMaxP ||
+		128*int64(p.N)*int64(p.R) > kdfMaxMemory || int64(p.N)*int64(p.R)*int64(p.P) > kdfMaxWork {
+		return errors.New(excessiveKDFCost)
+	}
+	return nil
+}
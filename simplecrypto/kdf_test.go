@@ -0,0 +1,51 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKDFParams(t *testing.T) {
+	p1, p2 := NewKDFParams(), NewKDFParams()
+	assert.Len(t, p1.Salt, kdfSaltSize)
+	assert.False(t, bytes.Equal(p1.Salt, p2.Salt), "salts should be random")
+}
+
+func TestDeriveKeys(t *testing.T) {
+	t.Parallel()
+
+	expected, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	deriveKeysTests := []struct {
+		params        KDFParams
+		expectedKeys  *Keys
+		expectedError error
+	}{
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4096, 16, 1}, expected, nil},
+		{KDFParams{"argon2", []byte("longtestiv123456"), 4096, 16, 1}, nil, errors.New(unsupportedKDF)},
+		{KDFParams{KDFScrypt, []byte("short"), 4096, 16, 1}, nil, errors.New(invalidKDFSalt)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4095, 16, 1}, nil, errors.New(invalidKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 0, 16, 1}, nil, errors.New(invalidKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4096, 0, 1}, nil, errors.New(invalidKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4096, 16, -1}, nil, errors.New(invalidKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 1 << 30, 1, 1}, nil, errors.New(excessiveKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4096, 1 << 20, 1}, nil, errors.New(excessiveKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 4096, 16, 1 << 20}, nil, errors.New(excessiveKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 1 << 20, 32, 1}, nil, errors.New(excessiveKDFCost)},
+		{KDFParams{KDFScrypt, []byte("longtestiv123456"), 1 << 18, 8, 256}, nil, errors.New(excessiveKDFCost)},
+	}
+
+	for _, e := range deriveKeysTests {
+		keys, err := e.params.DeriveKeys([]byte("foobar"))
+		assert.Equal(t, e.expectedError, err)
+		assert.Equal(t, e.expectedKeys, keys)
+	}
+}
+
+func TestCheckCost(t *testing.T) {
+	assert.Nil(t, NewKDFParams().checkCost())
+	assert.Nil(t, LegacyKDFParams([]byte("longtestiv123456")).checkCost())
+}
@@ -0,0 +1,72 @@
+package simplecrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// Vault keys are random and stored wrapped, sealed with AES-GCM under the
+// encryption key derived from the password, so changing the password only
+// means wrapping them again.
+//
+// Wrapped keys layout:
+//
+//	nonce (12) | sealed encryption key and HMAC key (64 + 16)
+const (
+	keySize = 32
+
+	keyWrapInfo = "gcloud-crypto key wrap v1"
+
+	unwrapFailed      = "Unable to unwrap keys"
+	invalidWrappedKey = "Invalid wrapped keys"
+)
+
+// NewRandomKeys returns random keys for a new vault.
+func NewRandomKeys() *Keys {
+	return &Keys{randomBytes(keySize), randomBytes(keySize)}
+}
+
+func newKeyWrapAEAD(kek *Keys) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKeys seals keys with the key encryption key kek.
+func WrapKeys(keys, kek *Keys) ([]byte, error) {
+	if len(keys.EncryptionKey) != keySize || len(keys.HMACKey) != keySize {
+		return nil, errors.New(invalidWrappedKey)
+	}
+
+	aead, err := newKeyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := randomBytes(aead.NonceSize())
+	plaintext := append(append([]byte{}, keys.EncryptionKey...), keys.HMACKey...)
+	return aead.Seal(nonce, nonce, plaintext, []byte(keyWrapInfo)), nil
+}
+
+// UnwrapKeys opens keys sealed by WrapKeys, failing if kek is not the key
+// they were wrapped with.
+func UnwrapKeys(wrapped []byte, kek *Keys) (*Keys, error) {
+	aead, err := newKeyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) != aead.NonceSize()+2*keySize+aead.Overhead() {
+		return nil, errors.New(invalidWrappedKey)
+	}
+
+	nonce := wrapped[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, wrapped[aead.NonceSize():], []byte(keyWrapInfo))
+	if err != nil {
+		return nil, errors.New(unwrapFailed)
+	}
+	return &Keys{plaintext[:keySize], plaintext[keySize:]}, nil
+}
@@ -0,0 +1,56 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRandomKeys(t *testing.T) {
+	k1, k2 := NewRandomKeys(), NewRandomKeys()
+	assert.Len(t, k1.EncryptionKey, keySize)
+	assert.Len(t, k1.HMACKey, keySize)
+	assert.False(t, bytes.Equal(k1.EncryptionKey, k2.EncryptionKey), "keys should be random")
+	assert.False(t, bytes.Equal(k1.EncryptionKey, k1.HMACKey), "keys should be random")
+}
+
+func TestWrapKeys(t *testing.T) {
+	keys, kek := NewRandomKeys(), NewRandomKeys()
+
+	wrapped, err := WrapKeys(keys, kek)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(wrapped), string(keys.EncryptionKey))
+
+	unwrapped, err := UnwrapKeys(wrapped, kek)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, unwrapped)
+
+	// a new nonce every time
+	wrappedAgain, _ := WrapKeys(keys, kek)
+	assert.NotEqual(t, wrapped, wrappedAgain)
+
+	tampered := append([]byte{}, wrapped...)
+	tampered[20] ^= 0x01
+
+	unwrapTests := []struct {
+		wrapped       []byte
+		kek           *Keys
+		expectedError error
+	}{
+		{wrapped, NewRandomKeys(), errors.New(unwrapFailed)},
+		{tampered, kek, errors.New(unwrapFailed)},
+		{wrapped[:len(wrapped)-1], kek, errors.New(invalidWrappedKey)},
+		{nil, kek, errors.New(invalidWrappedKey)},
+	}
+
+	for _, e := range unwrapTests {
+		unwrapped, err := UnwrapKeys(e.wrapped, e.kek)
+		assert.Equal(t, e.expectedError, err)
+		assert.Nil(t, unwrapped)
+	}
+
+	_, err = WrapKeys(&Keys{[]byte("short"), keys.HMACKey}, kek)
+	assert.Equal(t, errors.New(invalidWrappedKey), err)
+}
@@ -0,0 +1,263 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	invalidRange         = "Range is outside of the file"
+	invalidEncryptedSize = "Encrypted file size does not match its chunks"
+)
+
+// RangeFetcher downloads length bytes of an encrypted file starting at
+// offset, or the rest of the file when length is negative. The size of the
+// whole encrypted file is returned along with the reader.
+type RangeFetcher func(offset, length int64) (io.ReadCloser, int64, error)
+
+// RangeDecrypter decrypts byte ranges of a remote file, fetching and
+// authenticating only the chunks holding the range.
+type RangeDecrypter struct {
+	fetch         RangeFetcher
+	keys          *Keys
+	header        []byte
+	aead          cipher.AEAD
+	chunkSize     int64
+	chunks        int64
+	encryptedSize int64
+	size          int64
+	legacy        bool
+}
+
+// NewRangeDecrypter fetches the header of a file to find out its format and
+// the size of its plaintext.
+func NewRangeDecrypter(fetch RangeFetcher, keys *Keys) (*RangeDecrypter, error) {
+	// one more byte holds the recipient count of version 3 headers
+	r, encryptedSize, err := fetch(0, int64(streamHeaderLen+1))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	header := make([]byte, streamHeaderLen+1)
+	n, _ := io.ReadFull(r, header)
+
+	rd := &RangeDecrypter{fetch: fetch, keys: keys, header: header, encryptedSize: encryptedSize}
+
+	if n < len(streamMagic) || !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		// legacy files can only be authenticated as a whole
+		rd.legacy = true
+		rd.size = encryptedSize - aes.BlockSize - sha256.Size
+		if rd.size < 0 {
+			return nil, errors.New(errorReadingHMAC)
+		}
+		return rd, nil
+	}
+
+	if n <= streamHeaderLen {
+		return nil, errors.New(errorReadingHeader)
+	}
+
+	if header[len(streamMagic)] != streamRecipientVersion {
+		rd.header = header[:streamHeaderLen]
+	} else if rd.header, err = fetchStanzas(fetch, header); err != nil {
+		return nil, err
+	}
+
+	h, err := parseStreamHeader(rd.header)
+	if err != nil {
+		return nil, err
+	}
+
+	if rd.aead, err = newHeaderAEAD(h, keys); err != nil {
+		return nil, err
+	}
+
+	rd.chunkSize = int64(h.chunkSize)
+	body := encryptedSize - int64(len(rd.header))
+	if rd.chunks = sealedChunks(body, rd.chunkSize); rd.chunks == 0 {
+		return nil, errors.New(invalidEncryptedSize)
+	}
+
+	rd.size = body - rd.chunks*gcmTagSize
+	return rd, nil
+}
+
+// fetchStanzas fetches the recipient stanzas following the first bytes of a
+// version 3 header, returning the whole header.
+func fetchStanzas(fetch RangeFetcher, header []byte) ([]byte, error) {
+	size := stanzasSize(header)
+	if size == 0 {
+		return header, nil
+	}
+
+	r, _, err := fetch(int64(len(header)), int64(size))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	stanzas := make([]byte, size)
+	if _, err := io.ReadFull(r, stanzas); err != nil {
+		return nil, errors.New(errorReadingHeader)
+	}
+	return append(header, stanzas...), nil
+}
+
+// Size returns the size of the plaintext.
+func (rd *RangeDecrypter) Size() int64 {
+	return rd.size
+}
+
+// NewReader returns a reader producing length bytes of plaintext starting at
+// offset, or the rest of the plaintext when length is negative.
+func (rd *RangeDecrypter) NewReader(offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > rd.size {
+		return nil, errors.New(invalidRange)
+	}
+
+	if length < 0 || offset+length > rd.size {
+		length = rd.size - offset
+	}
+
+	if rd.legacy {
+		return rd.newLegacyReader(offset, length)
+	}
+
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	sealedSize := rd.chunkSize + gcmTagSize
+	first := offset / rd.chunkSize
+	last := (offset + length - 1) / rd.chunkSize
+
+	headerLen := int64(len(rd.header))
+	start := headerLen + first*sealedSize
+	end := headerLen + (last+1)*sealedSize
+	if end > rd.encryptedSize {
+		end = rd.encryptedSize
+	}
+
+	src, _, err := rd.fetch(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rangeReader{
+		rd:        rd,
+		src:       src,
+		index:     first,
+		skip:      offset - first*rd.chunkSize,
+		remaining: length,
+		chunk:     make([]byte, sealedSize),
+	}, nil
+}
+
+// rangeReader opens the fetched chunks one at a time, the last chunk of the
+// file being opened with the final flag set.
+type rangeReader struct {
+	rd        *RangeDecrypter
+	src       io.ReadCloser
+	index     int64
+	skip      int64
+	remaining int64
+	chunk     []byte
+	opened    []byte
+	out       []byte
+	err       error
+}
+
+func (rr *rangeReader) open() error {
+	sealedSize := int64(len(rr.chunk))
+	final := rr.index == rr.rd.chunks-1
+	if final {
+		sealedSize = rr.rd.encryptedSize - int64(len(rr.rd.header)) - rr.index*int64(len(rr.chunk))
+	}
+
+	if _, err := io.ReadFull(rr.src, rr.chunk[:sealedSize]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	opened, err := rr.rd.aead.Open(rr.opened[:0], chunkNonce(uint64(rr.index), final), rr.chunk[:sealedSize], rr.rd.header)
+	if err != nil {
+		log.Errorf("Failed to authenticate chunk %d", rr.index)
+		return errors.New(chunkAuthenticationFailed)
+	}
+
+	rr.opened = opened
+	rr.out = opened[rr.skip:]
+	if int64(len(rr.out)) > rr.remaining {
+		rr.out = rr.out[:rr.remaining]
+	}
+
+	rr.skip = 0
+	rr.remaining -= int64(len(rr.out))
+	rr.index++
+	return nil
+}
+
+func (rr *rangeReader) Read(b []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		if rr.remaining == 0 {
+			return 0, io.EOF
+		}
+		rr.err = rr.open()
+	}
+
+	n := copy(b, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+func (rr *rangeReader) Close() error {
+	return rr.src.Close()
+}
+
+// legacyRangeReader decrypts a whole legacy file, returning only the range,
+// and reads the rest of the file before EOF to check the HMAC.
+type legacyRangeReader struct {
+	src       io.ReadCloser
+	decrypted io.Reader
+	r         io.Reader
+}
+
+func (rd *RangeDecrypter) newLegacyReader(offset, length int64) (io.ReadCloser, error) {
+	src, _, err := rd.fetch(0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := NewDecryptReader(src, rd.keys)
+	if _, err := io.CopyN(ioutil.Discard, decrypted, offset); err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	return &legacyRangeReader{src: src, decrypted: decrypted, r: io.LimitReader(decrypted, length)}, nil
+}
+
+func (lr *legacyRangeReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	if err == io.EOF {
+		if _, drainErr := io.Copy(ioutil.Discard, lr.decrypted); drainErr != nil {
+			return n, drainErr
+		}
+	}
+	return n, err
+}
+
+func (lr *legacyRangeReader) Close() error {
+	return lr.src.Close()
+}
@@ -0,0 +1,155 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceFetcher serves ranges of an encrypted file held in memory, counting
+// the bytes fetched.
+type sliceFetcher struct {
+	data    []byte
+	fetched int64
+}
+
+func (sf *sliceFetcher) fetch(offset, length int64) (io.ReadCloser, int64, error) {
+	end := int64(len(sf.data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+
+	sf.fetched += end - offset
+	return ioutil.NopCloser(bytes.NewReader(sf.data[offset:end])), int64(len(sf.data)), nil
+}
+
+func TestRangeDecrypter(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	const chunkSize = 100
+	plaintext := randomByte(1050)
+	sf := &sliceFetcher{data: encryptStream(plaintext, keys, chunkSize)}
+
+	rd, err := NewRangeDecrypter(sf.fetch, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(plaintext)), rd.Size())
+
+	rangeTests := []struct {
+		offset, length int64
+		expected       []byte
+		chunks         int64
+	}{
+		{0, -1, plaintext, 11},
+		{0, 10, plaintext[:10], 1},
+		{95, 10, plaintext[95:105], 2},
+		{100, 100, plaintext[100:200], 1},
+		{1000, -1, plaintext[1000:], 1},
+		{1040, 100, plaintext[1040:], 1},
+		{1050, 10, []byte{}, 0},
+		{500, 0, []byte{}, 0},
+	}
+
+	for _, e := range rangeTests {
+		sf.fetched = 0
+
+		r, err := rd.NewReader(e.offset, e.length)
+		assert.Nil(t, err)
+
+		actual, err := ioutil.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, e.expected, actual)
+		assert.True(t, sf.fetched <= e.chunks*(chunkSize+gcmTagSize), "more than the chunks holding the range were fetched")
+	}
+
+	_, err = rd.NewReader(1051, 10)
+	assert.Equal(t, errors.New(invalidRange), err)
+}
+
+func TestRangeDecrypterEmptyFile(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	sf := &sliceFetcher{data: encryptStream(nil, keys, DefaultChunkSize)}
+
+	rd, err := NewRangeDecrypter(sf.fetch, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), rd.Size())
+
+	r, err := rd.NewReader(0, -1)
+	assert.Nil(t, err)
+
+	actual, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Empty(t, actual)
+}
+
+func TestRangeDecrypterTampered(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	const chunkSize = 100
+	const sealedSize = chunkSize + gcmTagSize
+	plaintext := randomByte(1000)
+	ciphertext := encryptStream(plaintext, keys, chunkSize)
+
+	// only the chunks holding the range are authenticated
+	tampered := append([]byte{}, ciphertext...)
+	tampered[streamHeaderLen+5*sealedSize+10] ^= 0x01
+
+	rd, err := NewRangeDecrypter((&sliceFetcher{data: tampered}).fetch, keys)
+	assert.Nil(t, err)
+
+	r, _ := rd.NewReader(0, 500)
+	actual, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext[:500], actual)
+
+	r, _ = rd.NewReader(450, 100)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, errors.New(chunkAuthenticationFailed), err)
+
+	// dropping the last chunk makes the previous one look final
+	rd, err = NewRangeDecrypter((&sliceFetcher{data: ciphertext[:len(ciphertext)-sealedSize]}).fetch, keys)
+	assert.Nil(t, err)
+
+	r, _ = rd.NewReader(850, -1)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, errors.New(chunkAuthenticationFailed), err)
+
+	// a size that can not hold the chunks is refused
+	_, err = NewRangeDecrypter((&sliceFetcher{data: ciphertext[:len(ciphertext)-sealedSize+gcmTagSize-1]}).fetch, keys)
+	assert.Equal(t, errors.New(invalidEncryptedSize), err)
+}
+
+func TestRangeDecrypterLegacyFile(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	ciphertext, _ := ioutil.ReadFile("test_data/test-legacy_encrypted-1")
+	expected, _ := ioutil.ReadFile("test_data/test-encrypt_decrypt_1")
+
+	rd, err := NewRangeDecrypter((&sliceFetcher{data: ciphertext}).fetch, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(expected)), rd.Size())
+
+	r, err := rd.NewReader(100, 200)
+	assert.Nil(t, err)
+
+	actual, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[100:300], actual)
+
+	// the whole file is still authenticated
+	ciphertext[len(ciphertext)-1] ^= 0x01
+	rd, _ = NewRangeDecrypter((&sliceFetcher{data: ciphertext}).fetch, keys)
+
+	r, _ = rd.NewReader(100, 200)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, errors.New(hmacValidationFailed), err)
+}
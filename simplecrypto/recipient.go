@@ -0,0 +1,208 @@
+package simplecrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files can be encrypted to X25519 recipients, without the vault keys: a
+// random file key is wrapped for every recipient in the header of the file,
+// each wrap using the shared secret between a fresh ephemeral key and the
+// public key of the recipient.
+//
+// Recipient stanza layout:
+//
+//	ephemeral public key (32) | sealed file key (32 + 16)
+const (
+	RecipientPrefix = "gcpub1"
+	IdentityPrefix  = "GCSEC1"
+
+	x25519KeySize       = 32
+	fileKeySize         = 32
+	recipientStanzaSize = x25519KeySize + fileKeySize + gcmTagSize
+	maxRecipients       = 255
+
+	identityInfo      = "gcloud-crypto vault identity"
+	recipientWrapInfo = "gcloud-crypto x25519 v1"
+	sealedNameInfo    = "gcloud-crypto sealed name v1"
+
+	invalidRecipient   = "Invalid recipient"
+	invalidIdentity    = "Invalid identity"
+	noRecipients       = "No recipients"
+	tooManyRecipients  = "Too many recipients"
+	noMatchingIdentity = "File is not encrypted to this identity"
+	invalidSealedName  = "Invalid sealed name"
+)
+
+// Recipient is the public key files are encrypted to.
+type Recipient struct {
+	publicKey []byte
+}
+
+// Identity is the private key decrypting the files of its recipient.
+type Identity struct {
+	privateKey []byte
+	publicKey  []byte
+}
+
+func newIdentity(privateKey []byte) (*Identity, error) {
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privateKey: privateKey, publicKey: publicKey}, nil
+}
+
+// NewIdentity returns a random identity.
+func NewIdentity() (*Identity, error) {
+	return newIdentity(randomBytes(x25519KeySize))
+}
+
+// Identity returns the identity of the vault, derived from its keys so that
+// anyone holding them can decrypt the files encrypted to its recipient.
+func (k *Keys) Identity() (*Identity, error) {
+	privateKey := make([]byte, x25519KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.EncryptionKey, nil, []byte(identityInfo)), privateKey); err != nil {
+		return nil, err
+	}
+	return newIdentity(privateKey)
+}
+
+// Recipient returns the recipient of the identity.
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{publicKey: id.publicKey}
+}
+
+func (id *Identity) String() string {
+	return IdentityPrefix + base64.RawURLEncoding.EncodeToString(id.privateKey)
+}
+
+// ParseIdentity parses an identity formatted by String.
+func ParseIdentity(s string) (*Identity, error) {
+	privateKey, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, IdentityPrefix))
+	if err != nil || !strings.HasPrefix(s, IdentityPrefix) || len(privateKey) != x25519KeySize {
+		return nil, errors.New(invalidIdentity)
+	}
+	return newIdentity(privateKey)
+}
+
+func (r *Recipient) String() string {
+	return RecipientPrefix + base64.RawURLEncoding.EncodeToString(r.publicKey)
+}
+
+// ParseRecipient parses a recipient formatted by String.
+func ParseRecipient(s string) (*Recipient, error) {
+	publicKey, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, RecipientPrefix))
+	if err != nil || !strings.HasPrefix(s, RecipientPrefix) || len(publicKey) != x25519KeySize {
+		return nil, errors.New(invalidRecipient)
+	}
+	return &Recipient{publicKey: publicKey}, nil
+}
+
+// newX25519AEAD returns the AEAD keyed by the shared secret of an ephemeral
+// key and a recipient, bound to both public keys. privateKey is the one of
+// either side, and peerPublicKey the public key of the other side.
+func newX25519AEAD(privateKey, peerPublicKey, ephemeralPublicKey, recipientPublicKey []byte, info string) (cipher.AEAD, error) {
+	shared, err := curve25519.X25519(privateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte{}, ephemeralPublicKey...), recipientPublicKey...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTo encrypts plaintext for a recipient, with a fresh ephemeral key. The
+// key of every seal is unique, so a zero nonce is used.
+func sealTo(plaintext []byte, r *Recipient, info string) ([]byte, error) {
+	ephemeral, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newX25519AEAD(ephemeral.privateKey, r.publicKey, ephemeral.publicKey, r.publicKey, info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ephemeral.publicKey, make([]byte, aead.NonceSize()), plaintext, nil), nil
+}
+
+func openWith(sealed []byte, id *Identity, info string) ([]byte, error) {
+	ephemeralPublicKey := sealed[:x25519KeySize]
+
+	aead, err := newX25519AEAD(id.privateKey, ephemeralPublicKey, ephemeralPublicKey, id.publicKey, info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), sealed[x25519KeySize:], nil)
+}
+
+// wrapFileKey returns the stanzas of the header of a file encrypted to
+// recipients.
+func wrapFileKey(fileKey []byte, recipients []*Recipient) ([][]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New(noRecipients)
+	} else if len(recipients) > maxRecipients {
+		return nil, errors.New(tooManyRecipients)
+	}
+
+	stanzas := make([][]byte, len(recipients))
+	for i, r := range recipients {
+		stanza, err := sealTo(fileKey, r, recipientWrapInfo)
+		if err != nil {
+			return nil, err
+		}
+		stanzas[i] = stanza
+	}
+	return stanzas, nil
+}
+
+func unwrapFileKey(stanzas [][]byte, id *Identity) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if fileKey, err := openWith(stanza, id, recipientWrapInfo); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, errors.New(noMatchingIdentity)
+}
+
+// SealName encrypts a file name for a recipient, so that clients holding
+// only the recipient can name the files they upload.
+func SealName(name string, r *Recipient) (string, error) {
+	sealed, err := sealTo([]byte(name), r, sealedNameInfo)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenName decrypts a file name sealed by SealName.
+func OpenName(sealedName string, id *Identity) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(sealedName)
+	if err != nil || len(sealed) < x25519KeySize+gcmTagSize {
+		return "", errors.New(invalidSealedName)
+	}
+
+	name, err := openWith(sealed, id, sealedNameInfo)
+	if err != nil {
+		return "", errors.New(invalidSealedName)
+	}
+	return string(name), nil
+}
@@ -0,0 +1,164 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptToRecipients(plaintext []byte, recipients []*Recipient, chunkSize int) []byte {
+	encryptReader, err := newRecipientEncryptReaderSize(bytes.NewReader(plaintext), recipients, chunkSize)
+	if err != nil {
+		panic(err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(encryptReader)
+	if err != nil {
+		panic(err)
+	}
+	return ciphertext
+}
+
+func vaultRecipient(keys *Keys) *Recipient {
+	id, err := keys.Identity()
+	if err != nil {
+		panic(err)
+	}
+	return id.Recipient()
+}
+
+func TestIdentity(t *testing.T) {
+	keys, otherKeys := NewRandomKeys(), NewRandomKeys()
+
+	id1, err := keys.Identity()
+	assert.Nil(t, err)
+	id2, _ := keys.Identity()
+	assert.Equal(t, id1, id2, "the vault identity should be derived from the keys")
+
+	otherID, _ := otherKeys.Identity()
+	assert.NotEqual(t, id1.publicKey, otherID.publicKey)
+
+	parsedID, err := ParseIdentity(id1.String())
+	assert.Nil(t, err)
+	assert.Equal(t, id1, parsedID)
+
+	parsedRecipient, err := ParseRecipient(id1.Recipient().String())
+	assert.Nil(t, err)
+	assert.Equal(t, id1.Recipient(), parsedRecipient)
+
+	for _, invalid := range []string{"", RecipientPrefix, RecipientPrefix + "AAAA", id1.String(), "x" + id1.Recipient().String()} {
+		_, err := ParseRecipient(invalid)
+		assert.Equal(t, errors.New(invalidRecipient), err, invalid)
+	}
+
+	for _, invalid := range []string{"", IdentityPrefix + "AAAA", id1.Recipient().String()} {
+		_, err := ParseIdentity(invalid)
+		assert.Equal(t, errors.New(invalidIdentity), err, invalid)
+	}
+}
+
+func TestRecipientEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+	keys, otherKeys := NewRandomKeys(), NewRandomKeys()
+	collaborator, _ := NewIdentity()
+
+	recipients := []*Recipient{collaborator.Recipient(), vaultRecipient(keys)}
+
+	for _, chunkSize := range []int{1, 1000, DefaultChunkSize} {
+		for _, size := range []int{0, 1, 999, 1000, 1001, 100000} {
+			plaintext := randomByte(size)
+			ciphertext := encryptToRecipients(plaintext, recipients, chunkSize)
+			assert.Equal(t, encryptedSize(int64(size), int64(chunkSize))+1+2*recipientStanzaSize, int64(len(ciphertext)))
+
+			decrypted, err := ioutil.ReadAll(NewDecryptReader(iotest.OneByteReader(bytes.NewReader(ciphertext)), keys))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted stream does not match")
+
+			_, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(ciphertext), otherKeys))
+			assert.Equal(t, errors.New(noMatchingIdentity), err)
+		}
+	}
+
+	_, err := NewRecipientEncryptReader(bytes.NewReader(nil), nil)
+	assert.Equal(t, errors.New(noRecipients), err)
+}
+
+func TestRecipientDecryptTampered(t *testing.T) {
+	t.Parallel()
+	keys := NewRandomKeys()
+	ciphertext := encryptToRecipients(randomByte(5000), []*Recipient{vaultRecipient(keys)}, 1000)
+
+	tamper := func(i int) []byte {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+
+	tamperTests := []struct {
+		name          string
+		ciphertext    []byte
+		expectedError error
+	}{
+		{"flipped stanza", tamper(streamHeaderLen + 40), errors.New(noMatchingIdentity)},
+		{"flipped ephemeral key", tamper(streamHeaderLen + 1), errors.New(noMatchingIdentity)},
+		{"flipped chunk", tamper(streamHeaderLen + 1 + recipientStanzaSize + 10), errors.New(chunkAuthenticationFailed)},
+		{"truncated stanza", ciphertext[:streamHeaderLen+10], errors.New(errorReadingHeader)},
+	}
+
+	for _, e := range tamperTests {
+		_, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(e.ciphertext), keys))
+		assert.Equal(t, e.expectedError, err, e.name)
+	}
+}
+
+func TestRecipientRangeDecrypter(t *testing.T) {
+	t.Parallel()
+	keys := NewRandomKeys()
+
+	plaintext := randomByte(1050)
+	sf := &sliceFetcher{data: encryptToRecipients(plaintext, []*Recipient{vaultRecipient(keys)}, 100)}
+
+	rd, err := NewRangeDecrypter(sf.fetch, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(plaintext)), rd.Size())
+
+	for _, e := range []struct{ offset, length int64 }{{0, -1}, {95, 10}, {1040, 100}} {
+		r, err := rd.NewReader(e.offset, e.length)
+		assert.Nil(t, err)
+
+		actual, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+
+		end := e.offset + e.length
+		if e.length < 0 || end > int64(len(plaintext)) {
+			end = int64(len(plaintext))
+		}
+		assert.Equal(t, plaintext[e.offset:end], actual)
+	}
+}
+
+func TestSealName(t *testing.T) {
+	keys := NewRandomKeys()
+	id, _ := keys.Identity()
+
+	sealed, err := SealName("camera/2016/img.jpg", id.Recipient())
+	assert.Nil(t, err)
+	assert.NotContains(t, sealed, "img")
+
+	name, err := OpenName(sealed, id)
+	assert.Nil(t, err)
+	assert.Equal(t, "camera/2016/img.jpg", name)
+
+	otherID, _ := NewIdentity()
+	for _, e := range []struct {
+		sealed string
+		id     *Identity
+	}{{sealed, otherID}, {sealed[:10], id}, {"not base64!", id}} {
+		_, err := OpenName(e.sealed, e.id)
+		assert.Equal(t, errors.New(invalidSealedName), err)
+	}
+}
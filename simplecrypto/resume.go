@@ -0,0 +1,97 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ResumableEncrypter encrypts a file again, from any offset of the encrypted
+// file on: the chunks only depend on the header and the keys, so a transfer
+// interrupted midway can go on with the bytes it did not send yet.
+type ResumableEncrypter struct {
+	header    []byte
+	aead      cipher.AEAD
+	chunkSize int64
+}
+
+// EncryptHeader returns the header of the file encrypted by a reader of
+// NewEncryptReader or NewRecipientEncryptReader, or nil for other readers.
+func EncryptHeader(r io.Reader) []byte {
+	if er, ok := r.(*streamEncryptReader); ok {
+		return er.header
+	}
+	return nil
+}
+
+// NewResumableEncrypter returns an encrypter producing the file of header,
+// which must be decryptable with keys.
+func NewResumableEncrypter(header []byte, keys *Keys) (*ResumableEncrypter, error) {
+	if len(header) < streamHeaderLen || !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		return nil, errors.New(errorReadingHeader)
+	}
+
+	switch header[len(streamMagic)] {
+	case streamVersion:
+		if len(header) != streamHeaderLen {
+			return nil, errors.New(errorReadingHeader)
+		}
+	case streamRecipientVersion:
+		if len(header) <= streamHeaderLen || len(header) != streamHeaderLen+1+stanzasSize(header) {
+			return nil, errors.New(errorReadingHeader)
+		}
+	default:
+		return nil, errors.New(unsupportedVersion)
+	}
+
+	h, err := parseStreamHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newHeaderAEAD(h, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &ResumableEncrypter{header: header, aead: aead, chunkSize: int64(h.chunkSize)}, nil
+}
+
+// Size returns the size of the encrypted file holding size bytes of
+// plaintext.
+func (re *ResumableEncrypter) Size(size int64) int64 {
+	return encryptedSize(size, re.chunkSize) - int64(streamHeaderLen) + int64(len(re.header))
+}
+
+// NewReader returns a reader producing the encrypted file from offset on.
+// src is the whole plaintext, read from the start of the chunk holding
+// offset.
+func (re *ResumableEncrypter) NewReader(src io.ReadSeeker, offset int64) (io.Reader, error) {
+	if offset < 0 {
+		return nil, errors.New(invalidRange)
+	}
+
+	headerLen := int64(len(re.header))
+	sealedSize := re.chunkSize + gcmTagSize
+
+	index, skip := int64(0), int64(0)
+	if offset > headerLen {
+		index = (offset - headerLen) / sealedSize
+		skip = offset - headerLen - index*sealedSize
+	}
+
+	if _, err := src.Seek(index*re.chunkSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	er := &streamEncryptReader{src: src, aead: re.aead, header: re.header, chunk: make([]byte, re.chunkSize+1), index: uint64(index)}
+	if offset < headerLen {
+		er.pending = re.header[offset:]
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, er, skip); err != nil {
+		return nil, err
+	}
+	return er, nil
+}
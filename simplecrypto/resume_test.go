@@ -0,0 +1,77 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumableEncrypter(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+	otherKeys, _ := GetKeyFromPassphrase([]byte("barfoo"), []byte("longtestiv123456"), 4096, 16, 1)
+	chunkSize := 1000
+
+	for _, size := range []int{0, 1, 999, 1000, 1001, 4500} {
+		plaintext := randomByte(size)
+
+		encryptReader, _ := newEncryptReaderSize(bytes.NewReader(plaintext), keys, chunkSize)
+		vaultHeader := append([]byte{}, EncryptHeader(encryptReader)...)
+		vaultCiphertext, _ := ioutil.ReadAll(encryptReader)
+
+		recipientCiphertext := encryptToRecipients(plaintext, []*Recipient{vaultRecipient(otherKeys), vaultRecipient(keys)}, chunkSize)
+		recipientHeader := recipientCiphertext[:streamHeaderLen+1+2*recipientStanzaSize]
+
+		for _, c := range []struct {
+			header, ciphertext []byte
+		}{
+			{vaultHeader, vaultCiphertext},
+			{recipientHeader, recipientCiphertext},
+		} {
+			re, err := NewResumableEncrypter(c.header, keys)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(c.ciphertext)), re.Size(int64(size)))
+
+			sealedSize := chunkSize + gcmTagSize
+			for _, offset := range []int{0, 1, streamHeaderLen, len(c.header), len(c.header) + 1, len(c.header) + sealedSize,
+				len(c.header) + sealedSize + 7, len(c.header) + 3*sealedSize - 1, len(c.ciphertext) - 1} {
+				if offset < 0 || offset >= len(c.ciphertext) {
+					continue
+				}
+
+				r, err := re.NewReader(bytes.NewReader(plaintext), int64(offset))
+				assert.Nil(t, err)
+				rest, err := ioutil.ReadAll(r)
+				assert.Nil(t, err)
+				assert.True(t, bytes.Equal(c.ciphertext[offset:], rest), "size %d, offset %d", size, offset)
+			}
+		}
+	}
+}
+
+func TestResumableEncrypterInvalidHeader(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+	header := encryptStream([]byte("data"), keys, 16)[:streamHeaderLen]
+
+	for _, h := range [][]byte{nil, header[:streamHeaderLen-1], append([]byte("NOTMAGI"), header[len(streamMagic):]...), append(header, 0)} {
+		_, err := NewResumableEncrypter(h, keys)
+		assert.NotNil(t, err)
+	}
+
+	// the file key of version 3 files is only unwrapped by a recipient
+	otherKeys, _ := GetKeyFromPassphrase([]byte("barfoo"), []byte("longtestiv123456"), 4096, 16, 1)
+	recipientHeader := encryptToRecipients([]byte("data"), []*Recipient{vaultRecipient(otherKeys)}, 16)[:streamHeaderLen+1+recipientStanzaSize]
+	_, err := NewResumableEncrypter(recipientHeader, keys)
+	assert.NotNil(t, err)
+	_, err = NewResumableEncrypter(recipientHeader, otherKeys)
+	assert.Nil(t, err)
+
+	assert.Nil(t, EncryptHeader(bytes.NewReader(header)))
+
+	re, _ := NewResumableEncrypter(header, keys)
+	_, err = re.NewReader(bytes.NewReader(nil), -1)
+	assert.Equal(t, invalidRange, err.Error())
+}
@@ -0,0 +1,452 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files are encrypted with the STREAM construction: a header followed by
+// chunks of plaintext, each sealed with AES-GCM under a key derived for the
+// file. The nonce of a chunk holds its index and a flag set on the last
+// chunk, so chunks can not be reordered, dropped or truncated at a chunk
+// boundary without failing authentication. The header is authenticated as
+// the additional data of every chunk.
+//
+// Header layout:
+//
+//	magic (7) | version (1) | chunk size (4, big endian) | salt (16)
+//
+// Version 3 files are encrypted to recipients instead of the vault keys, the
+// header goes on with the recipient stanzas wrapping the file key:
+//
+//	recipient count (1) | recipient stanzas
+const (
+	streamMagic            = "GCCRYPT"
+	streamVersion          = 2
+	streamRecipientVersion = 3
+	streamSaltSize         = 16
+	streamHeaderLen        = len(streamMagic) + 1 + 4 + streamSaltSize
+	gcmTagSize             = 16
+
+	// DefaultChunkSize is the amount of plaintext sealed in each chunk.
+	DefaultChunkSize = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+
+	streamKeyInfo          = "gcloud-crypto stream v2"
+	streamRecipientKeyInfo = "gcloud-crypto stream v3"
+
+	errorReadingHeader        = "Unable to read header from file"
+	unsupportedVersion        = "Unsupported file format version"
+	invalidChunkSize          = "Invalid chunk size in header"
+	chunkAuthenticationFailed = "Chunk authentication failed"
+)
+
+type streamHeader struct {
+	version   byte
+	chunkSize uint32
+	salt      []byte
+	stanzas   [][]byte
+}
+
+func (h *streamHeader) marshal() []byte {
+	b := make([]byte, 0, streamHeaderLen)
+	b = append(b, streamMagic...)
+	b = append(b, h.version)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], h.chunkSize)
+	b = append(b, h.salt...)
+
+	if h.version == streamRecipientVersion {
+		b = append(b, byte(len(h.stanzas)))
+		for _, stanza := range h.stanzas {
+			b = append(b, stanza...)
+		}
+	}
+	return b
+}
+
+// stanzasSize returns the size of the recipient stanzas following the first
+// streamHeaderLen+1 bytes of a version 3 header.
+func stanzasSize(b []byte) int {
+	return int(b[streamHeaderLen]) * recipientStanzaSize
+}
+
+// readStreamHeader reads the rest of the header starting with prefix.
+func readStreamHeader(src io.Reader, prefix []byte) ([]byte, error) {
+	length := streamHeaderLen
+	switch prefix[len(streamMagic)] {
+	case streamVersion:
+	case streamRecipientVersion:
+		length++
+	default:
+		return nil, errors.New(unsupportedVersion)
+	}
+
+	header := make([]byte, length)
+	copy(header, prefix)
+	if _, err := io.ReadFull(src, header[len(prefix):]); err != nil {
+		return nil, errors.New(errorReadingHeader)
+	}
+
+	if prefix[len(streamMagic)] != streamRecipientVersion {
+		return header, nil
+	}
+
+	stanzas := make([]byte, stanzasSize(header))
+	if _, err := io.ReadFull(src, stanzas); err != nil {
+		return nil, errors.New(errorReadingHeader)
+	}
+	return append(header, stanzas...), nil
+}
+
+func parseStreamHeader(b []byte) (*streamHeader, error) {
+	h := &streamHeader{
+		version:   b[len(streamMagic)],
+		chunkSize: binary.BigEndian.Uint32(b[len(streamMagic)+1:]),
+		salt:      b[len(streamMagic)+5 : streamHeaderLen],
+	}
+
+	switch h.version {
+	case streamVersion:
+	case streamRecipientVersion:
+		for offset := streamHeaderLen + 1; offset < len(b); offset += recipientStanzaSize {
+			h.stanzas = append(h.stanzas, b[offset:offset+recipientStanzaSize])
+		}
+	default:
+		return nil, errors.New(unsupportedVersion)
+	}
+
+	if h.chunkSize == 0 || h.chunkSize > maxChunkSize {
+		return nil, errors.New(invalidChunkSize)
+	}
+	return h, nil
+}
+
+// newHeaderAEAD returns the AEAD sealing the chunks of the file: the file
+// key of version 3 files is unwrapped with the identity of the vault.
+func newHeaderAEAD(h *streamHeader, keys *Keys) (cipher.AEAD, error) {
+	if h.version != streamRecipientVersion {
+		return newStreamAEAD(keys.EncryptionKey, h.salt, streamKeyInfo)
+	}
+
+	id, err := keys.Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := unwrapFileKey(h.stanzas, id)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamAEAD(fileKey, h.salt, streamRecipientKeyInfo)
+}
+
+// newStreamAEAD derives the key of a file from a secret and the salt of its
+// header.
+func newStreamAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), fileKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedSize returns the size of size bytes of plaintext once encrypted:
+// an empty file still holds one, empty, final chunk.
+func encryptedSize(size, chunkSize int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(streamHeaderLen) + size + chunks*gcmTagSize
+}
+
+// HeaderPrefixSize is how many of the first bytes of an encrypted file
+// PlaintextSize needs to find out its format.
+const HeaderPrefixSize = streamHeaderLen + 1
+
+// PlaintextSize returns the size of the plaintext of an encrypted file from
+// its first HeaderPrefixSize bytes, fewer when the file is shorter, and the
+// size of the whole file, without reading the rest of it. It returns -1 when
+// no file of a known format has that size.
+func PlaintextSize(prefix []byte, encryptedSize int64) int64 {
+	if len(prefix) < len(streamMagic) || !bytes.Equal(prefix[:len(streamMagic)], []byte(streamMagic)) {
+		// legacy files hold an IV and an HMAC around the ciphertext
+		if size := encryptedSize - aes.BlockSize - sha256.Size; size >= 0 {
+			return size
+		}
+		return -1
+	}
+
+	if len(prefix) < HeaderPrefixSize {
+		return -1
+	}
+
+	headerLen := int64(streamHeaderLen)
+	switch prefix[len(streamMagic)] {
+	case streamVersion:
+	case streamRecipientVersion:
+		headerLen += 1 + int64(stanzasSize(prefix))
+	default:
+		return -1
+	}
+
+	chunkSize := binary.BigEndian.Uint32(prefix[len(streamMagic)+1:])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return -1
+	}
+
+	chunks := sealedChunks(encryptedSize-headerLen, int64(chunkSize))
+	if chunks == 0 {
+		return -1
+	}
+	return encryptedSize - headerLen - chunks*gcmTagSize
+}
+
+// sealedChunks returns how many chunks of chunkSize bytes of plaintext the
+// body of an encrypted file holds, or 0 when no body has that size.
+func sealedChunks(body, chunkSize int64) int64 {
+	sealedSize := chunkSize + gcmTagSize
+	chunks := (body + sealedSize - 1) / sealedSize
+
+	if chunks <= 0 || body-(chunks-1)*sealedSize < gcmTagSize {
+		return 0
+	}
+	return chunks
+}
+
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// streamEncryptReader reads one byte past every chunk, to know whether the
+// chunk is the last one before sealing it.
+type streamEncryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	chunk   []byte
+	carry   int
+	index   uint64
+	sealed  []byte
+	pending []byte
+	done    bool
+}
+
+// NewEncryptReader returns a reader producing the encrypted form of src.
+func NewEncryptReader(src io.Reader, keys *Keys) (io.Reader, error) {
+	return newEncryptReaderSize(src, keys, DefaultChunkSize)
+}
+
+func newEncryptReaderSize(src io.Reader, keys *Keys, chunkSize int) (io.Reader, error) {
+	h := &streamHeader{version: streamVersion, chunkSize: uint32(chunkSize), salt: randomBytes(streamSaltSize)}
+
+	aead, err := newStreamAEAD(keys.EncryptionKey, h.salt, streamKeyInfo)
+	if err != nil {
+		log.Error("Unable to initalize AES crypto cipher: ", err.Error())
+		return nil, err
+	}
+	return newStreamEncryptReader(src, aead, h), nil
+}
+
+// NewRecipientEncryptReader returns a reader producing the encrypted form of
+// src, which the identity of any of the recipients can decrypt.
+func NewRecipientEncryptReader(src io.Reader, recipients []*Recipient) (io.Reader, error) {
+	return newRecipientEncryptReaderSize(src, recipients, DefaultChunkSize)
+}
+
+func newRecipientEncryptReaderSize(src io.Reader, recipients []*Recipient, chunkSize int) (io.Reader, error) {
+	fileKey := randomBytes(fileKeySize)
+
+	stanzas, err := wrapFileKey(fileKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &streamHeader{version: streamRecipientVersion, chunkSize: uint32(chunkSize), salt: randomBytes(streamSaltSize), stanzas: stanzas}
+
+	aead, err := newStreamAEAD(fileKey, h.salt, streamRecipientKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamEncryptReader(src, aead, h), nil
+}
+
+func newStreamEncryptReader(src io.Reader, aead cipher.AEAD, h *streamHeader) *streamEncryptReader {
+	header := h.marshal()
+	return &streamEncryptReader{src: src, aead: aead, header: header, chunk: make([]byte, int(h.chunkSize)+1), pending: header}
+}
+
+func (er *streamEncryptReader) seal() error {
+	chunkSize := len(er.chunk) - 1
+
+	n, err := io.ReadFull(er.src, er.chunk[er.carry:])
+	n += er.carry
+
+	switch err {
+	case nil:
+		er.sealed = er.aead.Seal(er.sealed[:0], chunkNonce(er.index, false), er.chunk[:chunkSize], er.header)
+		er.chunk[0] = er.chunk[chunkSize]
+		er.carry = 1
+		er.index++
+	case io.EOF, io.ErrUnexpectedEOF:
+		er.sealed = er.aead.Seal(er.sealed[:0], chunkNonce(er.index, true), er.chunk[:n], er.header)
+		er.done = true
+	default:
+		return err
+	}
+
+	er.pending = er.sealed
+	return nil
+}
+
+func (er *streamEncryptReader) Read(b []byte) (int, error) {
+	if len(er.pending) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, er.pending)
+	er.pending = er.pending[n:]
+	return n, nil
+}
+
+// streamDecryptReader mirrors streamEncryptReader: the last chunk is the one
+// followed by EOF, and is opened with the final flag set.
+type streamDecryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  []byte
+	carry  int
+	index  uint64
+	opened []byte
+	out    []byte
+	done   bool
+	err    error
+}
+
+func newStreamDecryptReader(src io.Reader, keys *Keys, header []byte) (*streamDecryptReader, error) {
+	h, err := parseStreamHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newHeaderAEAD(h, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamDecryptReader{src: src, aead: aead, header: header, chunk: make([]byte, int(h.chunkSize)+aead.Overhead()+1)}, nil
+}
+
+func (dr *streamDecryptReader) open() error {
+	sealedSize := len(dr.chunk) - 1
+
+	n, err := io.ReadFull(dr.src, dr.chunk[dr.carry:])
+	n += dr.carry
+
+	var openErr error
+	switch err {
+	case nil:
+		dr.opened, openErr = dr.aead.Open(dr.opened[:0], chunkNonce(dr.index, false), dr.chunk[:sealedSize], dr.header)
+		dr.chunk[0] = dr.chunk[sealedSize]
+		dr.carry = 1
+		dr.index++
+	case io.EOF, io.ErrUnexpectedEOF:
+		dr.opened, openErr = dr.aead.Open(dr.opened[:0], chunkNonce(dr.index, true), dr.chunk[:n], dr.header)
+		dr.done = true
+	default:
+		return err
+	}
+
+	if openErr != nil {
+		log.Errorf("Failed to authenticate chunk %d", dr.index)
+		return errors.New(chunkAuthenticationFailed)
+	}
+
+	dr.out = dr.opened
+	return nil
+}
+
+func (dr *streamDecryptReader) Read(b []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.open()
+	}
+
+	n := copy(b, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// decryptReader picks the format of the file from its first bytes: files
+// without the magic are legacy AES-CTR files.
+type decryptReader struct {
+	src  io.Reader
+	keys *Keys
+	r    io.Reader
+	err  error
+}
+
+// NewDecryptReader returns a reader producing the plaintext of src. Reading
+// returns an error instead of io.EOF when authentication fails. Plaintext
+// is only returned once authenticated, except for legacy files, which must
+// not be trusted until EOF is reached.
+func NewDecryptReader(src io.Reader, keys *Keys) io.Reader {
+	return &decryptReader{src: src, keys: keys}
+}
+
+func (dr *decryptReader) init() (io.Reader, error) {
+	prefix := make([]byte, len(streamMagic)+1)
+	n, err := io.ReadFull(dr.src, prefix)
+
+	if err != nil || !bytes.Equal(prefix[:len(streamMagic)], []byte(streamMagic)) {
+		return &legacyDecryptReader{src: io.MultiReader(bytes.NewReader(prefix[:n]), dr.src), keys: dr.keys}, nil
+	}
+
+	header, err := readStreamHeader(dr.src, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamDecryptReader(dr.src, dr.keys, header)
+}
+
+func (dr *decryptReader) Read(b []byte) (int, error) {
+	if dr.r == nil {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.r, dr.err = dr.init(); dr.err != nil {
+			return 0, dr.err
+		}
+	}
+	return dr.r.Read(b)
+}
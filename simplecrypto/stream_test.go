@@ -0,0 +1,162 @@
+package simplecrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptStream(plaintext []byte, keys *Keys, chunkSize int) []byte {
+	encryptReader, err := newEncryptReaderSize(bytes.NewReader(plaintext), keys, chunkSize)
+	if err != nil {
+		panic(err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(encryptReader)
+	if err != nil {
+		panic(err)
+	}
+	return ciphertext
+}
+
+func TestEncryptDecryptReader(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	for _, chunkSize := range []int{1, 16, 1000, DefaultChunkSize} {
+		for _, size := range []int{0, 1, 15, 16, 17, 999, 1000, 1001, 4096, 100000} {
+			plaintext := randomByte(size)
+
+			encryptReader, err := newEncryptReaderSize(bytes.NewReader(plaintext), keys, chunkSize)
+			assert.Nil(t, err)
+
+			ciphertext, err := ioutil.ReadAll(iotest.HalfReader(encryptReader))
+			assert.Nil(t, err)
+			assert.Equal(t, encryptedSize(int64(size), int64(chunkSize)), int64(len(ciphertext)))
+
+			decrypted, err := ioutil.ReadAll(NewDecryptReader(iotest.OneByteReader(bytes.NewReader(ciphertext)), keys))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted stream does not match")
+		}
+	}
+}
+
+func TestPlaintextSize(t *testing.T) {
+	t.Parallel()
+	keys := NewRandomKeys()
+	collaborator, _ := NewIdentity()
+	recipients := []*Recipient{collaborator.Recipient(), vaultRecipient(keys)}
+
+	prefix := func(ciphertext []byte) []byte {
+		if len(ciphertext) > HeaderPrefixSize {
+			return ciphertext[:HeaderPrefixSize]
+		}
+		return ciphertext
+	}
+
+	for _, size := range []int{0, 1, 999, 1000, 1001, 3*1000 + 10} {
+		for _, ciphertext := range [][]byte{
+			encryptStream(randomByte(size), keys, 1000),
+			encryptToRecipients(randomByte(size), recipients, 1000),
+		} {
+			assert.Equal(t, int64(size), PlaintextSize(prefix(ciphertext), int64(len(ciphertext))), size)
+		}
+	}
+
+	// legacy files are told apart by their lack of magic
+	ciphertext, _ := ioutil.ReadFile("test_data/test-legacy_encrypted-1")
+	expected, _ := ioutil.ReadFile("test_data/test-encrypt_decrypt_1")
+	assert.Equal(t, int64(len(expected)), PlaintextSize(prefix(ciphertext), int64(len(ciphertext))))
+
+	header := encryptStream(nil, keys, 1000)
+	unsupported := append([]byte(nil), header...)
+	unsupported[len(streamMagic)] = 9
+	for _, test := range []struct {
+		prefix        []byte
+		encryptedSize int64
+	}{
+		{header, int64(streamHeaderLen) + gcmTagSize - 1},
+		{header, int64(streamHeaderLen) + 1000 + gcmTagSize + 1},
+		{header[:streamHeaderLen], int64(streamHeaderLen)},
+		{unsupported, int64(streamHeaderLen)},
+		{ciphertext[:10], aes.BlockSize + sha256.Size - 1},
+	} {
+		assert.Equal(t, int64(-1), PlaintextSize(test.prefix, test.encryptedSize), test.encryptedSize)
+	}
+}
+
+func TestDecryptReaderTampered(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	const chunkSize = 100
+	const sealedSize = chunkSize + gcmTagSize
+	ciphertext := encryptStream(randomByte(1000), keys, chunkSize)
+	chunks := ciphertext[streamHeaderLen:]
+
+	tamper := func(pos int) []byte {
+		c := append([]byte{}, ciphertext...)
+		c[pos] ^= 0x01
+		return c
+	}
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tamperTests := []struct {
+		name          string
+		ciphertext    []byte
+		expectedError error
+	}{
+		{"flipped bit", tamper(streamHeaderLen + 500), errors.New(chunkAuthenticationFailed)},
+		{"flipped salt", tamper(streamHeaderLen - 1), errors.New(chunkAuthenticationFailed)},
+		{"changed chunk size", tamper(len(streamMagic) + 4), errors.New(chunkAuthenticationFailed)},
+		{"unknown version", concat(ciphertext[:len(streamMagic)], []byte{9}, ciphertext[len(streamMagic)+1:]), errors.New(unsupportedVersion)},
+		{"truncated header", ciphertext[:streamHeaderLen-1], errors.New(errorReadingHeader)},
+		{"truncated chunk", ciphertext[:len(ciphertext)-1], errors.New(chunkAuthenticationFailed)},
+		{"truncated at chunk boundary", ciphertext[:streamHeaderLen+5*sealedSize], errors.New(chunkAuthenticationFailed)},
+		{"dropped chunk", concat(ciphertext[:streamHeaderLen], chunks[sealedSize:]), errors.New(chunkAuthenticationFailed)},
+		{"swapped chunks", concat(ciphertext[:streamHeaderLen], chunks[sealedSize:2*sealedSize], chunks[:sealedSize], chunks[2*sealedSize:]), errors.New(chunkAuthenticationFailed)},
+		{"appended chunk", concat(ciphertext, chunks[:sealedSize]), errors.New(chunkAuthenticationFailed)},
+	}
+
+	for _, e := range tamperTests {
+		_, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(e.ciphertext), keys))
+		assert.Equal(t, e.expectedError, err, e.name)
+	}
+}
+
+func TestDecryptReaderOnlyReturnsAuthenticatedChunks(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	const chunkSize = 100
+	plaintext := randomByte(1000)
+	ciphertext := encryptStream(plaintext, keys, chunkSize)
+
+	// corrupt the fourth chunk
+	ciphertext[streamHeaderLen+3*(chunkSize+gcmTagSize)+10] ^= 0x01
+
+	decrypted, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(ciphertext), keys))
+	assert.Equal(t, errors.New(chunkAuthenticationFailed), err)
+	assert.Equal(t, plaintext[:3*chunkSize], decrypted)
+}
+
+func TestDecryptReaderWrongKey(t *testing.T) {
+	t.Parallel()
+	keys, _ := GetKeyFromPassphrase([]byte("foobar"), []byte("longtestiv123456"), 4096, 16, 1)
+	wrongKeys, _ := GetKeyFromPassphrase([]byte("barfoo"), []byte("longtestiv123456"), 4096, 16, 1)
+
+	ciphertext := encryptStream(randomByte(1000), keys, DefaultChunkSize)
+
+	decrypted, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(ciphertext), wrongKeys))
+	assert.Equal(t, errors.New(chunkAuthenticationFailed), err)
+	assert.Empty(t, decrypted)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+)
+
+// stateFileName names a file kept on disk for a vault after id and its keys,
+// without revealing anything about either.
+func stateFileName(dir string, keys *simplecrypto.Keys, id, ext string) string {
+	mac := hmac.New(sha256.New, keys.HMACKey)
+	mac.Write([]byte(id))
+	return filepath.Join(dir, hex.EncodeToString(mac.Sum(nil)[:16])+ext)
+}
+
+// readStateFile reads a file written by writeStateFile.
+func readStateFile(file string, keys *simplecrypto.Keys) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(simplecrypto.NewDecryptReader(f, keys))
+}
+
+// writeStateFile writes data encrypted with the vault keys, through a
+// temporary file so an interrupted write never leaves a truncated file
+// behind.
+func writeStateFile(file string, keys *simplecrypto.Keys, data []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".state-")
+	if err != nil {
+		return err
+	}
+
+	encryptedReader, err := simplecrypto.NewEncryptReader(bytes.NewReader(data), keys)
+	if err == nil {
+		_, err = io.Copy(tmp, encryptedReader)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const defaultConcurrency = 4
+
+// transferFailure is a file an upload or a download failed on.
+type transferFailure struct {
+	file string
+	err  error
+}
+
+// transferError reports every file a glob upload or download failed on,
+// out of total files, instead of only the first failure.
+type transferError struct {
+	op       string
+	total    int
+	failures []transferFailure
+}
+
+func (te *transferError) Error() string {
+	lines := []string{fmt.Sprintf("%d of %d files failed to %s:", len(te.failures), te.total, te.op)}
+	for _, f := range te.failures {
+		lines = append(lines, fmt.Sprintf("  %s: %s", f.file, f.err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runTransfers calls transfer for every job, running up to concurrency of
+// them at once, and returns their errors in the order of the jobs.
+func runTransfers(concurrency, jobs int, transfer func(i int) error) []error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	errs := make([]error, jobs)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < jobs; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = transfer(i)
+		}(i)
+	}
+
+	wg.Wait()
+	return errs
+}
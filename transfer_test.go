@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTransfers(t *testing.T) {
+	for _, concurrency := range []int{0, 1, 3, 50} {
+		var (
+			mu            sync.Mutex
+			running, peak int
+			transferred   = make([]bool, 20)
+			expectedLimit = concurrency
+		)
+		if expectedLimit < 1 {
+			expectedLimit = 1
+		}
+
+		errs := runTransfers(concurrency, len(transferred), func(i int) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			transferred[i] = true
+			mu.Unlock()
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+
+			if i%5 == 0 {
+				return errors.New(errFakeInjected)
+			}
+			return nil
+		})
+
+		assert.True(t, peak <= expectedLimit, "at most %d transfers should run at once", expectedLimit)
+		for i, err := range errs {
+			assert.True(t, transferred[i])
+			if i%5 == 0 {
+				assert.Equal(t, errors.New(errFakeInjected), err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+}
+
+func TestTransferError(t *testing.T) {
+	te := &transferError{op: "upload", total: 3, failures: []transferFailure{
+		{"a.txt", errors.New(errFakeInjected)},
+		{"b.txt", errors.New(hashMismatchErr)},
+	}}
+	assert.Equal(t, "2 of 3 files failed to upload:\n  a.txt: fake: injected failure\n  b.txt: hash mismatch of uploaded file", te.Error())
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
+	"io"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
 	_ "github.com/GregorioDiStefano/go-file-storage/log"
@@ -31,82 +35,138 @@ func (c *client) reuseExistingEncryptedPath(fullPlaintextRemoteUploadPath string
 	return ""
 }
 
-func (c *client) prepareAndDoUpload(uploadFile, remoteUploadPath string) error {
-	finalEncryptedUploadPath := ""
+// reserveUpload picks the encrypted path of a file about to be uploaded,
+// unless one is given, and adds it to the cache, so files uploaded at the
+// same time to a new directory share its encrypted path, and the same file
+// is never uploaded twice.
+func (c *client) reserveUpload(remoteUploadPath, finalEncryptedUploadPath string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for e := range c.bcache.seenFiles {
-		plaintextFilepath, err := decryptFilePath(e, c.keys)
-		if err != nil {
-			log.Errorf("Unable to decrypt filepath: %s", e)
-			continue
-		}
+	for _, plaintextFilepath := range c.bcache.seenFiles {
 		if plaintextFilepath == remoteUploadPath {
 			log.Infof("this file already exists: %s", plaintextFilepath)
-			return errors.New(fileAlreadyExistsError)
+			return "", errors.New(fileAlreadyExistsError)
 		}
 	}
 
-	encryptedFile, md5Hash, err := simplecrypto.EncryptFile(uploadFile, c.keys)
+	if err := c.beginManifestUpdate(); err != nil {
+		return "", err
+	}
+
+	if finalEncryptedUploadPath == "" {
+		finalEncryptedUploadPath = c.reuseExistingEncryptedPath(remoteUploadPath)
+	}
+	if finalEncryptedUploadPath == "" {
+		finalEncryptedUploadPath = encryptFilePath(remoteUploadPath, c.keys)
+	}
+
+	c.bcache.addFile(finalEncryptedUploadPath, remoteUploadPath)
+	return finalEncryptedUploadPath, nil
+}
+
+func (c *client) prepareAndDoUpload(uploadFile, remoteUploadPath string) error {
+	file, err := os.Open(uploadFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	fileStat, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
-	if finalEncryptedUploadPath = c.reuseExistingEncryptedPath(remoteUploadPath); finalEncryptedUploadPath == "" {
-		finalEncryptedUploadPath = encryptFilePath(remoteUploadPath, c.keys)
+	if rb, ok := c.bucket.(resumableBucket); ok && c.isResumable(fileStat.Size()) {
+		return c.doResumableUpload(rb, file, fileStat, uploadFile, remoteUploadPath)
 	}
 
-	if err := c.bucket.Upload(encryptedFile, finalEncryptedUploadPath, md5Hash); err != nil {
+	// the file is encrypted while it is being uploaded, so no encrypted copy
+	// is ever written to disk, and hashed for the manifest on the way
+	hash := sha256.New()
+	pt := &PassThrough{Reader: io.TeeReader(file, hash), contentLength: fileStat.Size(), task: "Uploading", name: uploadFile}
+	defer pt.finish()
+
+	encryptedReader, err := c.newEncryptReader(pt)
+	if err != nil {
 		return err
 	}
 
-	c.bcache.addFile(finalEncryptedUploadPath, remoteUploadPath)
-	return nil
+	finalEncryptedUploadPath, err := c.reserveUpload(remoteUploadPath, "")
+	if err != nil {
+		return err
+	}
+
+	err = c.bucket.Upload(encryptedReader, finalEncryptedUploadPath)
+	c.endUpload(remoteUploadPath, finalEncryptedUploadPath, fileStat, hash.Sum(nil), err)
+	return err
 }
 
+// endUpload adds an uploaded file to the manifest, or removes it from the
+// cache when its upload failed.
+func (c *client) endUpload(remoteUploadPath, finalEncryptedUploadPath string, fileStat os.FileInfo, sha256Hash []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.bcache.removeFile(remoteUploadPath)
+		return
+	}
+
+	c.manifestAdd(remoteUploadPath, manifestEntry{
+		Object:   finalEncryptedUploadPath,
+		Size:     fileStat.Size(),
+		ModTime:  fileStat.ModTime().UTC(),
+		Uploaded: time.Now().UTC(),
+		SHA256:   sha256Hash,
+	})
+}
+
+// processUpload uploads the files matching uploadPath, c.concurrency at a
+// time. Files already in the bucket are skipped; the other failures do not
+// stop the upload, they are all reported once every file has been tried.
 func (c *client) processUpload(uploadPath, remoteDirectory string) error {
 	globMatches := globMatchWithDirectories(uploadPath)
-	errorOccuredWhileUploading := false
 
 	if len(globMatches) == 0 {
 		return errors.New(fileNotFoundError)
 	}
 
 	// cache the list of all files before we start uploading
-	objects, err := c.bucket.List()
-
-	if err != nil {
-		log.Fatal("Unable to load remote objects")
+	if _, err := c.listFiles(); err != nil {
+		log.Error("Unable to load remote objects")
 		return err
 	}
+	defer c.endManifestUpdate()
 
-	for _, encryptedFile := range objects {
-		decryptedFile, _ := decryptFilePath(encryptedFile, c.keys)
-		c.bcache.addFile(encryptedFile, decryptedFile)
-	}
-
-	for _, fileToUpload := range globMatches {
+	errs := runTransfers(c.concurrency, len(globMatches), func(i int) error {
+		fileToUpload := globMatches[i]
 		newUploadDirectory := ""
 		if strings.Contains(uploadPath, "*") {
 			newUploadDirectory = filepath.Join(remoteDirectory, relativePathFromGlob(uploadPath, fileToUpload))
 		} else {
 			newUploadDirectory = filepath.Join(remoteDirectory, fileToUpload)
 		}
-		if err := c.prepareAndDoUpload(fileToUpload, newUploadDirectory); err != nil {
-			if err != nil {
-				errorOccuredWhileUploading = true
-				switch err.Error() {
-				case fileAlreadyExistsError:
-					log.Info("file already exists, skipping upload.")
-				default:
-					log.Infof("failed with %s when uploading: %s", err.Error(), fileToUpload)
-					return err
-				}
-			}
+		return c.prepareAndDoUpload(fileToUpload, newUploadDirectory)
+	})
+
+	skipped := false
+	te := &transferError{op: "upload", total: len(globMatches)}
+	for i, err := range errs {
+		switch {
+		case err == nil:
+		case err.Error() == fileAlreadyExistsError:
+			log.Info("file already exists, skipping upload.")
+			skipped = true
+		default:
+			log.Infof("failed with %s when uploading: %s", err.Error(), globMatches[i])
+			te.failures = append(te.failures, transferFailure{globMatches[i], err})
 		}
 	}
 
-	if errorOccuredWhileUploading {
+	if len(te.failures) > 0 {
+		return te
+	} else if skipped {
 		return errors.New(fileUploadFailError)
 	}
 
@@ -14,7 +14,7 @@ import (
 
 func TestDoUpload(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	cleanUp(c)
 
 	randomFileTestFilename := randomFile()
@@ -129,7 +129,7 @@ func TestDoUpload(t *testing.T) {
 
 func TestDoUploadResume(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	defer cleanUp(c)
 
 	err := c.processUpload("testdata/testdata1", "")
@@ -155,7 +155,7 @@ func TestDoUploadResume(t *testing.T) {
 
 func TestDoUploadDirectoryAndResume(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	defer cleanUp(c)
 
 	expectedOutput := []string{
@@ -192,7 +192,7 @@ func TestDoUploadDirectoryAndResume(t *testing.T) {
 
 func TestExistingDirectoriesReused(t *testing.T) {
 	bs, keys := setupUp()
-	c := &client{&keys, bs, bucketCache{}}
+	c := newClient(&keys, bs)
 	defer cleanUp(c)
 
 	identicalRemoteDirectories := []string{}
@@ -210,7 +210,7 @@ func TestExistingDirectoriesReused(t *testing.T) {
 	encryptedFilesInBucket, err := c.bucket.List()
 	assert.Empty(t, err)
 
-	for _, e := range encryptedFilesInBucket {
+	for _, e := range objectNames(encryptedFilesInBucket) {
 		if !searchForString(identicalRemoteEncryptedDirectories, filepath.Dir(e)) {
 			identicalRemoteEncryptedDirectories = append(identicalRemoteEncryptedDirectories, filepath.Dir(e))
 		}
@@ -218,3 +218,96 @@ func TestExistingDirectoriesReused(t *testing.T) {
 
 	assert.Equal(t, len(identicalRemoteEncryptedDirectories), len(identicalRemoteDirectories))
 }
+
+func TestDoUploadFaults(t *testing.T) {
+	allFiles := []string{"testdata/testdata1", "testdata/testdata2", "testdata/testdata3", "testdata/testdata4", "testdata/testdata5", "testdata/testdata6"}
+
+	uploadFaultTests := []struct {
+		failUpload  int
+		md5Mismatch bool
+
+		expectedError     error
+		expectedFailed    []string
+		expectedStructure []string
+	}{
+		{0, true, errors.New(hashMismatchErr), allFiles, nil},
+		{1, false, errors.New(errFakeInjected), allFiles[:1], allFiles[1:]},
+		{3, false, errors.New(errFakeInjected), allFiles[2:3], []string{"testdata/testdata1", "testdata/testdata2", "testdata/testdata4", "testdata/testdata5", "testdata/testdata6"}},
+	}
+
+	for _, e := range uploadFaultTests {
+		fb := newFakeBucket()
+		fb.failUpload = e.failUpload
+		fb.md5Mismatch = e.md5Mismatch
+
+		keys := testKeys()
+		c := newClient(&keys, fb)
+
+		// every file is tried, and every failure reported
+		err := c.processUpload("testdata/testdata*", "testdata")
+		te, ok := err.(*transferError)
+		assert.True(t, ok)
+		assert.Equal(t, len(allFiles), te.total)
+
+		failed := []string{}
+		for _, f := range te.failures {
+			failed = append(failed, f.file)
+			assert.Equal(t, e.expectedError, f.err)
+		}
+		assert.Equal(t, e.expectedFailed, failed)
+
+		filesInBucket, err := c.getFileList("")
+		assert.Nil(t, err)
+		assert.Equal(t, e.expectedStructure, filesInBucket)
+	}
+}
+
+func TestDoUploadParallel(t *testing.T) {
+	fb := newFakeBucket()
+	keys := testKeys()
+	c := newClient(&keys, fb)
+	c.useManifest = true
+	c.concurrency = 4
+
+	assert.Nil(t, c.processUpload("testdata/*", "parallel"))
+
+	sequential := newClient(&keys, newFakeBucket())
+	assert.Nil(t, sequential.processUpload("testdata/*", "parallel"))
+
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	expected, _ := sequential.getFileList("")
+	assert.Equal(t, expected, files)
+
+	// files uploaded at once to a new directory share its encrypted path
+	encryptedDirs := map[string]bool{}
+	for _, object := range objectNames(mustList(fb)) {
+		if !isReservedObject(object) {
+			encryptedDirs[filepath.Dir(object)] = true
+		}
+	}
+	plaintextDirs, _ := c.getDirList("")
+	assert.Equal(t, len(plaintextDirs), len(encryptedDirs))
+
+	m, err := readManifest(fb, c.keys)
+	assert.Nil(t, err)
+	assert.Len(t, m.Files, len(files))
+	assert.True(t, manifestFresh(fb, c.keys))
+}
+
+func mustList(b Bucket) []objectInfo {
+	objects, err := b.List()
+	if err != nil {
+		panic(err)
+	}
+	return objects
+}
+
+func TestDoUploadListFails(t *testing.T) {
+	bs, keys := brokenSetupUp()
+	c := newClient(&keys, bs)
+
+	err := c.processUpload("testdata/testdata1", "")
+	assert.Error(t, err)
+	assert.Equal(t, 0, bs.uploads)
+}
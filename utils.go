@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -22,19 +21,10 @@ func isStringInSlice(s string, list []string) bool {
 	return false
 }
 
-func getDecryptedToEncryptedFileMapping(encryptedFilePaths []string, key *simplecrypto.Keys) decryptedToEncryptedFilePath {
-	m := make(decryptedToEncryptedFilePath, len(encryptedFilePaths))
-	for _, e := range encryptedFilePaths {
-		plainTextFilepath, err := decryptFilePath(e, key)
-
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		m[plainTextFilepath] = e
-	}
-
-	return m
+// getDecryptedToEncryptedFileMapping maps the decrypted paths of the listed
+// objects to their encrypted paths, through the name cache.
+func (c *client) getDecryptedToEncryptedFileMapping(encryptedFilePaths []string) decryptedToEncryptedFilePath {
+	return c.bcache.refresh(encryptedFilePaths, c.keys)
 }
 
 func encryptFilePath(path string, key *simplecrypto.Keys) string {
@@ -51,29 +41,19 @@ func encryptFilePath(path string, key *simplecrypto.Keys) string {
 }
 
 func decryptFilePath(encryptedPath string, key *simplecrypto.Keys) (string, error) {
-	splitPath := strings.Split(encryptedPath, "/")
-	decryptedPath := []string{}
-
-	for _, e := range splitPath {
-		if e == PASSWORD_CHECK_FILE {
-			continue
-		} else if t, err := simplecrypto.DecryptText(e, key.EncryptionKey); err == nil {
-			decryptedPath = append(decryptedPath, t)
-		} else {
-			return "", errors.New("failed to decrypt file: " + encryptedPath)
-		}
-	}
-
-	entireDecryptedPath := strings.Join(decryptedPath, "/")
-	return entireDecryptedPath, nil
+	return newNameDecrypter(key).decryptPath(encryptedPath)
 }
 
 func enumeratePrint(items []string) {
+	enumerateFprint(os.Stdout, items)
+}
+
+func enumerateFprint(w io.Writer, items []string) {
 	if len(items) > 0 {
 		count := 0
 		for _, e := range items {
 			if e != "" {
-				fmt.Println(fmt.Sprintf("%d:\t%s", count, e))
+				fmt.Fprintln(w, fmt.Sprintf("%d:\t%s", count, e))
 				count++
 			}
 		}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	VAULT_HEADER_FILE    = "vaultheader"
+	VAULT_MIGRATION_FILE = "vaultheader.migration"
+
+	// vaultHeaderVersion is written by new vaults, older headers are still
+	// read: version 1 headers use the keys derived from the password as the
+	// vault keys, version 2 headers wrap them in a single key slot.
+	vaultHeaderVersion       = 3
+	vaultHeaderDerivedKeysV1 = 1
+	vaultHeaderWrappedKeyV2  = 2
+
+	errVaultHeaderVersion = "unsupported vault header version"
+	errInvalidVaultHeader = "invalid vault header"
+	errWrongPassword      = "failed to verify password"
+	errVaultNotLegacy     = "this vault already has a vault header, there is nothing to migrate"
+	errVaultLegacy        = "this vault has no vault header, run 'migrate' first"
+)
+
+// vaultHeader is stored, as JSON, in the VAULT_HEADER_FILE object of every
+// vault. It holds the random vault keys, wrapped in key slots unlocked by
+// different passwords or keyfiles, and the other recipients files are
+// encrypted to. Version 1 headers hold what is needed to
+// derive the keys from the password and a check value encrypted with them.
+type vaultHeader struct {
+	Version int       `json:"version"`
+	Slots   []keySlot `json:"slots,omitempty"`
+
+	Recipients    []vaultRecipient `json:"recipients,omitempty"`
+	RecipientsMAC []byte           `json:"recipients_mac,omitempty"`
+
+	// version 1 and 2 headers
+	KDF        *simplecrypto.KDFParams `json:"kdf,omitempty"`
+	Check      string                  `json:"check,omitempty"`
+	WrappedKey []byte                  `json:"wrapped_key,omitempty"`
+}
+
+// legacyKDFParams derives the keys of legacy vaults, tests replace it
+// with cheaper parameters.
+var legacyKDFParams = func() *simplecrypto.KDFParams {
+	return simplecrypto.LegacyKDFParams(legacySalt())
+}
+
+// isReservedObject is true for the objects holding the vault metadata,
+// which are not encrypted files.
+func isReservedObject(name string) bool {
+	switch name {
+	case PASSWORD_CHECK_FILE, VAULT_HEADER_FILE, VAULT_MIGRATION_FILE, VAULT_MANIFEST_FILE, VAULT_MANIFEST_PENDING_FILE:
+		return true
+	}
+	return false
+}
+
+// newVaultHeader creates the header of a new vault, with random keys in a
+// default key slot unlocked by password, returning the keys along with it.
+func newVaultHeader(password []byte, kdf *simplecrypto.KDFParams) (*vaultHeader, *simplecrypto.Keys, error) {
+	keys := simplecrypto.NewRandomKeys()
+
+	slot, err := newKeySlot(defaultKeySlot, password, kdf, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &vaultHeader{Version: vaultHeaderVersion, Slots: []keySlot{*slot}}, keys, nil
+}
+
+// unlockSlot returns the vault keys and the index of the key slot unlocked
+// by secret, or -1 for version 1 headers.
+func (vh *vaultHeader) unlockSlot(secret []byte) (*simplecrypto.Keys, int, error) {
+	if vh.Version == vaultHeaderDerivedKeysV1 {
+		keys, err := vh.KDF.DeriveKeys(secret)
+		if err != nil {
+			return nil, -1, err
+		}
+
+		if plainText, err := simplecrypto.DecryptText(vh.Check, keys.EncryptionKey); err != nil || plainText != PASSWORD_CHECK_STRING {
+			return nil, -1, errors.New(errWrongPassword)
+		}
+		return keys, -1, nil
+	}
+
+	for i := range vh.Slots {
+		if keys, err := vh.Slots[i].unlock(secret); err == nil {
+			return keys, i, nil
+		}
+	}
+	return nil, -1, errors.New(errWrongPassword)
+}
+
+// unlock returns the vault keys, if secret unlocks any key slot.
+func (vh *vaultHeader) unlock(secret []byte) (*simplecrypto.Keys, error) {
+	keys, _, err := vh.unlockSlot(secret)
+	return keys, err
+}
+
+func readVaultHeader(bucket Bucket, name string) (*vaultHeader, error) {
+	download, _, err := bucket.Download(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer download.Close()
+
+	data, err := ioutil.ReadAll(download)
+	if err != nil {
+		return nil, err
+	}
+	return parseVaultHeader(data)
+}
+
+// parseVaultHeader decodes a vault header, version 2 headers are turned into
+// a single key slot.
+func parseVaultHeader(data []byte) (*vaultHeader, error) {
+	vh := &vaultHeader{}
+	if err := json.Unmarshal(data, vh); err != nil {
+		return nil, err
+	}
+
+	switch vh.Version {
+	case vaultHeaderVersion:
+		if len(vh.Slots) == 0 {
+			return nil, errors.New(errInvalidVaultHeader)
+		}
+	case vaultHeaderWrappedKeyV2:
+		if vh.KDF == nil {
+			return nil, errors.New(errInvalidVaultHeader)
+		}
+		slot := keySlot{Name: defaultKeySlot, KDF: *vh.KDF, WrappedKey: vh.WrappedKey}
+		vh = &vaultHeader{Version: vaultHeaderVersion, Slots: []keySlot{slot}}
+	case vaultHeaderDerivedKeysV1:
+		if vh.KDF == nil {
+			return nil, errors.New(errInvalidVaultHeader)
+		}
+	default:
+		return nil, errors.New(errVaultHeaderVersion)
+	}
+	return vh, nil
+}
+
+func writeVaultHeader(bucket Bucket, name string, vh *vaultHeader) error {
+	data, err := json.Marshal(vh)
+	if err != nil {
+		return err
+	}
+	return bucket.Upload(bytes.NewReader(data), name)
+}
+
+// unlockVault returns the keys of the vault. Vaults created before vault
+// headers derive their keys from the legacy salt and are verified with the
+// PASSWORD_CHECK_FILE object; the returned bool is true for those.
+func unlockVault(bucket Bucket, password []byte) (*simplecrypto.Keys, bool, error) {
+	vh, err := readVaultHeader(bucket, VAULT_HEADER_FILE)
+	if err == nil {
+		keys, err := vh.unlock(password)
+		return keys, false, err
+	}
+
+	log.WithFields(logrus.Fields{"error": err}).Debug("no vault header, trying the legacy password check")
+
+	keys, err := legacyKDFParams().DeriveKeys(password)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if err := verifyPassword(bucket, keys); err != nil {
+		return nil, true, err
+	}
+	return keys, true, nil
+}
+
+// reencryptObject downloads an object with the old keys and uploads it
+// under a new name with the new keys, before deleting the old object.
+func reencryptObject(bucket Bucket, encryptedPath, plaintextPath string, oldKeys, newKeys *simplecrypto.Keys) error {
+	download, _, err := bucket.Download(encryptedPath, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer download.Close()
+
+	encryptedReader, err := simplecrypto.NewEncryptReader(simplecrypto.NewDecryptReader(download, oldKeys), newKeys)
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Upload(encryptedReader, encryptFilePath(plaintextPath, newKeys)); err != nil {
+		return err
+	}
+	return bucket.Delete(encryptedPath)
+}
+
+// doMigrate moves a legacy vault to a vault header with random keys,
+// re-encrypting every filename and file with them. The
+// new header is kept in VAULT_MIGRATION_FILE until every object has been
+// migrated, so an interrupted migration can be resumed by running it again.
+func (c *client) doMigrate(password []byte) error {
+	oldKeys, legacy, err := unlockVault(c.bucket, password)
+	if err != nil {
+		return err
+	} else if !legacy {
+		return errors.New(errVaultNotLegacy)
+	}
+
+	var newKeys *simplecrypto.Keys
+	vh, err := readVaultHeader(c.bucket, VAULT_MIGRATION_FILE)
+
+	if err == nil {
+		log.Info("Resuming interrupted migration")
+		if newKeys, err = vh.unlock(password); err != nil {
+			return err
+		}
+	} else {
+		if vh, newKeys, err = newVaultHeader(password, newKDFParams()); err != nil {
+			return err
+		}
+		if err := writeVaultHeader(c.bucket, VAULT_MIGRATION_FILE, vh); err != nil {
+			return err
+		}
+	}
+
+	// the manifest is encrypted with the old keys until every file is migrated
+	oldManifest, _ := readManifest(c.bucket, oldKeys)
+
+	objects, err := c.bucket.List()
+	if err != nil {
+		return errors.New("failed getting objects: " + err.Error())
+	}
+
+	// the files migrated before the migration was interrupted, the old
+	// objects of which may be left
+	migrated := map[string]bool{}
+	legacyObjects := map[string]string{}
+	for _, encryptedPath := range objectNames(objects) {
+		if isReservedObject(encryptedPath) {
+			continue
+		}
+
+		plaintextPath, err := decryptFilePath(encryptedPath, oldKeys)
+		if err != nil {
+			if plaintextPath, err := decryptFilePath(encryptedPath, newKeys); err == nil {
+				migrated[plaintextPath] = true
+				continue
+			}
+			return err
+		}
+		legacyObjects[encryptedPath] = plaintextPath
+	}
+
+	for _, encryptedPath := range objectNames(objects) {
+		plaintextPath, ok := legacyObjects[encryptedPath]
+		if !ok {
+			continue
+		}
+
+		if migrated[plaintextPath] {
+			log.Infof("Removing the migrated: %s", plaintextPath)
+			if err := c.bucket.Delete(encryptedPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Infof("Migrating: %s", plaintextPath)
+		if err := reencryptObject(c.bucket, encryptedPath, plaintextPath, oldKeys, newKeys); err != nil {
+			return err
+		}
+	}
+
+	if err := writeVaultHeader(c.bucket, VAULT_HEADER_FILE, vh); err != nil {
+		return err
+	}
+
+	for _, name := range []string{VAULT_MIGRATION_FILE, PASSWORD_CHECK_FILE} {
+		if err := c.bucket.Delete(name); err != nil {
+			log.WithFields(logrus.Fields{"object": name, "error": err}).Warn("unable to remove object left by the migration")
+		}
+	}
+
+	c.keys, c.manifest = newKeys, nil
+	c.forgetRecipients()
+	c.bcache.empty()
+	c.migrateManifest(oldManifest)
+	return nil
+}
+
+// migrateManifest replaces the manifest encrypted with the old keys of a
+// migrated vault by one rebuilt with the new keys, keeping what the old one
+// knew about the files. Without useManifest, the old one is removed.
+func (c *client) migrateManifest(old *manifest) {
+	if !c.useManifest {
+		if err := c.bucket.Delete(VAULT_MANIFEST_FILE); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Debug("no manifest to remove")
+		}
+		return
+	}
+
+	if _, err := c.rebuildManifest(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warn("unable to write the manifest, it will be rebuilt")
+		c.manifest = nil
+		return
+	}
+
+	if old == nil || c.manifest == nil {
+		return
+	}
+
+	for plaintextPath, entry := range c.manifest.Files {
+		if known, ok := old.Files[plaintextPath]; ok && entry.Size < 0 {
+			known.Object = entry.Object
+			c.manifest.Files[plaintextPath] = known
+			c.manifest.dirty = true
+		}
+	}
+	c.endManifestUpdate()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-crypto/simplecrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKDFParams() *simplecrypto.KDFParams {
+	return &simplecrypto.KDFParams{Algorithm: simplecrypto.KDFScrypt, Salt: randomByte(32), N: 1024, R: 8, P: 1}
+}
+
+// setupLegacyVault fills a bucket like the ones created before vault headers,
+// using the keys of the simplecrypto legacy test file.
+func setupLegacyVault(t *testing.T) (*fakeBucket, *simplecrypto.Keys, func()) {
+	originalLegacyKDFParams := legacyKDFParams
+	legacyKDFParams = func() *simplecrypto.KDFParams {
+		return &simplecrypto.KDFParams{Algorithm: simplecrypto.KDFScrypt, Salt: []byte("longtestiv123456"), N: 4096, R: 16, P: 1}
+	}
+
+	fb := newFakeBucket()
+	legacyKeys, _ := legacyKDFParams().DeriveKeys([]byte("foobar"))
+	c := newClient(legacyKeys, fb)
+
+	keyCheck, _ := simplecrypto.EncryptText(PASSWORD_CHECK_STRING, legacyKeys.EncryptionKey)
+	assert.Nil(t, fb.Upload(strings.NewReader(keyCheck), PASSWORD_CHECK_FILE))
+
+	legacyFile, _ := ioutil.ReadFile("simplecrypto/test_data/test-legacy_encrypted-1")
+	assert.Nil(t, fb.Upload(bytes.NewReader(legacyFile), encryptFilePath("old/legacy.bin", legacyKeys)))
+
+	uploadContent(c, "docs/a.txt", []byte("some text"))
+	uploadContent(c, "docs/b.txt", []byte("more text"))
+
+	return fb, legacyKeys, func() { legacyKDFParams = originalLegacyKDFParams }
+}
+
+func TestLegacySalt(t *testing.T) {
+	salt := legacySalt()
+	assert.Len(t, salt, 64)
+	assert.Equal(t, make([]byte, 32), salt[:32])
+	assert.Equal(t, []byte{0, 1, 2, 3}, salt[32:36])
+	assert.Equal(t, byte(31), salt[63])
+}
+
+func TestVaultHeader(t *testing.T) {
+	fb := newFakeBucket()
+
+	vh, keys, err := newVaultHeader([]byte("password"), testKDFParams())
+	assert.Nil(t, err)
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, vh))
+
+	readHeader, err := readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, vh, readHeader)
+
+	unlockedKeys, legacy, err := unlockVault(fb, []byte("password"))
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+	assert.Equal(t, keys, unlockedKeys)
+
+	_, _, err = unlockVault(fb, []byte("wrong"))
+	assert.Equal(t, errors.New(errWrongPassword), err)
+
+	vh.Version = vaultHeaderVersion + 1
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, vh))
+	_, err = readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Equal(t, errors.New(errVaultHeaderVersion), err)
+}
+
+func TestUnlockLegacyVault(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	keys, legacy, err := unlockVault(fb, []byte("foobar"))
+	assert.Nil(t, err)
+	assert.True(t, legacy)
+	assert.Equal(t, legacyKeys, keys)
+
+	_, _, err = unlockVault(fb, []byte("wrong"))
+	assert.Error(t, err)
+
+	// the metadata objects are not listed as files
+	c := newClient(keys, fb)
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"docs/a.txt", "docs/b.txt", "old/legacy.bin"}, files)
+}
+
+func assertMigrated(t *testing.T, fb *fakeBucket, c *client) {
+	keys, legacy, err := unlockVault(fb, []byte("foobar"))
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+	assert.Equal(t, c.keys, keys)
+
+	assert.NotContains(t, fb.objects, PASSWORD_CHECK_FILE)
+	assert.NotContains(t, fb.objects, VAULT_MIGRATION_FILE)
+
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"docs/a.txt", "docs/b.txt", "old/legacy.bin"}, files)
+
+	var out bytes.Buffer
+	assert.Nil(t, c.doCat("docs/a.txt", "", &out))
+	assert.Equal(t, "some text", out.String())
+
+	out.Reset()
+	expected, _ := ioutil.ReadFile("simplecrypto/test_data/test-encrypt_decrypt_1")
+	assert.Nil(t, c.doCat("old/legacy.bin", "", &out))
+	assert.Equal(t, expected, out.Bytes())
+}
+
+func TestDoMigrate(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	c := newClient(legacyKeys, fb)
+
+	assert.Error(t, c.doMigrate([]byte("wrong")))
+	assert.NotContains(t, fb.objects, VAULT_MIGRATION_FILE)
+
+	assert.Nil(t, c.doMigrate([]byte("foobar")))
+	assert.NotEqual(t, legacyKeys, c.keys)
+	assertMigrated(t, fb, c)
+
+	assert.Equal(t, errors.New(errVaultNotLegacy), c.doMigrate([]byte("foobar")))
+	assert.NotContains(t, fb.objects, VAULT_MANIFEST_FILE)
+}
+
+func TestDoMigrateManifest(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	c := newManifestClient(fb)
+	c.keys = legacyKeys
+	uploadThroughClient(t, c, "docs/c.txt", []byte("uploaded with the manifest"))
+
+	assert.Nil(t, c.doMigrate([]byte("foobar")))
+
+	// the manifest is rebuilt with the new keys, without the old objects
+	m, err := readManifest(fb, c.keys)
+	assert.Nil(t, err)
+	assert.Len(t, m.Files, 4)
+	for _, entry := range m.Files {
+		assert.Contains(t, fb.objects, entry.Object)
+		_, err := decryptFilePath(entry.Object, c.keys)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int64(len("uploaded with the manifest")), m.Files["docs/c.txt"].Size)
+	assert.True(t, manifestFresh(fb, c.keys))
+
+	lists := fb.lists
+	files, err := c.getFileList("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"docs/a.txt", "docs/b.txt", "docs/c.txt", "old/legacy.bin"}, files)
+
+	other := newManifestClient(fb)
+	other.keys = c.keys
+	files, err = other.getFileList("")
+	assert.Nil(t, err)
+	assert.Len(t, files, 4)
+	assert.Equal(t, lists, fb.lists)
+}
+
+func TestDoMigrateResume(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	c := newClient(legacyKeys, fb)
+
+	// the migration header and the first file are uploaded, then it fails
+	fb.failUpload = fb.uploads + 3
+	assert.Equal(t, errors.New(errFakeInjected), c.doMigrate([]byte("foobar")))
+	assert.Equal(t, legacyKeys, c.keys)
+	assert.Contains(t, fb.objects, VAULT_MIGRATION_FILE)
+
+	migrationHeader, err := readVaultHeader(fb, VAULT_MIGRATION_FILE)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.doMigrate([]byte("foobar")))
+	assertMigrated(t, fb, c)
+
+	vh, err := readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, migrationHeader, vh)
+}
+
+func TestDoMigrateResumeAfterFailedDelete(t *testing.T) {
+	fb, legacyKeys, done := setupLegacyVault(t)
+	defer done()
+
+	c := newClient(legacyKeys, fb)
+	objects := len(fb.objects)
+
+	// the first file is uploaded with the new keys, but its old object stays
+	fb.deleteErr = errors.New(errFakeInjected)
+	assert.Equal(t, fb.deleteErr, c.doMigrate([]byte("foobar")))
+	assert.Equal(t, objects+2, len(fb.objects))
+	fb.deleteErr = nil
+
+	uploads := fb.uploads
+	assert.Nil(t, c.doMigrate([]byte("foobar")))
+	assertMigrated(t, fb, c)
+
+	// only the files left were uploaded again, along with the vault header
+	// replacing the key check
+	assert.Equal(t, uploads+2+1, fb.uploads)
+	assert.Equal(t, objects, len(fb.objects))
+}
+
+func TestUnlockVaultHeaderV1(t *testing.T) {
+	fb := newFakeBucket()
+
+	kdf := testKDFParams()
+	derivedKeys, _ := kdf.DeriveKeys([]byte("password"))
+	check, _ := simplecrypto.EncryptText(PASSWORD_CHECK_STRING, derivedKeys.EncryptionKey)
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, &vaultHeader{Version: vaultHeaderDerivedKeysV1, KDF: kdf, Check: check}))
+
+	keys, legacy, err := unlockVault(fb, []byte("password"))
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+	assert.Equal(t, derivedKeys, keys)
+
+	_, _, err = unlockVault(fb, []byte("wrong"))
+	assert.Equal(t, errors.New(errWrongPassword), err)
+}
+
+func TestReadVaultHeaderV2(t *testing.T) {
+	fb := newFakeBucket()
+
+	kdf := testKDFParams()
+	slot, _ := newKeySlot(defaultKeySlot, []byte("password"), kdf, simplecrypto.NewRandomKeys())
+	assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, &vaultHeader{Version: vaultHeaderWrappedKeyV2, KDF: kdf, WrappedKey: slot.WrappedKey}))
+
+	vh, err := readVaultHeader(fb, VAULT_HEADER_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, &vaultHeader{Version: vaultHeaderVersion, Slots: []keySlot{*slot}}, vh)
+
+	invalidHeaders := []*vaultHeader{
+		{Version: vaultHeaderVersion},
+		{Version: vaultHeaderWrappedKeyV2},
+		{Version: vaultHeaderDerivedKeysV1},
+	}
+
+	for _, invalid := range invalidHeaders {
+		assert.Nil(t, writeVaultHeader(fb, VAULT_HEADER_FILE, invalid))
+		_, err := readVaultHeader(fb, VAULT_HEADER_FILE)
+		assert.Equal(t, errors.New(errInvalidVaultHeader), err)
+	}
+}